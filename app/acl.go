@@ -0,0 +1,942 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Max number of entries kept in the ACL LOG. (acllog-max-len)
+const aclLogMaxLen = 128
+
+// Denials of the same kind within this window get grouped into the same ACL LOG entry.
+const aclLogGroupingWindow = 60 * time.Second
+
+// Sets up the acl users at startup: the default user (with requirepass as its password
+// if set), or whatever is in the aclfile if one is configured.
+func setupACL(aclFile string, requirePass string) {
+	CONFIG.acl = RedisACL{
+		users: make(map[string]*ACLUser),
+		file:  aclFile,
+	}
+	CONFIG.acl.users["default"] = newDefaultUser(requirePass)
+
+	if aclFile == "" {
+		return
+	}
+	if _, err := os.Stat(aclFile); err != nil { // nothing saved yet, starting from the default user
+		fmt.Println("aclfile not found. Proceeding anyway...")
+		return
+	}
+	users, err := loadACLFile(aclFile)
+	if err != nil {
+		logAndExit("error loading the aclfile", err)
+	}
+	CONFIG.acl.users = users
+}
+
+// Creates the default user. Can run anything, and doesn't need a password unless one is given.
+func newDefaultUser(password string) *ACLUser {
+	user := newACLUser("default")
+	for _, rule := range []string{"on", "allkeys", "allchannels", "allcommands"} {
+		user.applyRule(rule)
+	}
+	user.setPassword(password)
+	return user
+}
+
+// Creates a new user with no permissions at all. (disabled, no passwords)
+func newACLUser(name string) *ACLUser {
+	return &ACLUser{
+		name:      name,
+		passwords: make(map[string]struct{}),
+		root:      &ACLSelector{},
+	}
+}
+
+// Replaces the passwords of the user with the given one. An empty password means nopass.
+// This is how requirepass applies to the default user.
+func (user *ACLUser) setPassword(password string) {
+	user.applyRule("resetpass")
+	if password == "" {
+		user.applyRule("nopass")
+		return
+	}
+	user.applyRule(">" + password)
+}
+
+// Returns a deep copy of the user, so changes can be applied all-or-nothing.
+func (user *ACLUser) clone() *ACLUser {
+	clone := &ACLUser{
+		name:      user.name,
+		enabled:   user.enabled,
+		nopass:    user.nopass,
+		passwords: make(map[string]struct{}, len(user.passwords)),
+		root:      user.root.clone(),
+	}
+	for hash := range user.passwords {
+		clone.passwords[hash] = struct{}{}
+	}
+	for _, selector := range user.selectors {
+		clone.selectors = append(clone.selectors, selector.clone())
+	}
+	return clone
+}
+
+func (selector *ACLSelector) clone() *ACLSelector {
+	return &ACLSelector{
+		commandRules:    append([]string{}, selector.commandRules...),
+		keyPatterns:     append([]ACLKeyPattern{}, selector.keyPatterns...),
+		channelPatterns: append([]string{}, selector.channelPatterns...),
+	}
+}
+
+// Applies a single ACL SETUSER rule to the user. Selector rules (commands, keys, channels)
+// apply to the root selector, a "(...)" rule adds a new selector.
+func (user *ACLUser) applyRule(rule string) error {
+	if strings.HasPrefix(rule, "(") && strings.HasSuffix(rule, ")") {
+		selector := &ACLSelector{}
+		for _, selectorRule := range strings.Fields(rule[1 : len(rule)-1]) {
+			if err := selector.applyRule(selectorRule); err != nil {
+				return err
+			}
+		}
+		user.selectors = append(user.selectors, selector)
+		return nil
+	}
+
+	if rule == "" {
+		return fmt.Errorf("Syntax error")
+	}
+
+	switch strings.ToLower(rule) {
+	case "on":
+		user.enabled = true
+		return nil
+	case "off":
+		user.enabled = false
+		return nil
+	case "nopass":
+		user.nopass = true
+		user.passwords = make(map[string]struct{})
+		return nil
+	case "resetpass":
+		user.nopass = false
+		user.passwords = make(map[string]struct{})
+		return nil
+	case "clearselectors":
+		user.selectors = nil
+		return nil
+	case "reset":
+		user.enabled = false
+		user.nopass = false
+		user.passwords = make(map[string]struct{})
+		user.root = &ACLSelector{}
+		user.selectors = nil
+		return nil
+	}
+
+	switch rule[0] {
+	case '>': // add password
+		user.nopass = false
+		user.passwords[hashPassword(rule[1:])] = struct{}{}
+		return nil
+
+	case '<': // remove password
+		hash := hashPassword(rule[1:])
+		if _, exists := user.passwords[hash]; !exists {
+			return fmt.Errorf("The password you are trying to remove from the user does not exist")
+		}
+		delete(user.passwords, hash)
+		return nil
+
+	case '#': // add password hash
+		hash := rule[1:]
+		if !isValidPasswordHash(hash) {
+			return fmt.Errorf("The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+		}
+		user.nopass = false
+		user.passwords[hash] = struct{}{}
+		return nil
+
+	case '!': // remove password hash
+		hash := rule[1:]
+		if !isValidPasswordHash(hash) {
+			return fmt.Errorf("The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+		}
+		if _, exists := user.passwords[hash]; !exists {
+			return fmt.Errorf("The password you are trying to remove from the user does not exist")
+		}
+		delete(user.passwords, hash)
+		return nil
+	}
+
+	return user.root.applyRule(rule)
+}
+
+// Applies a single rule (commands, keys or channels) to the selector.
+func (selector *ACLSelector) applyRule(rule string) error {
+	switch strings.ToLower(rule) {
+	case "allkeys":
+		rule = "~*"
+	case "resetkeys":
+		selector.keyPatterns = nil
+		return nil
+	case "allchannels":
+		rule = "&*"
+	case "resetchannels":
+		selector.channelPatterns = nil
+		return nil
+	case "allcommands":
+		rule = "+@all"
+	case "nocommands":
+		rule = "-@all"
+	}
+
+	switch {
+	case strings.HasPrefix(rule, "~"):
+		selector.addKeyPattern(ACLKeyPattern{pattern: rule[1:], read: true, write: true})
+		return nil
+
+	case strings.HasPrefix(rule, "%"):
+		permissions, pattern, found := strings.Cut(rule[1:], "~")
+		if !found || permissions == "" {
+			return fmt.Errorf("Syntax error")
+		}
+		keyPattern := ACLKeyPattern{pattern: pattern}
+		for _, p := range strings.ToUpper(permissions) {
+			switch p {
+			case 'R':
+				keyPattern.read = true
+			case 'W':
+				keyPattern.write = true
+			default:
+				return fmt.Errorf("Syntax error")
+			}
+		}
+		selector.addKeyPattern(keyPattern)
+		return nil
+
+	case strings.HasPrefix(rule, "&"):
+		pattern := rule[1:]
+		if pattern == "*" {
+			selector.channelPatterns = nil
+		}
+		if !selector.hasChannelPattern("*") && !selector.hasChannelPattern(pattern) {
+			selector.channelPatterns = append(selector.channelPatterns, pattern)
+		}
+		return nil
+
+	case strings.HasPrefix(rule, "+"), strings.HasPrefix(rule, "-"):
+		rule = strings.ToLower(rule)
+		if !isValidCommandRule(rule[1:]) {
+			return fmt.Errorf("Unknown command or category name in ACL")
+		}
+		if rule[1:] == "@all" { // everything before this is overridden anyway
+			selector.commandRules = nil
+		}
+		selector.commandRules = append(selector.commandRules, rule)
+		return nil
+	}
+
+	return fmt.Errorf("Syntax error")
+}
+
+func (selector *ACLSelector) addKeyPattern(keyPattern ACLKeyPattern) {
+	if keyPattern.pattern == "*" && keyPattern.read && keyPattern.write { // allkeys covers every other pattern
+		selector.keyPatterns = nil
+	}
+	for _, existing := range selector.keyPatterns {
+		if existing == keyPattern {
+			return
+		}
+	}
+	selector.keyPatterns = append(selector.keyPatterns, keyPattern)
+}
+
+func (selector *ACLSelector) hasChannelPattern(pattern string) bool {
+	for _, existing := range selector.channelPatterns {
+		if existing == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks that the target of a +/- rule is a known command, subcommand (cmd|sub) or category.
+func isValidCommandRule(target string) bool {
+	if strings.HasPrefix(target, "@") {
+		category := target[1:]
+		if category == "all" {
+			return true
+		}
+		for _, c := range aclCategories {
+			if c == category {
+				return true
+			}
+		}
+		return false
+	}
+
+	name, subcommandName, hasSubcommand := strings.Cut(target, "|")
+	command, exists := commandTable[name]
+	if !exists {
+		return false
+	}
+	if hasSubcommand {
+		_, exists = command.subcommands[subcommandName]
+	}
+	return exists
+}
+
+// Returns true if the selector's command rules allow the command to run.
+func (selector *ACLSelector) commandAllowed(command RedisCommand) bool {
+	containerName, _, _ := strings.Cut(command.name, "|")
+
+	allowed := false
+	for _, rule := range selector.commandRules {
+		add := rule[0] == '+'
+		target := rule[1:]
+
+		if strings.HasPrefix(target, "@") {
+			if target == "@all" || commandInCategory(command, target[1:]) {
+				allowed = add
+			}
+		} else if target == command.name || target == containerName {
+			allowed = add
+		}
+	}
+	return allowed
+}
+
+// Returns true if one of the selector's key patterns gives the access required for the key.
+func (selector *ACLSelector) keyAllowed(key string, read bool, write bool) bool {
+	for _, keyPattern := range selector.keyPatterns {
+		if (read && !keyPattern.read) || (write && !keyPattern.write) {
+			continue
+		}
+		if stringMatch(keyPattern.pattern, key, false) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the connection's user can read every key, through any of its selectors.
+// SORT needs it for BY and GET: their patterns can reach any key.
+func canReadAllKeys(conn net.Conn) bool {
+	if isSuperConnection(conn) {
+		return true
+	}
+	user, authenticated := connectionUser(conn)
+	if !authenticated {
+		return false
+	}
+	for _, selector := range append([]*ACLSelector{user.root}, user.selectors...) {
+		for _, keyPattern := range selector.keyPatterns {
+			if keyPattern.pattern == "*" && keyPattern.read {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns true if one of the selector's channel patterns matches the channel.
+// isPattern is for PSUBSCRIBE: the pattern itself has to be allowed literally.
+func (selector *ACLSelector) channelAllowed(channel string, isPattern bool) bool {
+	for _, pattern := range selector.channelPatterns {
+		if pattern == "*" || (isPattern && pattern == channel) || (!isPattern && stringMatch(pattern, channel, false)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks the command against a single selector. Returns the reason for the denial
+// ("command", "key" or "channel") and the denied object, or "" if it's allowed.
+func (selector *ACLSelector) check(command RedisCommand, commands []string) (reason string, object string) {
+	if !selector.commandAllowed(command) {
+		return "command", command.name
+	}
+
+	keys := commandKeys(command, commands)
+	access := commandKeyAccess(command, commands, keys)
+	for i, key := range keys {
+		read := strings.Contains(access[i], "R")
+		write := strings.Contains(access[i], "W")
+		if !selector.keyAllowed(key, read, write) {
+			return "key", key
+		}
+	}
+
+	for _, channel := range commandChannels(command, commands) {
+		if !selector.channelAllowed(channel, command.name == "psubscribe" || command.name == "punsubscribe") {
+			return "channel", channel
+		}
+	}
+	return "", ""
+}
+
+// Checks if the user can run the command. The command is allowed if the root permissions or
+// any of the selectors allow it entirely. When denied, the root selector's reason is returned.
+func (user *ACLUser) check(command RedisCommand, commands []string) (reason string, object string) {
+	reason, object = user.root.check(command, commands)
+	if reason == "" {
+		return "", ""
+	}
+	for _, selector := range user.selectors {
+		if selectorReason, _ := selector.check(command, commands); selectorReason == "" {
+			return "", ""
+		}
+	}
+	return reason, object
+}
+
+// Returns the pub/sub channels the command operates on (none, until there are pub/sub commands).
+func commandChannels(command RedisCommand, commands []string) []string {
+	switch command.name {
+	case "subscribe", "psubscribe":
+		return commands[1:]
+	case "publish":
+		return commands[1:2]
+	}
+	return nil
+}
+
+// Returns true if the password is valid for the user.
+func (user *ACLUser) checkPassword(password string) bool {
+	if !user.enabled {
+		return false
+	}
+	if user.nopass {
+		return true
+	}
+	_, exists := user.passwords[hashPassword(password)]
+	return exists
+}
+
+// Returns the hex encoded sha-256 hash of the password. Passwords are never stored in plain text.
+func hashPassword(password string) string {
+	hash := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(hash[:])
+}
+
+func isValidPasswordHash(hash string) bool {
+	if len(hash) != 64 {
+		return false
+	}
+	for _, c := range hash {
+		if !(c >= '0' && c <= '9') && !(c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Describes the user's rules, the way ACL LIST and the aclfile show them.
+func (user *ACLUser) describe() string {
+	rules := []string{"user", user.name}
+	if user.enabled {
+		rules = append(rules, "on")
+	} else {
+		rules = append(rules, "off")
+	}
+	if user.nopass {
+		rules = append(rules, "nopass")
+	}
+	for _, hash := range user.sortedPasswords() {
+		rules = append(rules, "#"+hash)
+	}
+	rules = append(rules, user.root.describe())
+	for _, selector := range user.selectors {
+		rules = append(rules, "("+selector.describe()+")")
+	}
+	return strings.Join(rules, " ")
+}
+
+func (user *ACLUser) sortedPasswords() []string {
+	hashes := make([]string, 0, len(user.passwords))
+	for hash := range user.passwords {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	return hashes
+}
+
+// Describes the selector's keys, channels and commands rules, space separated.
+func (selector *ACLSelector) describe() string {
+	rules := make([]string, 0, 3)
+	if keys := selector.describeKeys(); keys != "" {
+		rules = append(rules, keys)
+	}
+	rules = append(rules, selector.describeChannels(), selector.describeCommands())
+	return strings.Join(rules, " ")
+}
+
+func (selector *ACLSelector) describeKeys() string {
+	patterns := make([]string, 0, len(selector.keyPatterns))
+	for _, keyPattern := range selector.keyPatterns {
+		switch {
+		case keyPattern.read && keyPattern.write:
+			patterns = append(patterns, "~"+keyPattern.pattern)
+		case keyPattern.read:
+			patterns = append(patterns, "%R~"+keyPattern.pattern)
+		default:
+			patterns = append(patterns, "%W~"+keyPattern.pattern)
+		}
+	}
+	return strings.Join(patterns, " ")
+}
+
+func (selector *ACLSelector) describeChannels() string {
+	if len(selector.channelPatterns) == 0 {
+		return "resetchannels"
+	}
+	patterns := make([]string, 0, len(selector.channelPatterns))
+	for _, pattern := range selector.channelPatterns {
+		patterns = append(patterns, "&"+pattern)
+	}
+	return strings.Join(patterns, " ")
+}
+
+func (selector *ACLSelector) describeCommands() string {
+	if len(selector.commandRules) == 0 {
+		return "-@all"
+	}
+	rules := selector.commandRules
+	if rules[0] != "+@all" && rules[0] != "-@all" {
+		rules = append([]string{"-@all"}, rules...)
+	}
+	return strings.Join(rules, " ")
+}
+
+// Merges selector rules that got split over several arguments ("(+get", "~key)") back
+// into a single "(...)" rule.
+func mergeSelectorRules(rules []string) ([]string, error) {
+	merged := make([]string, 0, len(rules))
+	for i := 0; i < len(rules); i++ {
+		rule := rules[i]
+		if !strings.HasPrefix(rule, "(") || strings.HasSuffix(rule, ")") {
+			merged = append(merged, rule)
+			continue
+		}
+
+		start := i
+		for i++; ; i++ {
+			if i >= len(rules) {
+				return nil, fmt.Errorf("ERR Unmatched parenthesis in acl selector starting at '%s'.", rules[start])
+			}
+			rule += " " + rules[i]
+			if strings.HasSuffix(rules[i], ")") {
+				break
+			}
+		}
+		merged = append(merged, rule)
+	}
+	return merged, nil
+}
+
+// Applies the rules to a copy of the user (or a new user), so a bad rule leaves it untouched.
+func setUserRules(name string, rules []string) (*ACLUser, error) {
+	rules, err := mergeSelectorRules(rules)
+	if err != nil {
+		return nil, err
+	}
+
+	user := newACLUser(name)
+	if existing, exists := CONFIG.acl.users[name]; exists {
+		user = existing.clone()
+	}
+	for _, rule := range rules {
+		if err := user.applyRule(rule); err != nil {
+			return nil, fmt.Errorf("ERR Error in ACL SETUSER modifier '%s': %s", rule, err)
+		}
+	}
+	return user, nil
+}
+
+// Returns the user the connection is authenticated as. Connections that never called AUTH
+// are authenticated as the default user, as long as it doesn't need a password.
+func connectionUser(conn net.Conn) (*ACLUser, bool) {
+	client, exists := CONFIG.clients[conn]
+	if !exists {
+		return nil, false
+	}
+	if client.user != "" {
+		user, exists := CONFIG.acl.users[client.user]
+		return user, exists
+	}
+
+	defaultUser := CONFIG.acl.users["default"]
+	if defaultUser.enabled && defaultUser.nopass {
+		client.user = "default"
+		return defaultUser, true
+	}
+	return nil, false
+}
+
+// Returns true for connections that bypass auth and acls: internal execution (nil) and the master link.
+func isSuperConnection(conn net.Conn) bool {
+	return conn == nil || (CONFIG.masterConn != nil && conn == CONFIG.masterConn)
+}
+
+// Closes every connection authenticated as one of the users. Used when users get deleted.
+func disconnectUsers(names map[string]struct{}) {
+	for _, client := range CONFIG.clients {
+		if _, exists := names[client.user]; exists {
+			client.user = ""
+			client.conn.Close()
+		}
+	}
+}
+
+// Adds a denied request to the ACL LOG, grouping it with a recent identical denial if there is one.
+func addACLLogEntry(reason string, object string, username string, conn net.Conn) {
+	context := "toplevel"
+	if CONFIG.inExec {
+		context = "multi"
+	}
+	clientInfo := ""
+	if conn != nil {
+		clientInfo = fmt.Sprintf("addr=%s", conn.RemoteAddr())
+	}
+	now := time.Now()
+
+	for i, entry := range CONFIG.acl.log {
+		if entry.reason == reason && entry.context == context && entry.object == object &&
+			entry.username == username && now.Sub(entry.updatedAt) < aclLogGroupingWindow {
+			entry.count++
+			entry.updatedAt = now
+			entry.clientInfo = clientInfo
+
+			// move it back to the front, it's the latest one again
+			copy(CONFIG.acl.log[1:i+1], CONFIG.acl.log[:i])
+			CONFIG.acl.log[0] = entry
+			return
+		}
+	}
+
+	entry := &ACLLogEntry{
+		count:      1,
+		reason:     reason,
+		context:    context,
+		object:     object,
+		username:   username,
+		clientInfo: clientInfo,
+		entryID:    CONFIG.acl.nextLogID,
+		createdAt:  now,
+		updatedAt:  now,
+	}
+	CONFIG.acl.nextLogID++
+
+	CONFIG.acl.log = append([]*ACLLogEntry{entry}, CONFIG.acl.log...)
+	if len(CONFIG.acl.log) > aclLogMaxLen {
+		CONFIG.acl.log = CONFIG.acl.log[:aclLogMaxLen]
+	}
+}
+
+// Returns the NOPERM error reply for a denial.
+func aclDenialError(reason string, username string, object string) string {
+	switch reason {
+	case "key":
+		return respEncodeError("NOPERM No permissions to access a key")
+	case "channel":
+		return respEncodeError("NOPERM No permissions to access a channel")
+	}
+	return respEncodeError(fmt.Sprintf("NOPERM User %s has no permissions to run the '%s' command", username, object))
+}
+
+// Reads the users from an aclfile. Every line is "user <name> [rules...]". The whole file has
+// to be valid, otherwise nothing is loaded. A default user is added if the file has none.
+func loadACLFile(path string) (map[string]*ACLUser, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	users := make(map[string]*ACLUser)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "user" {
+			return nil, fmt.Errorf("%s:%d: line should start with user keyword", path, i+1)
+		}
+		name := fields[1]
+		if _, exists := users[name]; exists {
+			return nil, fmt.Errorf("%s:%d: duplicate user '%s' found", path, i+1, name)
+		}
+
+		rules, err := mergeSelectorRules(fields[2:])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, i+1, err)
+		}
+		user := newACLUser(name)
+		for _, rule := range rules {
+			if err := user.applyRule(rule); err != nil {
+				return nil, fmt.Errorf("%s:%d: %s. Error in rule '%s'", path, i+1, err, rule)
+			}
+		}
+		users[name] = user
+	}
+
+	if _, exists := users["default"]; !exists {
+		users["default"] = newDefaultUser("")
+	}
+	return users, nil
+}
+
+// Writes every user to the aclfile, one "user ..." line each (same format as ACL LIST).
+// Goes through a temp file, so a failed save never leaves a half written aclfile behind.
+func saveACLFile(path string) error {
+	content := ""
+	for _, name := range sortedUserNames() {
+		content += CONFIG.acl.users[name].describe() + "\n"
+	}
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, []byte(content), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func sortedUserNames() []string {
+	names := make([]string, 0, len(CONFIG.acl.users))
+	for name := range CONFIG.acl.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Checks that the connection is authenticated and that its user can run the command.
+// Returns the error reply (NOAUTH/NOPERM) to send back if it can't.
+func aclCheckRequest(command RedisCommand, commands []string, conn net.Conn) (string, bool) {
+	if isSuperConnection(conn) || command.name == "auth" || command.name == "hello" { // anyone can try to authenticate
+		return "", true
+	}
+
+	user, authenticated := connectionUser(conn)
+	if !authenticated {
+		return respEncodeError("NOAUTH Authentication required."), false
+	}
+
+	reason, object := user.check(command, commands)
+	if reason == "" {
+		return "", true
+	}
+	addACLLogEntry(reason, object, user.name, conn)
+	return aclDenialError(reason, user.name, object), false
+}
+
+// ACL SETUSER username [rule ...]
+func _aclSetUser(args []string) ([]string, error) {
+	user, err := setUserRules(args[0], args[1:])
+	if err != nil {
+		return []string{respEncodeError(err.Error())}, nil
+	}
+	CONFIG.acl.users[user.name] = user
+	return []string{respEncodeString("OK")}, nil
+}
+
+// ACL GETUSER username
+func _aclGetUser(args []string) ([]string, error) {
+	user, exists := CONFIG.acl.users[args[0]]
+	if !exists {
+		return []string{"$-1\r\n"}, nil
+	}
+
+	flags := []string{"off"}
+	if user.enabled {
+		flags[0] = "on"
+	}
+	if user.nopass {
+		flags = append(flags, "nopass")
+	}
+
+	response := "*12\r\n"
+	response += respEncodeBulkString("flags") + respEncodeStringArray(flags)
+	response += respEncodeBulkString("passwords") + respEncodeStringArray(user.sortedPasswords())
+	response += _aclEncodeSelector(user.root)
+
+	response += respEncodeBulkString("selectors") + fmt.Sprintf("*%d\r\n", len(user.selectors))
+	for _, selector := range user.selectors {
+		response += "*6\r\n" + _aclEncodeSelector(selector)
+	}
+	return []string{response}, nil
+}
+
+// Encodes the commands, keys and channels of the selector as key-value pairs (6 elements).
+func _aclEncodeSelector(selector *ACLSelector) string {
+	channels := ""
+	if len(selector.channelPatterns) > 0 {
+		channels = selector.describeChannels()
+	}
+	return respEncodeBulkString("commands") + respEncodeBulkString(selector.describeCommands()) +
+		respEncodeBulkString("keys") + respEncodeBulkString(selector.describeKeys()) +
+		respEncodeBulkString("channels") + respEncodeBulkString(channels)
+}
+
+// ACL DELUSER username [username ...]
+func _aclDelUser(args []string) ([]string, error) {
+	deleted := make(map[string]struct{})
+	for _, name := range args {
+		if name == "default" {
+			return []string{respEncodeError("ERR The 'default' user cannot be removed")}, nil
+		}
+	}
+	for _, name := range args {
+		if _, exists := CONFIG.acl.users[name]; exists {
+			delete(CONFIG.acl.users, name)
+			deleted[name] = struct{}{}
+		}
+	}
+
+	// Whoever was authenticated as a deleted user is kicked out.
+	disconnectUsers(deleted)
+	return []string{respEncodeInteger(len(deleted))}, nil
+}
+
+// ACL LIST
+func _aclList() ([]string, error) {
+	rules := make([]string, 0, len(CONFIG.acl.users))
+	for _, name := range sortedUserNames() {
+		rules = append(rules, CONFIG.acl.users[name].describe())
+	}
+	return []string{respEncodeStringArray(rules)}, nil
+}
+
+// ACL CAT [category]
+func _aclCat(args []string) ([]string, error) {
+	if len(args) == 0 {
+		return []string{respEncodeStringArray(aclCategories)}, nil
+	}
+
+	category := strings.ToLower(args[0])
+	if !isValidCommandRule("@" + category) {
+		return []string{respEncodeError(fmt.Sprintf("ERR Unknown category '%s'", args[0]))}, nil
+	}
+
+	names := make([]string, 0)
+	for _, command := range commandTable {
+		if commandInCategory(command, category) {
+			names = append(names, command.name)
+		}
+		for _, subcommand := range command.subcommands {
+			if commandInCategory(subcommand, category) {
+				names = append(names, subcommand.name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return []string{respEncodeStringArray(names)}, nil
+}
+
+// ACL DRYRUN username command [arg ...]
+func _aclDryRun(args []string) ([]string, error) {
+	user, exists := CONFIG.acl.users[args[0]]
+	if !exists {
+		return []string{respEncodeError(fmt.Sprintf("ERR User '%s' not found", args[0]))}, nil
+	}
+
+	commands := append([]string{strings.ToLower(args[1])}, args[2:]...)
+	if _, exists := commandTable[commands[0]]; !exists {
+		return []string{respEncodeError(fmt.Sprintf("ERR Command '%s' not found", args[1]))}, nil
+	}
+	command, errResponse, ok := lookupCommand(commands)
+	if !ok {
+		return []string{errResponse}, nil
+	}
+
+	reason, object := user.check(command, commands)
+	switch reason {
+	case "command":
+		return []string{respEncodeBulkString(fmt.Sprintf("User %s has no permissions to run the '%s' command", user.name, object))}, nil
+	case "key", "channel":
+		return []string{respEncodeBulkString(fmt.Sprintf("User %s has no permissions to access the '%s' %s", user.name, object, reason))}, nil
+	}
+	return []string{respEncodeString("OK")}, nil
+}
+
+// ACL LOG [count | RESET]
+func _aclLog(args []string) ([]string, error) {
+	count := len(CONFIG.acl.log)
+	if len(args) > 0 {
+		if strings.ToLower(args[0]) == "reset" {
+			CONFIG.acl.log = nil
+			return []string{respEncodeString("OK")}, nil
+		}
+
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 0 {
+			return []string{respEncodeError("ERR value is out of range, must be positive")}, nil
+		}
+		count = min(n, count)
+	}
+
+	now := time.Now()
+	response := fmt.Sprintf("*%d\r\n", count)
+	for _, entry := range CONFIG.acl.log[:count] {
+		ageSeconds := fmt.Sprintf("%.3f", now.Sub(entry.createdAt).Seconds())
+
+		response += "*20\r\n"
+		response += respEncodeBulkString("count") + respEncodeInteger(entry.count)
+		response += respEncodeBulkString("reason") + respEncodeBulkString(entry.reason)
+		response += respEncodeBulkString("context") + respEncodeBulkString(entry.context)
+		response += respEncodeBulkString("object") + respEncodeBulkString(entry.object)
+		response += respEncodeBulkString("username") + respEncodeBulkString(entry.username)
+		response += respEncodeBulkString("age-seconds") + respEncodeBulkString(ageSeconds)
+		response += respEncodeBulkString("client-info") + respEncodeBulkString(entry.clientInfo)
+		response += respEncodeBulkString("entry-id") + respEncodeInteger(entry.entryID)
+		response += respEncodeBulkString("timestamp-created") + respEncodeInteger(int(entry.createdAt.UnixMilli()))
+		response += respEncodeBulkString("timestamp-last-updated") + respEncodeInteger(int(entry.updatedAt.UnixMilli()))
+	}
+	return []string{response}, nil
+}
+
+// ACL LOAD: replaces every user with the ones from the aclfile. Connections authenticated
+// as users that don't exist anymore get disconnected.
+func _aclLoad() ([]string, error) {
+	if CONFIG.acl.file == "" {
+		return []string{respEncodeError(aclFileNotConfiguredError)}, nil
+	}
+
+	users, err := loadACLFile(CONFIG.acl.file)
+	if err != nil {
+		return []string{respEncodeError("ERR " + err.Error())}, nil
+	}
+
+	removed := make(map[string]struct{})
+	for name := range CONFIG.acl.users {
+		if _, exists := users[name]; !exists {
+			removed[name] = struct{}{}
+		}
+	}
+	CONFIG.acl.users = users
+	disconnectUsers(removed)
+	return []string{respEncodeString("OK")}, nil
+}
+
+// ACL SAVE
+func _aclSave() ([]string, error) {
+	if CONFIG.acl.file == "" {
+		return []string{respEncodeError(aclFileNotConfiguredError)}, nil
+	}
+	if err := saveACLFile(CONFIG.acl.file); err != nil {
+		return []string{respEncodeError("ERR There was an error trying to save the ACLs. Please check the server logs for more information")}, nil
+	}
+	return []string{respEncodeString("OK")}, nil
+}
+
+const aclFileNotConfiguredError = "ERR This Redis instance is not configured to use an ACL file. You may want to specify users via the ACL SETUSER command and then issue a CONFIG REWRITE (assuming you have a Redis configuration file set) in order to store users in the Redis configuration."
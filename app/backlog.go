@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// repl-backlog-size default, and the smallest size it can be set to.
+const (
+	defaultReplBacklogSize = 1024 * 1024
+	minReplBacklogSize     = 16 * 1024
+)
+
+// Generates a new random replication id (40 hex characters).
+func generateReplicationID() string {
+	id := make([]byte, 20)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Starts a new replication history: the current id becomes the secondary one, so replicas
+// that followed the old history up to this point can still PSYNC from us (failover, promotion).
+func shiftReplicationID() {
+	CONFIG.masterReplID2 = CONFIG.masterReplID
+	CONFIG.secondReplOffset = CONFIG.masterReplOffset + 1
+	CONFIG.masterReplID = generateReplicationID()
+}
+
+// Forgets the secondary replication id.
+func clearReplicationID2() {
+	CONFIG.masterReplID2 = "0000000000000000000000000000000000000000"
+	CONFIG.secondReplOffset = -1
+}
+
+// Creates an empty backlog, starting at the current replication offset.
+func newReplicationBacklog(size int) *ReplicationBacklog {
+	return &ReplicationBacklog{
+		buffer: make([]byte, size),
+		end:    CONFIG.masterReplOffset,
+	}
+}
+
+// Appends data to the backlog, overwriting the oldest bytes once it's full.
+func (backlog *ReplicationBacklog) write(data []byte) {
+	backlog.end += len(data)
+	size := len(backlog.buffer)
+	if len(data) > size { // only the tail fits anyway
+		data = data[len(data)-size:]
+	}
+	for len(data) > 0 {
+		n := copy(backlog.buffer[backlog.index:], data)
+		data = data[n:]
+		backlog.index = (backlog.index + n) % size
+		backlog.histlen = min(backlog.histlen+n, size)
+	}
+}
+
+// Returns the bytes of the replication stream from offset on. False if some of them are no
+// longer (or not yet) in the backlog.
+func (backlog *ReplicationBacklog) readFrom(offset int) ([]byte, bool) {
+	if offset < backlog.end-backlog.histlen || offset > backlog.end {
+		return nil, false
+	}
+	n := backlog.end - offset
+	size := len(backlog.buffer)
+	start := (backlog.index - n + size) % size
+
+	data := make([]byte, 0, n)
+	if start+n <= size {
+		return append(data, backlog.buffer[start:start+n]...), true
+	}
+	data = append(data, backlog.buffer[start:]...)
+	return append(data, backlog.buffer[:n-(size-start)]...), true
+}
+
+// Replication offset of the first byte in the backlog.
+func (backlog *ReplicationBacklog) firstByteOffset() int {
+	return backlog.end - backlog.histlen
+}
+
+// Changes the size of the backlog, keeping as much of the latest history as fits.
+func (backlog *ReplicationBacklog) resize(size int) {
+	data, _ := backlog.readFrom(backlog.firstByteOffset())
+	end := backlog.end
+	*backlog = ReplicationBacklog{buffer: make([]byte, size), end: end - len(data)}
+	backlog.write(data)
+}
+
+// Appends data to this server's replication stream: moves the replication offset forward,
+// and keeps the bytes in the backlog for the replicas that might need them later.
+func feedReplicationBacklog(data []byte) {
+	CONFIG.masterReplOffset += len(data)
+	if CONFIG.replBacklog != nil {
+		CONFIG.replBacklog.write(data)
+	}
+}
+
+// PSYNC replicationid offset. offset is the first byte the replica is missing (the byte right
+// after its own replication offset). If this server's history includes the replica's, and the
+// missing bytes are still in the backlog, the replica only gets those (+CONTINUE). Otherwise
+// it gets a snapshot of the whole dataset (+FULLRESYNC), see scheduleFullResync.
+//
+// The replies are queued right away, under the execution lock, so nothing propagated by
+// the commands that run next can reach the replica ahead of them.
+func onPSYNC(commands []string, conn net.Conn) ([]string, error) {
+	// PSYNC replicationid offset FAILOVER: our master hands its role over to us (see FAILOVER),
+	// and continues as our replica.
+	if len(commands) > 3 && strings.EqualFold(commands[3], "failover") {
+		if commands[1] != CONFIG.masterReplID {
+			return []string{respEncodeError("ERR PSYNC FAILOVER replid must match my replid.")}, nil
+		}
+		if CONFIG.isSlave {
+			replicationUnsetMaster()
+			fmt.Println("MASTER MODE enabled (failover request)")
+		}
+	}
+
+	// A replica passes on its master's stream, there is nothing to pass on without the link.
+	if CONFIG.isSlave && CONFIG.replState != replStateConnected {
+		return nil, fmt.Errorf("NOMASTERLINK Can't SYNC while not connected with my master")
+	}
+
+	replID := commands[1]
+	psyncOffset, err := strconv.Atoi(commands[2])
+	if err == nil && replID != "?" {
+		if missing, ok := _psyncContinue(replID, psyncOffset); ok {
+			replica := registerReplica(conn, false)
+			replica.output.queue([]byte(respEncodeString("CONTINUE " + CONFIG.masterReplID)))
+			replica.output.queue(missing)
+			return []string{}, nil
+		}
+	}
+
+	registerReplica(conn, true)
+	return []string{}, nil
+}
+
+// Returns the part of the replication stream a replica asking to continue from replID/offset
+// is missing. False if it can't continue: the history is not ours (or it diverged from ours,
+// for the secondary id), or the bytes are not in the backlog anymore.
+func _psyncContinue(replID string, psyncOffset int) ([]byte, bool) {
+	if replID != CONFIG.masterReplID && (replID != CONFIG.masterReplID2 || psyncOffset > CONFIG.secondReplOffset) {
+		return nil, false
+	}
+	if CONFIG.replBacklog == nil {
+		return nil, false
+	}
+	return CONFIG.replBacklog.readFrom(psyncOffset - 1)
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Adds a newly connected client to the registry.
+func registerClient(conn net.Conn, isMasterConn bool) *RedisClient {
+	executionLock.Lock()
+	defer executionLock.Unlock()
+
+	CONFIG.nextClientID++
+	now := time.Now()
+	client := &RedisClient{
+		id:              CONFIG.nextClientID,
+		conn:            conn,
+		addr:            conn.RemoteAddr().String(),
+		laddr:           conn.LocalAddr().String(),
+		isMaster:        isMasterConn,
+		createdAt:       now,
+		lastInteraction: now,
+		disconnected:    make(chan struct{}),
+		output:          newOutputBuffer(conn),
+		resp:            2,
+
+		subscriptions:        make(map[string]struct{}),
+		patternSubscriptions: make(map[string]struct{}),
+	}
+	if isMasterConn { // picking the stream up where the previous link left it
+		client.db = CONFIG.masterDB
+	}
+	CONFIG.clients[conn] = client
+	return client
+}
+
+// Removes a disconnected client from the registry, and frees everything it was holding:
+// its transaction, the keys it was WATCHing, and its replica slot if it was one.
+func freeClient(client *RedisClient) {
+	executionLock.Lock()
+	defer executionLock.Unlock()
+
+	unwatchAllKeys(client.conn)
+	unsubscribeAll(client)
+	disableTracking(client)
+	for i, replica := range CONFIG.replicas {
+		if replica.conn == client.conn {
+			CONFIG.replicas = append(CONFIG.replicas[:i], CONFIG.replicas[i+1:]...)
+			break
+		}
+	}
+	if client.isMaster {
+		CONFIG.masterDB = client.db
+	}
+	delete(CONFIG.clients, client.conn)
+	client.output.close()
+	client.conn.Close()
+}
+
+// Returns the transaction state of the connection. Connections without a client (internal
+// execution) get a throwaway transaction, they never MULTI anyway.
+func clientTransaction(conn net.Conn) *RedisTransaction {
+	if client, exists := CONFIG.clients[conn]; exists {
+		return &client.transaction
+	}
+	return &RedisTransaction{}
+}
+
+// Returns a channel that gets closed when the connection goes away. nil (blocks forever)
+// for connections without a client.
+func clientDisconnected(conn net.Conn) <-chan struct{} {
+	if client, exists := CONFIG.clients[conn]; exists {
+		return client.disconnected
+	}
+	return nil
+}
+
+// Returns true if the connection belongs to one of our replicas.
+func isReplicaConn(conn net.Conn) bool {
+	for _, replica := range CONFIG.replicas {
+		if replica.conn == conn {
+			return true
+		}
+	}
+	return false
+}
+
+// Type of the client, as used by CLIENT LIST TYPE and CLIENT KILL TYPE.
+func (client *RedisClient) clientType() string {
+	if client.isMaster {
+		return "master"
+	}
+	if isReplicaConn(client.conn) {
+		return "replica"
+	}
+	if client.subscriptionCount() > 0 {
+		return "pubsub"
+	}
+	return "normal"
+}
+
+// Flags of the client, as shown in CLIENT LIST.
+func (client *RedisClient) flags() string {
+	flags := ""
+	if client.isMaster {
+		flags += "M"
+	}
+	if isReplicaConn(client.conn) {
+		flags += "S"
+	}
+	if client.subscriptionCount() > 0 {
+		flags += "P"
+	}
+	if client.transaction.active {
+		flags += "x"
+	}
+	if client.blocked {
+		flags += "b"
+	}
+	if client.noEvict {
+		flags += "e"
+	}
+	if client.tracking.enabled {
+		flags += "t"
+		if client.tracking.bcast {
+			flags += "B"
+		}
+		if client.tracking.redirect != 0 && clientByID(client.tracking.redirect) == nil {
+			flags += "R"
+		}
+	}
+	if flags == "" {
+		flags = "N"
+	}
+	return flags
+}
+
+// Describes the client in a single line, the format used by CLIENT LIST and CLIENT INFO.
+func (client *RedisClient) info() string {
+	now := time.Now()
+
+	multi := -1
+	if client.transaction.active {
+		multi = len(client.transaction.commandQueue)
+	}
+
+	redirect := -1
+	if client.tracking.enabled {
+		redirect = client.tracking.redirect
+	}
+
+	fields := []string{
+		fmt.Sprintf("id=%d", client.id),
+		fmt.Sprintf("addr=%s", client.addr),
+		fmt.Sprintf("laddr=%s", client.laddr),
+		fmt.Sprintf("name=%s", client.name),
+		fmt.Sprintf("age=%d", int(now.Sub(client.createdAt).Seconds())),
+		fmt.Sprintf("idle=%d", int(now.Sub(client.lastInteraction).Seconds())),
+		fmt.Sprintf("flags=%s", client.flags()),
+		fmt.Sprintf("db=%d", client.db),
+		fmt.Sprintf("sub=%d", len(client.subscriptions)),
+		fmt.Sprintf("psub=%d", len(client.patternSubscriptions)),
+		fmt.Sprintf("multi=%d", multi),
+		fmt.Sprintf("watch=%d", len(client.transaction.watchedKeys)),
+		fmt.Sprintf("cmd=%s", client.lastCommand),
+		fmt.Sprintf("user=%s", client.user),
+		fmt.Sprintf("redir=%d", redirect),
+		fmt.Sprintf("resp=%d", client.resp),
+		fmt.Sprintf("lib-name=%s", client.libName),
+		fmt.Sprintf("lib-ver=%s", client.libVer),
+	}
+	return strings.Join(fields, " ")
+}
+
+// Returns true if the command might write to the keyspace. For EXEC, that's if any of the
+// queued commands might.
+func commandMayWrite(client *RedisClient, command RedisCommand) bool {
+	if commandInCategory(command, "write") {
+		return true
+	}
+	if command.name == "exec" {
+		for _, queued := range client.transaction.commandQueue {
+			if queuedCommand, _, ok := lookupCommand(queued); ok && commandInCategory(queuedCommand, "write") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Holds the client's command back while a CLIENT PAUSE is active (and applies to it), or
+// a FAILOVER pauses the writes. The master link and replicas are never paused. Returns false
+// if the client went away meanwhile.
+func waitWhilePaused(client *RedisClient, command RedisCommand) bool {
+	if client.isMaster || isReplicaConn(client.conn) {
+		return true
+	}
+	for {
+		var unpaused chan struct{}
+		var timedOut <-chan time.Time // nil blocks forever
+		switch {
+		case CONFIG.pause.active && (CONFIG.pause.all || commandMayWrite(client, command)):
+			remaining := time.Until(CONFIG.pause.until)
+			if remaining <= 0 {
+				endClientPause()
+				continue
+			}
+			unpaused, timedOut = CONFIG.pause.unpaused, time.After(remaining)
+		case CONFIG.failover.state != failoverNone && commandMayWrite(client, command):
+			unpaused = CONFIG.failover.unpaused // the failover has a timeout of its own
+		default:
+			return true
+		}
+
+		gone := false
+		blockWithoutExecutionLock(client.conn, func(disconnected <-chan struct{}) {
+			select {
+			case <-unpaused:
+			case <-timedOut:
+			case <-disconnected:
+				gone = true
+			}
+		})
+		if gone {
+			return false
+		}
+	}
+}
+
+// Ends the current CLIENT PAUSE (if any), and lets the paused clients through.
+func endClientPause() {
+	if !CONFIG.pause.active {
+		return
+	}
+	close(CONFIG.pause.unpaused)
+	CONFIG.pause = ClientPause{}
+}
+
+// CLIENT LIST [TYPE type] [ID id [id ...]]
+func _clientList(args []string) ([]string, error) {
+	clientType := ""
+	ids := make(map[int]struct{})
+
+	for i := 0; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "type":
+			if i+1 >= len(args) {
+				return []string{respEncodeError("ERR syntax error")}, nil
+			}
+			i++
+			clientType = strings.ToLower(args[i])
+			if clientType == "slave" {
+				clientType = "replica"
+			}
+			if clientType != "normal" && clientType != "master" && clientType != "replica" && clientType != "pubsub" {
+				return []string{respEncodeError(fmt.Sprintf("ERR Unknown client type '%s'", args[i]))}, nil
+			}
+		case "id":
+			if i+1 >= len(args) {
+				return []string{respEncodeError("ERR syntax error")}, nil
+			}
+			for i++; i < len(args); i++ {
+				id, err := strconv.Atoi(args[i])
+				if err != nil || id <= 0 {
+					return []string{respEncodeError(fmt.Sprintf("ERR Invalid client ID '%s'", args[i]))}, nil
+				}
+				ids[id] = struct{}{}
+			}
+		default:
+			return []string{respEncodeError("ERR syntax error")}, nil
+		}
+	}
+
+	lines := ""
+	for _, client := range sortedClients() {
+		if clientType != "" && client.clientType() != clientType {
+			continue
+		}
+		if _, wanted := ids[client.id]; len(ids) > 0 && !wanted {
+			continue
+		}
+		lines += client.info() + "\n"
+	}
+	return []string{respEncodeBulkString(lines)}, nil
+}
+
+// CLIENT KILL addr:port (old form) or CLIENT KILL <filter value> ... (ID, ADDR, LADDR, USER,
+// TYPE, SKIPME, MAXAGE)
+func _clientKill(args []string, self *RedisClient) ([]string, error) {
+	// Old form: just the address. Errors out if there is no such client.
+	if len(args) == 1 {
+		for _, client := range CONFIG.clients {
+			if client.addr == args[0] {
+				killClient(client, self)
+				return []string{respEncodeString("OK")}, nil
+			}
+		}
+		return []string{respEncodeError("ERR No such client")}, nil
+	}
+
+	if len(args)%2 != 0 {
+		return []string{respEncodeError("ERR syntax error")}, nil
+	}
+
+	filters := make(map[string]string)
+	skipMe := true
+	for i := 0; i < len(args); i += 2 {
+		filter, value := strings.ToLower(args[i]), args[i+1]
+		switch filter {
+		case "id", "maxage":
+			if n, err := strconv.Atoi(value); err != nil || n < 0 || (filter == "id" && n == 0) {
+				return []string{respEncodeError(fmt.Sprintf("ERR client-%s should be greater than 0", filter))}, nil
+			}
+		case "type":
+			value = strings.ToLower(value)
+			if value == "slave" {
+				value = "replica"
+			}
+			if value != "normal" && value != "master" && value != "replica" && value != "pubsub" {
+				return []string{respEncodeError(fmt.Sprintf("ERR Unknown client type '%s'", args[i+1]))}, nil
+			}
+		case "skipme":
+			switch strings.ToLower(value) {
+			case "yes":
+				skipMe = true
+			case "no":
+				skipMe = false
+			default:
+				return []string{respEncodeError("ERR syntax error")}, nil
+			}
+			continue
+		case "addr", "laddr", "user":
+		default:
+			return []string{respEncodeError("ERR syntax error")}, nil
+		}
+		filters[filter] = value
+	}
+
+	killed := 0
+	for _, client := range sortedClients() {
+		if skipMe && client == self {
+			continue
+		}
+		if !clientMatchesKillFilters(client, filters) {
+			continue
+		}
+		killClient(client, self)
+		killed++
+	}
+	return []string{respEncodeInteger(killed)}, nil
+}
+
+func clientMatchesKillFilters(client *RedisClient, filters map[string]string) bool {
+	for filter, value := range filters {
+		switch filter {
+		case "id":
+			if strconv.Itoa(client.id) != value {
+				return false
+			}
+		case "addr":
+			if client.addr != value {
+				return false
+			}
+		case "laddr":
+			if client.laddr != value {
+				return false
+			}
+		case "user":
+			if client.user != value {
+				return false
+			}
+		case "type":
+			if client.clientType() != value {
+				return false
+			}
+		case "maxage":
+			maxAge, _ := strconv.Atoi(value)
+			if time.Since(client.createdAt) < time.Duration(maxAge)*time.Second {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Disconnects the client. The client killing itself still gets the reply to CLIENT KILL,
+// its connection is closed once the reply is sent.
+func killClient(client *RedisClient, self *RedisClient) {
+	if client == self {
+		client.closeAfterReply = true
+		return
+	}
+	client.conn.Close()
+}
+
+// CLIENT PAUSE timeout [WRITE | ALL]
+func _clientPause(args []string) ([]string, error) {
+	timeout, err := strconv.Atoi(args[0])
+	if err != nil || timeout < 0 {
+		return []string{respEncodeError("ERR timeout is not an integer or out of range")}, nil
+	}
+
+	all := true
+	if len(args) > 1 {
+		switch strings.ToLower(args[1]) {
+		case "write":
+			all = false
+		case "all":
+		default:
+			return []string{respEncodeError("ERR syntax error")}, nil
+		}
+	}
+	if len(args) > 2 {
+		return []string{respEncodeError("ERR syntax error")}, nil
+	}
+
+	// A new pause replaces the current one. Waking up whoever is paused so they re-check.
+	endClientPause()
+	CONFIG.pause = ClientPause{
+		active:   true,
+		all:      all,
+		until:    time.Now().Add(time.Duration(timeout) * time.Millisecond),
+		unpaused: make(chan struct{}),
+	}
+	return []string{respEncodeString("OK")}, nil
+}
+
+// CLIENT SETINFO LIB-NAME name | LIB-VER version
+func _clientSetInfo(args []string, client *RedisClient) ([]string, error) {
+	value := args[1]
+	for _, c := range value {
+		if c < '!' || c > '~' { // no spaces, newlines or special characters, CLIENT LIST has to stay parsable
+			return []string{respEncodeError(fmt.Sprintf("ERR %s cannot contain spaces, newlines or special characters.", strings.ToLower(args[0])))}, nil
+		}
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "lib-name":
+		client.libName = value
+	case "lib-ver":
+		client.libVer = value
+	default:
+		return []string{respEncodeError(fmt.Sprintf("ERR Unrecognized option '%s'", args[0]))}, nil
+	}
+	return []string{respEncodeString("OK")}, nil
+}
+
+// CLIENT SETNAME name. An empty name removes it.
+func _clientSetName(args []string, client *RedisClient) ([]string, error) {
+	for _, c := range args[0] {
+		if c < '!' || c > '~' {
+			return []string{respEncodeError("ERR Client names cannot contain spaces, newlines or special characters.")}, nil
+		}
+	}
+	client.name = args[0]
+	return []string{respEncodeString("OK")}, nil
+}
+
+// Clients ordered by id, so listings are stable.
+func sortedClients() []*RedisClient {
+	clients := make([]*RedisClient, 0, len(CONFIG.clients))
+	for _, client := range CONFIG.clients {
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].id < clients[j].id })
+	return clients
+}
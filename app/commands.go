@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Every acl category a command can belong to (ACL CAT).
+var aclCategories = []string{
+	"keyspace", "read", "write", "set", "sortedset", "list", "hash", "string", "bitmap",
+	"hyperloglog", "geo", "stream", "pubsub", "admin", "fast", "slow", "blocking",
+	"dangerous", "connection", "transaction", "scripting",
+}
+
+// Table of every command the server knows how to handle. Used to validate commands
+// before they are executed or queued in a transaction, and to check acl permissions.
+//
+// arity follows the redis convention: the number of arguments including the command
+// name itself. A negative arity means "at least -arity arguments".
+var commandTable = map[string]RedisCommand{
+	"ping": {name: "ping", arity: -1, categories: []string{"fast", "connection"}},
+	"echo": {name: "echo", arity: 2, categories: []string{"fast", "connection"}},
+	"set":  {name: "set", arity: -3, categories: []string{"write", "string", "slow"}, firstKey: 1, lastKey: 1, keyStep: 1, keyAccess: "W"},
+	"get":  {name: "get", arity: 2, categories: []string{"read", "string", "fast"}, firstKey: 1, lastKey: 1, keyStep: 1, keyAccess: "R"},
+	"config": {name: "config", arity: -2, categories: []string{"admin", "slow", "dangerous"}, subcommands: map[string]RedisCommand{
+		"get": {name: "config|get", arity: -3, categories: []string{"admin", "slow", "dangerous"}},
+		"set": {name: "config|set", arity: -4, categories: []string{"admin", "slow", "dangerous"}},
+	}},
+	"keys":      {name: "keys", arity: 2, categories: []string{"keyspace", "read", "slow", "dangerous"}},
+	"command":   {name: "command", arity: -1, categories: []string{"slow", "connection"}},
+	"info":      {name: "info", arity: -1, categories: []string{"slow", "dangerous"}},
+	"replconf":  {name: "replconf", arity: -3, categories: []string{"admin", "slow", "dangerous"}},
+	"psync":     {name: "psync", arity: -3, categories: []string{"admin", "slow", "dangerous"}},
+	"replicaof": {name: "replicaof", arity: 3, categories: []string{"admin", "slow", "dangerous"}},
+	"slaveof":   {name: "slaveof", arity: 3, categories: []string{"admin", "slow", "dangerous"}},
+	"role":      {name: "role", arity: 1, categories: []string{"admin", "fast", "dangerous"}},
+	"failover":  {name: "failover", arity: -1, categories: []string{"admin", "slow", "dangerous"}},
+	"sentinel": {name: "sentinel", arity: -2, categories: []string{"admin", "slow", "dangerous"}, subcommands: map[string]RedisCommand{
+		"masters":                 {name: "sentinel|masters", arity: 2, categories: []string{"admin", "slow", "dangerous"}},
+		"master":                  {name: "sentinel|master", arity: 3, categories: []string{"admin", "slow", "dangerous"}},
+		"replicas":                {name: "sentinel|replicas", arity: 3, categories: []string{"admin", "slow", "dangerous"}},
+		"slaves":                  {name: "sentinel|slaves", arity: 3, categories: []string{"admin", "slow", "dangerous"}},
+		"sentinels":               {name: "sentinel|sentinels", arity: 3, categories: []string{"admin", "slow", "dangerous"}},
+		"get-master-addr-by-name": {name: "sentinel|get-master-addr-by-name", arity: 3, categories: []string{"admin", "slow", "dangerous"}},
+		"failover":                {name: "sentinel|failover", arity: 3, categories: []string{"admin", "slow", "dangerous"}},
+		"is-master-down-by-addr":  {name: "sentinel|is-master-down-by-addr", arity: 6, categories: []string{"admin", "slow", "dangerous"}},
+		"myid":                    {name: "sentinel|myid", arity: 2, categories: []string{"admin", "slow", "dangerous"}},
+	}},
+	"wait":    {name: "wait", arity: 3, categories: []string{"slow", "connection"}},
+	"type":    {name: "type", arity: 2, categories: []string{"keyspace", "read", "fast"}, firstKey: 1, lastKey: 1, keyStep: 1, keyAccess: "R"},
+	"xrange":  {name: "xrange", arity: -4, categories: []string{"read", "stream", "slow"}, firstKey: 1, lastKey: 1, keyStep: 1, keyAccess: "R"},
+	"xadd":    {name: "xadd", arity: -5, categories: []string{"write", "stream", "fast"}, firstKey: 1, lastKey: 1, keyStep: 1, keyAccess: "W"},
+	"xread":   {name: "xread", arity: -4, categories: []string{"read", "stream", "slow", "blocking"}, keyAccess: "R", getKeys: xreadKeys},
+	"incr":    {name: "incr", arity: 2, categories: []string{"write", "string", "fast"}, firstKey: 1, lastKey: 1, keyStep: 1, keyAccess: "RW"},
+	"multi":   {name: "multi", arity: 1, categories: []string{"fast", "transaction"}},
+	"exec":    {name: "exec", arity: 1, categories: []string{"slow", "transaction"}},
+	"discard": {name: "discard", arity: 1, categories: []string{"fast", "transaction"}},
+	"watch":   {name: "watch", arity: -2, categories: []string{"fast", "transaction"}, firstKey: 1, lastKey: -1, keyStep: 1, keyAccess: "R"},
+	"unwatch": {name: "unwatch", arity: 1, categories: []string{"fast", "transaction"}},
+	"auth":    {name: "auth", arity: -2, categories: []string{"fast", "connection"}},
+	"client": {name: "client", arity: -2, categories: []string{"slow"}, subcommands: map[string]RedisCommand{
+		"list":         {name: "client|list", arity: -2, categories: []string{"admin", "slow", "dangerous", "connection"}},
+		"info":         {name: "client|info", arity: 2, categories: []string{"slow", "connection"}},
+		"id":           {name: "client|id", arity: 2, categories: []string{"slow", "connection"}},
+		"setname":      {name: "client|setname", arity: 3, categories: []string{"slow", "connection"}},
+		"getname":      {name: "client|getname", arity: 2, categories: []string{"slow", "connection"}},
+		"setinfo":      {name: "client|setinfo", arity: 4, categories: []string{"slow", "connection"}},
+		"kill":         {name: "client|kill", arity: -3, categories: []string{"admin", "slow", "dangerous", "connection"}},
+		"pause":        {name: "client|pause", arity: -3, categories: []string{"admin", "slow", "dangerous", "connection"}},
+		"unpause":      {name: "client|unpause", arity: 2, categories: []string{"admin", "slow", "dangerous", "connection"}},
+		"tracking":     {name: "client|tracking", arity: -3, categories: []string{"slow", "connection"}},
+		"caching":      {name: "client|caching", arity: 3, categories: []string{"slow", "connection"}},
+		"getredir":     {name: "client|getredir", arity: 2, categories: []string{"slow", "connection"}},
+		"trackinginfo": {name: "client|trackinginfo", arity: 2, categories: []string{"slow", "connection"}},
+		"no-evict":     {name: "client|no-evict", arity: 3, categories: []string{"admin", "slow", "dangerous", "connection"}},
+	}},
+	"hello":        {name: "hello", arity: -1, categories: []string{"fast", "connection"}},
+	"subscribe":    {name: "subscribe", arity: -2, categories: []string{"pubsub", "slow"}},
+	"unsubscribe":  {name: "unsubscribe", arity: -1, categories: []string{"pubsub", "slow"}},
+	"psubscribe":   {name: "psubscribe", arity: -2, categories: []string{"pubsub", "slow"}},
+	"punsubscribe": {name: "punsubscribe", arity: -1, categories: []string{"pubsub", "slow"}},
+	"publish":      {name: "publish", arity: 3, categories: []string{"pubsub", "fast"}},
+	"select":       {name: "select", arity: 2, categories: []string{"fast", "connection"}},
+	"swapdb":       {name: "swapdb", arity: 3, categories: []string{"keyspace", "write", "fast", "dangerous"}},
+	"move":         {name: "move", arity: 3, categories: []string{"keyspace", "write", "fast"}, firstKey: 1, lastKey: 1, keyStep: 1, keyAccess: "RW"},
+	"copy":         {name: "copy", arity: -3, categories: []string{"keyspace", "write", "slow"}, firstKey: 1, lastKey: 2, keyStep: 1, keyAccess: "RW"},
+	"dbsize":       {name: "dbsize", arity: 1, categories: []string{"keyspace", "read", "fast"}},
+	"flushdb":      {name: "flushdb", arity: -1, categories: []string{"keyspace", "write", "slow", "dangerous"}},
+	"flushall":     {name: "flushall", arity: -1, categories: []string{"keyspace", "write", "slow", "dangerous"}},
+	"save":         {name: "save", arity: 1, categories: []string{"admin", "slow", "dangerous"}},
+	"expire":       {name: "expire", arity: -3, categories: []string{"keyspace", "write", "fast"}, firstKey: 1, lastKey: 1, keyStep: 1, keyAccess: "RW"},
+	"pexpire":      {name: "pexpire", arity: -3, categories: []string{"keyspace", "write", "fast"}, firstKey: 1, lastKey: 1, keyStep: 1, keyAccess: "RW"},
+	"expireat":     {name: "expireat", arity: -3, categories: []string{"keyspace", "write", "fast"}, firstKey: 1, lastKey: 1, keyStep: 1, keyAccess: "RW"},
+	"pexpireat":    {name: "pexpireat", arity: -3, categories: []string{"keyspace", "write", "fast"}, firstKey: 1, lastKey: 1, keyStep: 1, keyAccess: "RW"},
+	"ttl":          {name: "ttl", arity: 2, categories: []string{"keyspace", "read", "fast"}, firstKey: 1, lastKey: 1, keyStep: 1, keyAccess: "R"},
+	"pttl":         {name: "pttl", arity: 2, categories: []string{"keyspace", "read", "fast"}, firstKey: 1, lastKey: 1, keyStep: 1, keyAccess: "R"},
+	"expiretime":   {name: "expiretime", arity: 2, categories: []string{"keyspace", "read", "fast"}, firstKey: 1, lastKey: 1, keyStep: 1, keyAccess: "R"},
+	"pexpiretime":  {name: "pexpiretime", arity: 2, categories: []string{"keyspace", "read", "fast"}, firstKey: 1, lastKey: 1, keyStep: 1, keyAccess: "R"},
+	"persist":      {name: "persist", arity: 2, categories: []string{"keyspace", "write", "fast"}, firstKey: 1, lastKey: 1, keyStep: 1, keyAccess: "RW"},
+	"del":          {name: "del", arity: -2, categories: []string{"keyspace", "write", "slow"}, firstKey: 1, lastKey: -1, keyStep: 1, keyAccess: "RW"},
+	"unlink":       {name: "unlink", arity: -2, categories: []string{"keyspace", "write", "fast"}, firstKey: 1, lastKey: -1, keyStep: 1, keyAccess: "RW"},
+	"exists":       {name: "exists", arity: -2, categories: []string{"keyspace", "read", "fast"}, firstKey: 1, lastKey: -1, keyStep: 1, keyAccess: "R"},
+	"touch":        {name: "touch", arity: -2, categories: []string{"keyspace", "read", "fast"}, firstKey: 1, lastKey: -1, keyStep: 1, keyAccess: "R"},
+	"rename":       {name: "rename", arity: 3, categories: []string{"keyspace", "write", "slow"}, firstKey: 1, lastKey: 2, keyStep: 1, keyAccess: "RW"},
+	"renamenx":     {name: "renamenx", arity: 3, categories: []string{"keyspace", "write", "fast"}, firstKey: 1, lastKey: 2, keyStep: 1, keyAccess: "RW"},
+	"randomkey":    {name: "randomkey", arity: 1, categories: []string{"keyspace", "read", "slow"}},
+	"scan":         {name: "scan", arity: -2, categories: []string{"keyspace", "read", "slow"}},
+	"hscan":        {name: "hscan", arity: -3, categories: []string{"read", "hash", "slow"}, firstKey: 1, lastKey: 1, keyStep: 1, keyAccess: "R"},
+	"sscan":        {name: "sscan", arity: -3, categories: []string{"read", "set", "slow"}, firstKey: 1, lastKey: 1, keyStep: 1, keyAccess: "R"},
+	"zscan":        {name: "zscan", arity: -3, categories: []string{"read", "sortedset", "slow"}, firstKey: 1, lastKey: 1, keyStep: 1, keyAccess: "R"},
+	"sort":         {name: "sort", arity: -2, categories: []string{"write", "set", "sortedset", "list", "slow", "dangerous"}, keyAccess: "RW", getKeys: sortKeys, getKeyAccess: sortKeyAccess},
+	"sort_ro":      {name: "sort_ro", arity: -2, categories: []string{"read", "set", "sortedset", "list", "slow", "dangerous"}, firstKey: 1, lastKey: 1, keyStep: 1, keyAccess: "R"},
+	"object": {name: "object", arity: -2, categories: []string{"slow"}, subcommands: map[string]RedisCommand{
+		"encoding": {name: "object|encoding", arity: 3, categories: []string{"keyspace", "read", "slow"}, firstKey: 2, lastKey: 2, keyStep: 1, keyAccess: "R"},
+		"freq":     {name: "object|freq", arity: 3, categories: []string{"keyspace", "read", "slow"}, firstKey: 2, lastKey: 2, keyStep: 1, keyAccess: "R"},
+		"idletime": {name: "object|idletime", arity: 3, categories: []string{"keyspace", "read", "slow"}, firstKey: 2, lastKey: 2, keyStep: 1, keyAccess: "R"},
+		"refcount": {name: "object|refcount", arity: 3, categories: []string{"keyspace", "read", "slow"}, firstKey: 2, lastKey: 2, keyStep: 1, keyAccess: "R"},
+		"help":     {name: "object|help", arity: 2, categories: []string{"keyspace", "slow"}},
+	}},
+	"acl": {name: "acl", arity: -2, categories: []string{"slow"}, subcommands: map[string]RedisCommand{
+		"setuser": {name: "acl|setuser", arity: -3, categories: []string{"admin", "slow", "dangerous"}},
+		"getuser": {name: "acl|getuser", arity: 3, categories: []string{"admin", "slow", "dangerous"}},
+		"deluser": {name: "acl|deluser", arity: -3, categories: []string{"admin", "slow", "dangerous"}},
+		"list":    {name: "acl|list", arity: 2, categories: []string{"admin", "slow", "dangerous"}},
+		"users":   {name: "acl|users", arity: 2, categories: []string{"admin", "slow", "dangerous"}},
+		"whoami":  {name: "acl|whoami", arity: 2, categories: []string{"slow"}},
+		"cat":     {name: "acl|cat", arity: -2, categories: []string{"slow"}},
+		"dryrun":  {name: "acl|dryrun", arity: -4, categories: []string{"admin", "slow", "dangerous"}},
+		"log":     {name: "acl|log", arity: -2, categories: []string{"admin", "slow", "dangerous"}},
+		"load":    {name: "acl|load", arity: 2, categories: []string{"admin", "slow", "dangerous"}},
+		"save":    {name: "acl|save", arity: 2, categories: []string{"admin", "slow", "dangerous"}},
+	}},
+}
+
+// Looks up the command (and its subcommand, for container commands) and checks its arity.
+// Returns the error reply (already resp encoded) to send back if the command can't be
+// executed as given.
+func lookupCommand(commands []string) (RedisCommand, string, bool) {
+	name := commands[0]
+
+	command, exists := commandTable[name]
+	// Sentinel mode only has a few commands, and SENTINEL only exists there.
+	if _, sentinelCommand := sentinelCommands[name]; (CONFIG.sentinelMode && !sentinelCommand) || (!CONFIG.sentinelMode && name == "sentinel") {
+		exists = false
+	}
+	if !exists {
+		argsPreview := ""
+		for _, arg := range commands[1:] {
+			argsPreview += fmt.Sprintf("'%s' ", arg)
+		}
+		errMsg := fmt.Sprintf("ERR unknown command '%s', with args beginning with: %s", name, argsPreview)
+		return RedisCommand{}, respEncodeError(errMsg), false
+	}
+
+	if command.subcommands != nil && len(commands) >= 2 {
+		subcommand, exists := command.subcommands[strings.ToLower(commands[1])]
+		if !exists {
+			errMsg := fmt.Sprintf("ERR unknown subcommand '%s'. Try %s HELP.", commands[1], strings.ToUpper(name))
+			return RedisCommand{}, respEncodeError(errMsg), false
+		}
+		command = subcommand
+		name = strings.ReplaceAll(subcommand.name, "|", " ")
+	}
+
+	if (command.arity > 0 && len(commands) != command.arity) || len(commands) < -command.arity {
+		errMsg := fmt.Sprintf("ERR wrong number of arguments for '%s' command", name)
+		return RedisCommand{}, respEncodeError(errMsg), false
+	}
+	return command, "", true
+}
+
+// Returns true if the command belongs to the given acl category.
+func commandInCategory(command RedisCommand, category string) bool {
+	for _, c := range command.categories {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the keys the command operates on, using the key positions from the command table.
+func commandKeys(command RedisCommand, commands []string) []string {
+	if command.getKeys != nil {
+		return command.getKeys(commands)
+	}
+	if command.firstKey == 0 || command.firstKey >= len(commands) {
+		return nil
+	}
+
+	lastKey := command.lastKey
+	if lastKey < 0 {
+		lastKey = len(commands) + lastKey
+	}
+	keys := make([]string, 0, 1)
+	for i := command.firstKey; i <= lastKey && i < len(commands); i += command.keyStep {
+		keys = append(keys, commands[i])
+	}
+	return keys
+}
+
+// Returns what the command does with each of its keys ("R", "W" or "RW"), in commandKeys order.
+func commandKeyAccess(command RedisCommand, commands []string, keys []string) []string {
+	if command.getKeyAccess != nil {
+		return command.getKeyAccess(commands)
+	}
+	access := make([]string, len(keys))
+	for i := range access {
+		access[i] = command.keyAccess
+	}
+	return access
+}
+
+// Keys for XREAD: everything in the first half after STREAMS.
+func xreadKeys(commands []string) []string {
+	for i, arg := range commands {
+		if strings.ToLower(arg) == "streams" {
+			streams := commands[i+1:]
+			return streams[:len(streams)/2]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A configuration parameter that can be read with CONFIG GET, and changed at runtime with
+// CONFIG SET if it has a setter.
+type ConfigParameter struct {
+	get func() string
+	set func(value string) error // nil for parameters that can't change at runtime
+
+	// Optional, for setters that change more than get shows. Returns what puts it all back the
+	// way it is now, for rolling back a CONFIG SET. Without it, the value of get is set again.
+	snapshot func() (restore func())
+}
+
+// Every parameter known to CONFIG GET/SET, by lowercase name.
+var configParameters = map[string]ConfigParameter{
+	"dir": {
+		get: func() string { return RDB.config.dir },
+	},
+	"dbfilename": {
+		get: func() string { return RDB.config.dbFileName },
+	},
+	"databases": {
+		get: func() string { return strconv.Itoa(CONFIG.databases) },
+	},
+	"requirepass": {
+		get: func() string { return CONFIG.requirePass },
+		set: func(value string) error {
+			// requirepass is just the password of the default user.
+			CONFIG.requirePass = value
+			CONFIG.acl.users["default"].setPassword(value)
+			return nil
+		},
+		snapshot: func() func() {
+			// The default user's passwords can have changed with ACL SETUSER since.
+			requirePass, defaultUser := CONFIG.requirePass, CONFIG.acl.users["default"].clone()
+			return func() {
+				CONFIG.requirePass = requirePass
+				*CONFIG.acl.users["default"] = *defaultUser
+			}
+		},
+	},
+	"notify-keyspace-events": {
+		get: func() string { return keyspaceEventsString(CONFIG.notifyKeyspaceEvents) },
+		set: func(value string) error {
+			classes, err := parseKeyspaceEvents(value)
+			if err != nil {
+				return err
+			}
+			CONFIG.notifyKeyspaceEvents = classes
+			return nil
+		},
+	},
+	"maxmemory-policy": {
+		get: func() string { return CONFIG.maxmemoryPolicy },
+		set: func(value string) error {
+			if !validMaxmemoryPolicy(value) {
+				return fmt.Errorf("argument(s) must be one of the following: volatile-lru, volatile-lfu, volatile-random, volatile-ttl, allkeys-lru, allkeys-lfu, allkeys-random, noeviction")
+			}
+			CONFIG.maxmemoryPolicy = strings.ToLower(value)
+			return nil
+		},
+	},
+	"repl-backlog-size": {
+		get: func() string { return strconv.Itoa(CONFIG.replBacklogSize) },
+		set: func(value string) error {
+			size, err := parseMemory(value)
+			if err != nil {
+				return err
+			}
+			CONFIG.replBacklogSize = max(size, minReplBacklogSize)
+			if CONFIG.replBacklog != nil {
+				CONFIG.replBacklog.resize(CONFIG.replBacklogSize)
+			}
+			return nil
+		},
+	},
+	"aclfile": {
+		get: func() string { return CONFIG.acl.file },
+	},
+	"min-replicas-to-write":    nonNegativeIntParameter(&CONFIG.minReplicasToWrite),
+	"min-slaves-to-write":      nonNegativeIntParameter(&CONFIG.minReplicasToWrite),
+	"min-replicas-max-lag":     nonNegativeIntParameter(&CONFIG.minReplicasMaxLag),
+	"min-slaves-max-lag":       nonNegativeIntParameter(&CONFIG.minReplicasMaxLag),
+	"replica-read-only":        yesNoParameter(&CONFIG.replicaReadOnly),
+	"slave-read-only":          yesNoParameter(&CONFIG.replicaReadOnly),
+	"replica-serve-stale-data": yesNoParameter(&CONFIG.replicaServeStaleData),
+	"slave-serve-stale-data":   yesNoParameter(&CONFIG.replicaServeStaleData),
+	"replica-priority":         nonNegativeIntParameter(&CONFIG.replicaPriority),
+	"slave-priority":           nonNegativeIntParameter(&CONFIG.replicaPriority),
+	"repl-diskless-sync":       yesNoParameter(&CONFIG.replDisklessSync),
+	"repl-diskless-sync-delay": nonNegativeIntParameter(&CONFIG.replDisklessSyncDelay),
+	"rdb-key-save-delay":       nonNegativeIntParameter(&CONFIG.rdbKeySaveDelay),
+	"repl-diskless-load": {
+		get: func() string { return CONFIG.replDisklessLoad },
+		set: func(value string) error {
+			if !validDisklessLoad(value) {
+				return fmt.Errorf("argument(s) must be one of the following: disabled, on-empty-db, swapdb")
+			}
+			CONFIG.replDisklessLoad = strings.ToLower(value)
+			return nil
+		},
+	},
+}
+
+func validDisklessLoad(value string) bool {
+	switch strings.ToLower(value) {
+	case "disabled", "on-empty-db", "swapdb":
+		return true
+	}
+	return false
+}
+
+// A yes/no parameter, backed by the given flag.
+func yesNoParameter(flag *bool) ConfigParameter {
+	return ConfigParameter{
+		get: func() string { return formatYesNo(*flag) },
+		set: func(value string) error {
+			b, err := parseYesNo(value)
+			if err != nil {
+				return err
+			}
+			*flag = b
+			return nil
+		},
+	}
+}
+
+// A parameter holding a number that can't be negative.
+func nonNegativeIntParameter(n *int) ConfigParameter {
+	return ConfigParameter{
+		get: func() string { return strconv.Itoa(*n) },
+		set: func(value string) error {
+			v, err := strconv.Atoi(value)
+			if err != nil || v < 0 {
+				return fmt.Errorf("argument must be a non negative integer")
+			}
+			*n = v
+			return nil
+		},
+	}
+}
+
+func parseYesNo(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "yes":
+		return true, nil
+	case "no":
+		return false, nil
+	}
+	return false, fmt.Errorf("argument must be 'yes' or 'no'")
+}
+
+func formatYesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// CONFIG GET parameter [parameter ...]. Parameters can be glob patterns.
+func _configGet(args []string) ([]string, error) {
+	names := make([]string, 0)
+	for name := range configParameters {
+		for _, pattern := range args {
+			if stringMatch(pattern, name, true) {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+
+	response := fmt.Sprintf("*%d\r\n", len(names)*2)
+	for _, name := range names {
+		response += respEncodeBulkString(name)
+		response += respEncodeBulkString(configParameters[name].get())
+	}
+	return []string{response}, nil
+}
+
+// CONFIG SET parameter value [parameter value ...]. Either every parameter is set, or none are.
+func _configSet(args []string) ([]string, error) {
+	if len(args)%2 != 0 {
+		return []string{respEncodeError("ERR wrong number of arguments for 'config|set' command")}, nil
+	}
+
+	// Checking every parameter exists and can be set, before touching anything.
+	for i := 0; i < len(args); i += 2 {
+		name := strings.ToLower(args[i])
+		parameter, exists := configParameters[name]
+		if !exists {
+			return []string{respEncodeError(fmt.Sprintf("ERR Unknown option or number of arguments for CONFIG SET - '%s'", args[i]))}, nil
+		}
+		if parameter.set == nil {
+			return []string{respEncodeError(fmt.Sprintf("ERR CONFIG SET failed (possibly related to argument '%s') - can't set immutable config", args[i]))}, nil
+		}
+	}
+
+	// The values themselves are only checked by the setters. If one fails, the parameters set
+	// before it are put back, in reverse order (a parameter can come twice).
+	restores := make([]func(), 0, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		parameter := configParameters[strings.ToLower(args[i])]
+		if parameter.snapshot != nil {
+			restores = append(restores, parameter.snapshot())
+		} else {
+			previous := parameter.get()
+			restores = append(restores, func() { parameter.set(previous) })
+		}
+		if err := parameter.set(args[i+1]); err != nil {
+			for j := len(restores) - 2; j >= 0; j-- {
+				restores[j]()
+			}
+			return []string{respEncodeError(fmt.Sprintf("ERR CONFIG SET failed (possibly related to argument '%s') - %s", args[i], err))}, nil
+		}
+	}
+	return []string{respEncodeString("OK")}, nil
+}
+
+// Parses a memory amount the way redis configs take them: a number of bytes, optionally
+// followed by a unit (k, kb, m, mb, g, gb; the "b" ones are powers of 1024).
+func parseMemory(value string) (int, error) {
+	units := []struct {
+		suffix     string
+		multiplier int
+	}{
+		{"kb", 1024}, {"mb", 1024 * 1024}, {"gb", 1024 * 1024 * 1024},
+		{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000}, {"b", 1},
+	}
+
+	lower := strings.ToLower(value)
+	multiplier := 1
+	for _, unit := range units {
+		if strings.HasSuffix(lower, unit.suffix) {
+			lower, multiplier = strings.TrimSuffix(lower, unit.suffix), unit.multiplier
+			break
+		}
+	}
+	n, err := strconv.Atoi(lower)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("argument must be a memory value")
+	}
+	return n * multiplier, nil
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Creates an empty database with the given index.
+func newDatabase(id int) *RedisDatabase {
+	return &RedisDatabase{
+		id:        id,
+		keys:      make(map[string]*RedisObject),
+		scanIndex: newScanIndex(nil),
+		expires:   newScanIndex(nil),
+	}
+}
+
+// Returns the database SELECTed by the client running the current command. Internal
+// execution (no client) works on database 0.
+func currentDB() *RedisDatabase {
+	if CONFIG.currentClient != nil {
+		return RDB.databases[CONFIG.currentClient.db]
+	}
+	return RDB.databases[0]
+}
+
+// Number of keys in the database, expired ones that haven't been collected yet included.
+func (db *RedisDatabase) size() int {
+	return len(db.keys)
+}
+
+// Returns the object stored at key without counting it as an access, nil if there is none
+// (or it has expired).
+func (db *RedisDatabase) lookupKey(key string) *RedisObject {
+	if expireIfNeeded(db, key) {
+		return nil
+	}
+	return db.keys[key]
+}
+
+// Returns the object stored at key for a command reading it, nil if there is none. Misses
+// fire the keymiss event.
+func (db *RedisDatabase) lookupKeyRead(key string) *RedisObject {
+	obj := db.lookupKey(key)
+	if obj == nil {
+		notifyKeyspaceEvent(notifyKeyMiss, "keymiss", key, db.id)
+		return nil
+	}
+	obj.touch()
+	return obj
+}
+
+// Returns the object stored at key for a command about to modify it, nil if there is none.
+func (db *RedisDatabase) lookupKeyWrite(key string) *RedisObject {
+	obj := db.lookupKey(key)
+	if obj != nil {
+		obj.touch()
+	}
+	return obj
+}
+
+// Stores the object at key, replacing whatever was there (expiry included).
+func (db *RedisDatabase) setKey(key string, obj *RedisObject) {
+	old, exists := db.keys[key]
+	if !exists {
+		db.scanIndex.add(key)
+	}
+	if obj.expires && (!exists || !old.expires) {
+		db.expires.add(key)
+	} else if !obj.expires && exists && old.expires {
+		db.expires.remove(key)
+	}
+	db.keys[key] = obj
+}
+
+// Sets the expiry of the key, which must exist.
+func (db *RedisDatabase) setExpire(key string, at time.Time) {
+	obj := db.keys[key]
+	if !obj.expires {
+		db.expires.add(key)
+	}
+	obj.expires, obj.expiresAt = true, at
+}
+
+// Removes the expiry of the key, which must exist.
+func (db *RedisDatabase) removeExpire(key string) {
+	obj := db.keys[key]
+	if obj.expires {
+		db.expires.remove(key)
+	}
+	obj.expires, obj.expiresAt = false, time.Time{}
+}
+
+// Returns true if the key exists in the database (and hasn't expired).
+func (db *RedisDatabase) keyExists(key string) bool {
+	return db.lookupKey(key) != nil
+}
+
+// Deletes the key from the database, whatever type of value it holds. Returns true if it existed.
+func (db *RedisDatabase) deleteKey(key string) bool {
+	obj, existed := db.keys[key]
+	if existed {
+		delete(db.keys, key)
+		db.scanIndex.remove(key)
+		if obj.expires {
+			db.expires.remove(key)
+		}
+	}
+	return existed
+}
+
+// Copies the value at key (and its expiry) into dst under dstKey. dstKey must not exist.
+func (db *RedisDatabase) copyKey(key string, dst *RedisDatabase, dstKey string) {
+	dst.setKey(dstKey, db.keys[key].duplicate())
+}
+
+// Empties the database. The transactions WATCHing any of its keys get flagged as dirty.
+func (db *RedisDatabase) flush() {
+	touchAllWatchedKeys(db)
+	db.keys = make(map[string]*RedisObject)
+	db.scanIndex = newScanIndex(nil)
+	db.expires = newScanIndex(nil)
+}
+
+// Flags every transaction WATCHing a key that exists in one of the databases as dirty. For
+// when whole databases change at once (FLUSHDB, SWAPDB).
+func touchAllWatchedKeys(dbs ...*RedisDatabase) {
+	for watchedKey, watchers := range CONFIG.watchedKeys {
+		inDBs, live := false, false
+		for _, db := range dbs {
+			inDBs = inDBs || watchedKey.db == db.id
+			live = live || keyIsLive(db, watchedKey.key)
+		}
+		if !inDBs || !live {
+			continue
+		}
+		for conn := range watchers {
+			clientTransaction(conn).dirty = true
+		}
+	}
+}
+
+// Parses a database index. Returns the error reply if it's not a valid one.
+func parseDBIndex(arg string, invalidError string) (int, string, bool) {
+	index, err := strconv.Atoi(arg)
+	if err != nil {
+		return 0, respEncodeError(invalidError), false
+	}
+	if index < 0 || index >= len(RDB.databases) {
+		return 0, respEncodeError("ERR DB index is out of range"), false
+	}
+	return index, "", true
+}
+
+// Parses the optional ASYNC|SYNC argument of FLUSHDB and FLUSHALL. Freeing is left to the
+// garbage collector either way, so both behave the same.
+func parseFlushMode(args []string) bool {
+	if len(args) == 0 {
+		return true
+	}
+	mode := strings.ToLower(args[0])
+	return len(args) == 1 && (mode == "async" || mode == "sync")
+}
+
+// SELECT index
+func onSELECT(commands []string, conn net.Conn) ([]string, error) {
+	index, errResponse, ok := parseDBIndex(commands[1], "ERR value is not an integer or out of range")
+	if !ok {
+		return []string{errResponse}, nil
+	}
+	if client, exists := CONFIG.clients[conn]; exists {
+		client.db = index
+	}
+	return []string{respEncodeString("OK")}, nil
+}
+
+// SWAPDB index1 index2. Clients connected to one database see the data of the other one right away.
+func onSWAPDB(commands []string) ([]string, error) {
+	first, errResponse, ok := parseDBIndex(commands[1], "ERR invalid first DB index")
+	if !ok {
+		return []string{errResponse}, nil
+	}
+	second, errResponse, ok := parseDBIndex(commands[2], "ERR invalid second DB index")
+	if !ok {
+		return []string{errResponse}, nil
+	}
+	if first == second {
+		return []string{respEncodeString("OK")}, nil
+	}
+
+	a, b := RDB.databases[first], RDB.databases[second]
+	a.id, b.id = second, first
+	RDB.databases[first], RDB.databases[second] = b, a
+	CONFIG.dirty++
+
+	// The keys WATCHed on either index now point at something else, and clients blocked on
+	// streams of either database might have something to read.
+	touchAllWatchedKeys(a, b)
+	for _, db := range []*RedisDatabase{a, b} {
+		for key, obj := range db.keys {
+			if obj.objType == objStream {
+				signalStreamWaiters(key)
+			}
+		}
+	}
+	return []string{respEncodeString("OK")}, nil
+}
+
+// MOVE key db. Replies 1 if the key was moved, 0 if it doesn't exist, or already exists in the target.
+func onMOVE(commands []string) ([]string, error) {
+	key := commands[1]
+	src := currentDB()
+	index, errResponse, ok := parseDBIndex(commands[2], "ERR value is not an integer or out of range")
+	if !ok {
+		return []string{errResponse}, nil
+	}
+	dst := RDB.databases[index]
+	if src == dst {
+		return []string{respEncodeError("ERR source and destination objects are the same")}, nil
+	}
+
+	if !src.keyExists(key) || dst.keyExists(key) {
+		return []string{respEncodeInteger(0)}, nil
+	}
+
+	src.copyKey(key, dst, key)
+	src.deleteKey(key)
+	signalModifiedKey(src, key)
+	signalModifiedKey(dst, key)
+	notifyKeyspaceEvent(notifyGeneric, "move_from", key, src.id)
+	notifyKeyspaceEvent(notifyGeneric, "move_to", key, dst.id)
+	return []string{respEncodeInteger(1)}, nil
+}
+
+// COPY source destination [DB destination-db] [REPLACE]
+func onCOPY(commands []string) ([]string, error) {
+	srcKey, dstKey := commands[1], commands[2]
+	src := currentDB()
+	dst := src
+	replace := false
+
+	args := commands[3:]
+	for i := 0; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "db":
+			if i+1 >= len(args) {
+				return []string{respEncodeError("ERR syntax error")}, nil
+			}
+			i++
+			index, errResponse, ok := parseDBIndex(args[i], "ERR value is not an integer or out of range")
+			if !ok {
+				return []string{errResponse}, nil
+			}
+			dst = RDB.databases[index]
+		case "replace":
+			replace = true
+		default:
+			return []string{respEncodeError("ERR syntax error")}, nil
+		}
+	}
+
+	if src == dst && srcKey == dstKey {
+		return []string{respEncodeError("ERR source and destination objects are the same")}, nil
+	}
+	if !src.keyExists(srcKey) {
+		return []string{respEncodeInteger(0)}, nil
+	}
+	if dst.keyExists(dstKey) {
+		if !replace {
+			return []string{respEncodeInteger(0)}, nil
+		}
+		dst.deleteKey(dstKey)
+	}
+
+	src.copyKey(srcKey, dst, dstKey)
+	signalModifiedKey(dst, dstKey)
+	notifyKeyspaceEvent(notifyGeneric, "copy_to", dstKey, dst.id)
+	return []string{respEncodeInteger(1)}, nil
+}
+
+// DBSIZE
+func onDBSIZE(_ []string) ([]string, error) {
+	return []string{respEncodeInteger(currentDB().size())}, nil
+}
+
+// FLUSHDB [ASYNC|SYNC]
+func onFLUSHDB(commands []string) ([]string, error) {
+	if !parseFlushMode(commands[1:]) {
+		return []string{respEncodeError("ERR syntax error")}, nil
+	}
+	currentDB().flush()
+	invalidateAllTrackedKeys()
+	CONFIG.dirty++
+	return []string{respEncodeString("OK")}, nil
+}
+
+// FLUSHALL [ASYNC|SYNC]
+func onFLUSHALL(commands []string) ([]string, error) {
+	if !parseFlushMode(commands[1:]) {
+		return []string{respEncodeError("ERR syntax error")}, nil
+	}
+	for _, db := range RDB.databases {
+		db.flush()
+	}
+	invalidateAllTrackedKeys()
+	CONFIG.dirty++
+	return []string{respEncodeString("OK")}, nil
+}
+
+// SAVE: writes every database to the rdb file.
+func onSAVE(_ []string) ([]string, error) {
+	if err := saveRDBToFile(RDB.config.dir, RDB.config.dbFileName); err != nil {
+		return nil, fmt.Errorf("error saving the rdb file: %s", err)
+	}
+	return []string{respEncodeString("OK")}, nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"strings"
 )
 
 // returns the resp bulk-string encoded value of the string provided.
@@ -36,3 +37,36 @@ func respEncodeInteger(num int) string {
 func respEncodeError(err string) string {
 	return fmt.Sprintf("-%s\r\n", err)
 }
+
+// returns the resp-encoded error reply for an error returned by a command handler.
+// Adds the generic ERR prefix if the handler didn't provide an error code itself.
+func respEncodeCommandError(err error) string {
+	msg := err.Error()
+	if !strings.HasPrefix(msg, "ERR ") {
+		msg = "ERR " + msg
+	}
+	return respEncodeError(msg)
+}
+
+// returns a resp-array of the already encoded values.
+func respEncodeArray(values []string) string {
+	return fmt.Sprintf("*%d\r\n%s", len(values), strings.Join(values, ""))
+}
+
+// returns a map of the already encoded key-value pairs (flattened, key first). Maps only
+// exist in RESP3, RESP2 clients get them as a flat array.
+func respEncodeMap(pairs []string, protocol int) string {
+	if protocol < 3 {
+		return respEncodeArray(pairs)
+	}
+	return fmt.Sprintf("%%%d\r\n%s", len(pairs)/2, strings.Join(pairs, ""))
+}
+
+// returns a push message (pub/sub messages, invalidations) of the already encoded values.
+// RESP2 has no push type, the messages are sent as plain arrays.
+func respEncodePush(values []string, protocol int) string {
+	if protocol < 3 {
+		return respEncodeArray(values)
+	}
+	return fmt.Sprintf(">%d\r\n%s", len(values), strings.Join(values, ""))
+}
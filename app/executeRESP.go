@@ -2,30 +2,79 @@ package main
 
 import (
 	"fmt"
+	"math"
 	"net"
+	"os"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 )
 
-var ackChan = make(chan bool)
-
 func executeResp(commands []string, conn net.Conn) (responses []string, err error) {
 	// If MULTI has been called, the command will not get executed, but queued.
-	transaction, exists := CONFIG.transactions[conn] // check if there is an active transaction on that connection
+	transaction := clientTransaction(conn) // check if there is an active transaction on that connection
 	command := commands[0]
+	inTransaction := transaction.active
+
+	// Unknown commands and bad arity are rejected right away, and so are commands the
+	// connection's user can't run. Inside MULTI, they also doom the transaction: EXEC will
+	// refuse to run any of it.
+	redisCommand, errResponse, ok := lookupCommand(commands)
+	if ok {
+		errResponse, ok = aclCheckRequest(redisCommand, commands, conn)
+	}
+	if !ok {
+		if inTransaction {
+			transaction.errored = true
+		}
+		return []string{errResponse}, nil
+	}
 
-	shouldQueue := exists && transaction.active && command != "multi" && command != "exec" && command != "discard"
+	// RESP2 clients that subscribed to something can only manage their subscriptions.
+	if _, allowed := pubsubContextCommands[command]; !allowed && clientInPubSubContext(conn) {
+		errMsg := fmt.Sprintf("ERR Can't execute '%s': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context", redisCommand.name)
+		return []string{respEncodeError(errMsg)}, nil
+	}
+
+	if errResponse, ok := replicaCheckRequest(redisCommand, commands, conn); !ok {
+		if inTransaction {
+			transaction.errored = true
+		}
+		return []string{errResponse}, nil
+	}
+	if errResponse, ok := minReplicasCheckRequest(redisCommand, conn); !ok {
+		if inTransaction {
+			transaction.errored = true
+		}
+		return []string{errResponse}, nil
+	}
+
+	shouldQueue := inTransaction && command != "multi" && command != "exec" && command != "discard" && command != "watch"
 	if shouldQueue {
 		// Queue the new command
 		transaction.commandQueue = append(transaction.commandQueue, commands)
-		CONFIG.transactions[conn] = transaction
 
 		return []string{respEncodeString("QUEUED")}, nil
 	}
 
-	switch command {
+	dirty := CONFIG.dirty
+	responses, err = dispatchCommand(commands, conn)
+	if err == nil {
+		trackCommandKeys(redisCommand, commands, conn)
+	}
+	propagateCall(redisCommand, commands, dirty)
+	return responses, err
+}
+
+// Runs the handler of the command.
+func dispatchCommand(commands []string, conn net.Conn) ([]string, error) {
+	switch commands[0] {
 
 	case "ping":
+		if clientInPubSubContext(conn) { // RESP2 subscribers get the pong in the same shape as messages
+			return []string{respEncodeStringArray([]string{"pong", ""})}, nil
+		}
 		return onPING()
 	case "echo":
 		return onECHO(commands)
@@ -42,13 +91,20 @@ func executeResp(commands []string, conn net.Conn) (responses []string, err erro
 	case "info":
 		return onINFO(commands)
 	case "replconf":
-		return onREPLCONF(commands, ackChan)
+		return onREPLCONF(commands)
+	case "replicaof", "slaveof":
+		return onREPLICAOF(commands)
+	case "role":
+		return onROLE(commands)
+	case "failover":
+		return onFAILOVER(commands)
+	case "sentinel":
+		return onSENTINEL(commands, conn)
 	case "psync":
-		// Save the connection as a replica for propagation.
-		registerReplica(conn)
-		return onPSYNC()
+		// Saves the connection as a replica for propagation.
+		return onPSYNC(commands, conn)
 	case "wait":
-		return onWAIT(commands, ackChan)
+		return onWAIT(commands, conn)
 	case "type":
 		return onTYPE(commands)
 	case "xrange":
@@ -56,7 +112,7 @@ func executeResp(commands []string, conn net.Conn) (responses []string, err erro
 	case "xadd":
 		return onXADD(commands)
 	case "xread":
-		return onXREAD(commands)
+		return onXREAD(commands, conn)
 	case "incr":
 		return onINCR(commands)
 	case "multi":
@@ -65,44 +121,336 @@ func executeResp(commands []string, conn net.Conn) (responses []string, err erro
 		return onEXEC(commands, conn)
 	case "discard":
 		return onDISCARD(commands, conn)
+	case "watch":
+		return onWATCH(commands, conn)
+	case "unwatch":
+		return onUNWATCH(commands, conn)
+	case "auth":
+		return onAUTH(commands, conn)
+	case "acl":
+		return onACL(commands, conn)
+	case "client":
+		return onCLIENT(commands, conn)
+	case "hello":
+		return onHELLO(commands, conn)
+	case "subscribe", "psubscribe":
+		return onSUBSCRIBE(commands, conn)
+	case "unsubscribe", "punsubscribe":
+		return onUNSUBSCRIBE(commands, conn)
+	case "publish":
+		if CONFIG.sentinelMode {
+			return onSentinelPUBLISH(commands)
+		}
+		return onPUBLISH(commands)
+	case "select":
+		return onSELECT(commands, conn)
+	case "swapdb":
+		return onSWAPDB(commands)
+	case "move":
+		return onMOVE(commands)
+	case "copy":
+		return onCOPY(commands)
+	case "dbsize":
+		return onDBSIZE(commands)
+	case "flushdb":
+		return onFLUSHDB(commands)
+	case "flushall":
+		return onFLUSHALL(commands)
+	case "save":
+		return onSAVE(commands)
+	case "expire", "pexpire", "expireat", "pexpireat":
+		return onEXPIRE(commands)
+	case "ttl", "pttl", "expiretime", "pexpiretime":
+		return onTTL(commands)
+	case "persist":
+		return onPERSIST(commands)
+	case "del", "unlink":
+		return onDEL(commands)
+	case "exists":
+		return onEXISTS(commands)
+	case "touch":
+		return onTOUCH(commands)
+	case "rename", "renamenx":
+		return onRENAME(commands)
+	case "randomkey":
+		return onRANDOMKEY(commands)
+	case "object":
+		return onOBJECT(commands)
+	case "scan":
+		return onSCAN(commands)
+	case "hscan", "sscan", "zscan":
+		return onHSCAN(commands)
+	case "sort", "sort_ro":
+		return onSORT(commands, conn)
 
 	}
 	return nil, fmt.Errorf("error parsing request")
 }
 
+func onAUTH(commands []string, conn net.Conn) ([]string, error) {
+	args := commands[1:]
+	if len(args) > 2 {
+		return []string{respEncodeError("ERR syntax error")}, nil
+	}
+
+	// AUTH password is AUTH default password
+	username, password := "default", args[0]
+	if len(args) == 2 {
+		username, password = args[0], args[1]
+	} else if CONFIG.acl.users["default"].nopass {
+		return []string{respEncodeError("ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")}, nil
+	}
+
+	user, exists := CONFIG.acl.users[username]
+	if !exists || !user.checkPassword(password) {
+		addACLLogEntry("auth", "AUTH", username, conn)
+		return []string{respEncodeError("WRONGPASS invalid username-password pair or user is disabled.")}, nil
+	}
+
+	if client, exists := CONFIG.clients[conn]; exists {
+		client.user = user.name
+	}
+	return []string{respEncodeString("OK")}, nil
+}
+
+// HELLO [protover [AUTH username password] [SETNAME clientname]]
+func onHELLO(commands []string, conn net.Conn) ([]string, error) {
+	args := commands[1:]
+	client := CONFIG.clients[conn]
+
+	protocol := client.resp
+	if len(args) > 0 {
+		version, err := strconv.Atoi(args[0])
+		if err != nil {
+			return []string{respEncodeError("ERR Protocol version is not an integer or out of range")}, nil
+		}
+		if version < 2 || version > 3 {
+			return []string{respEncodeError("NOPROTO unsupported protocol version")}, nil
+		}
+		protocol = version
+	}
+
+	var username, password, name string
+	auth, setName := false, false
+	for i := 1; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "auth":
+			if i+2 >= len(args) {
+				return []string{respEncodeError(fmt.Sprintf("ERR Syntax error in HELLO option '%s'", args[i]))}, nil
+			}
+			auth, username, password = true, args[i+1], args[i+2]
+			i += 2
+		case "setname":
+			if i+1 >= len(args) {
+				return []string{respEncodeError(fmt.Sprintf("ERR Syntax error in HELLO option '%s'", args[i]))}, nil
+			}
+			setName, name = true, args[i+1]
+			i++
+		default:
+			return []string{respEncodeError(fmt.Sprintf("ERR Syntax error in HELLO option '%s'", args[i]))}, nil
+		}
+	}
+
+	if auth {
+		responses, _ := onAUTH([]string{"auth", username, password}, conn)
+		if responses[0] != respEncodeString("OK") {
+			return responses, nil
+		}
+	}
+	if _, authenticated := connectionUser(conn); !authenticated && !isSuperConnection(conn) {
+		return []string{respEncodeError("NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time")}, nil
+	}
+	if setName {
+		if responses, _ := _clientSetName([]string{name}, client); responses[0] != respEncodeString("OK") {
+			return responses, nil
+		}
+	}
+	client.resp = protocol
+
+	role := "master"
+	if CONFIG.isSlave {
+		role = "replica"
+	}
+	return []string{respEncodeMap([]string{
+		respEncodeBulkString("server"), respEncodeBulkString("redis"),
+		respEncodeBulkString("version"), respEncodeBulkString(redisVersion),
+		respEncodeBulkString("proto"), respEncodeInteger(protocol),
+		respEncodeBulkString("id"), respEncodeInteger(client.id),
+		respEncodeBulkString("mode"), respEncodeBulkString("standalone"),
+		respEncodeBulkString("role"), respEncodeBulkString(role),
+		respEncodeBulkString("modules"), respEncodeArray([]string{}),
+	}, protocol)}, nil
+}
+
+func onACL(commands []string, conn net.Conn) ([]string, error) {
+	args := commands[2:]
+
+	switch strings.ToLower(commands[1]) {
+	case "setuser":
+		return _aclSetUser(args)
+	case "getuser":
+		return _aclGetUser(args)
+	case "deluser":
+		return _aclDelUser(args)
+	case "list":
+		return _aclList()
+	case "users":
+		return []string{respEncodeStringArray(sortedUserNames())}, nil
+	case "whoami":
+		username := "default"
+		if isSuperConnection(conn) {
+			// internal and master link commands run as the default user
+		} else if user, authenticated := connectionUser(conn); authenticated {
+			username = user.name
+		}
+		return []string{respEncodeBulkString(username)}, nil
+	case "cat":
+		return _aclCat(args)
+	case "dryrun":
+		return _aclDryRun(args)
+	case "log":
+		return _aclLog(args)
+	case "load":
+		return _aclLoad()
+	case "save":
+		return _aclSave()
+	}
+	return nil, fmt.Errorf("acl: unsupported subcommand")
+}
+
+func onCLIENT(commands []string, conn net.Conn) ([]string, error) {
+	args := commands[2:]
+	client, exists := CONFIG.clients[conn]
+	if !exists {
+		return nil, fmt.Errorf("client: no client for this connection")
+	}
+
+	switch strings.ToLower(commands[1]) {
+	case "list":
+		return _clientList(args)
+	case "info":
+		return []string{respEncodeBulkString(client.info() + "\n")}, nil
+	case "id":
+		return []string{respEncodeInteger(client.id)}, nil
+	case "setname":
+		return _clientSetName(args, client)
+	case "getname":
+		if client.name == "" {
+			return []string{"$-1\r\n"}, nil
+		}
+		return []string{respEncodeBulkString(client.name)}, nil
+	case "setinfo":
+		return _clientSetInfo(args, client)
+	case "kill":
+		return _clientKill(args, client)
+	case "pause":
+		return _clientPause(args)
+	case "unpause":
+		endClientPause()
+		return []string{respEncodeString("OK")}, nil
+	case "tracking":
+		return _clientTracking(args, client)
+	case "caching":
+		return _clientCaching(args, client)
+	case "getredir":
+		return _clientGetRedir(client)
+	case "trackinginfo":
+		return _clientTrackingInfo(client)
+	case "no-evict":
+		switch strings.ToLower(args[0]) {
+		case "on":
+			client.noEvict = true
+		case "off":
+			client.noEvict = false
+		default:
+			return []string{respEncodeError("ERR syntax error")}, nil
+		}
+		return []string{respEncodeString("OK")}, nil
+	}
+	return nil, fmt.Errorf("client: unsupported subcommand")
+}
+
 func onDISCARD(_ []string, conn net.Conn) ([]string, error) {
-	transaction, exists := CONFIG.transactions[conn]
-	if !exists || !transaction.active {
+	transaction := clientTransaction(conn)
+	if !transaction.active {
 		return []string{respEncodeError("ERR DISCARD without MULTI")}, nil
 	}
 
 	// clear the transaction
 	transaction.active = false
+	transaction.errored = false
 	transaction.commandQueue = make([][]string, 0)
 
-	CONFIG.transactions[conn] = transaction
+	unwatchAllKeys(conn)
+	return []string{respEncodeString("OK")}, nil
+}
+
+func onWATCH(commands []string, conn net.Conn) ([]string, error) {
+	args := commands[1:]
+	if len(args) < 1 {
+		return []string{respEncodeError("ERR wrong number of arguments for 'watch' command")}, nil
+	}
+
+	if clientTransaction(conn).active {
+		return []string{respEncodeError("ERR WATCH inside MULTI is not allowed")}, nil
+	}
+
+	db := currentDB()
+	for _, key := range args {
+		watchKey(conn, db, key)
+	}
+	return []string{respEncodeString("OK")}, nil
+}
+
+func onUNWATCH(_ []string, conn net.Conn) ([]string, error) {
+	unwatchAllKeys(conn)
 	return []string{respEncodeString("OK")}, nil
 }
 
 func onEXEC(_ []string, conn net.Conn) ([]string, error) {
-	transaction, exists := CONFIG.transactions[conn]
-	if !exists || !transaction.active {
+	transaction := clientTransaction(conn)
+	if !transaction.active {
 		// multi has not been called
 		return []string{respEncodeError("ERR EXEC without MULTI")}, nil
 	}
 
-	if len(transaction.commandQueue) == 0 {
-		// multi has been called, but no commands have been queued. return empty array and clear the multi
-		transaction.active = false
-		CONFIG.transactions[conn] = transaction
+	// The transaction is over either way. Clearing it before running the queue, otherwise
+	// the queued commands would just get queued again.
+	commandQueue := transaction.commandQueue
+	transaction.active = false
+	transaction.commandQueue = make([][]string, 0)
+
+	// A command got rejected while queueing: nothing gets executed.
+	if transaction.errored {
+		transaction.errored = false
+		unwatchAllKeys(conn)
+		return []string{respEncodeError("EXECABORT Transaction discarded because of previous errors.")}, nil
+	}
+
+	// A watched key was touched since WATCH: abort the whole transaction with a null reply.
+	if transaction.dirty || watchedKeyExpired(conn) {
+		unwatchAllKeys(conn)
+		return []string{"*-1\r\n"}, nil
+	}
+
+	// The keys only need to stay untouched until EXEC starts.
+	unwatchAllKeys(conn)
+
+	if len(commandQueue) == 0 {
+		// multi has been called, but no commands have been queued. return empty array
 		return []string{"*0\r\n"}, nil
 	}
 
-	responses := make([]string, 0, len(transaction.commandQueue))
-	for _, request := range transaction.commandQueue {
-		response, err := executeResp(request, nil) // leaving conn as nil ig.
+	// Every queued command gets exactly one element in the reply. Failing commands get an
+	// error element, the rest of the transaction still runs (no rollbacks, like redis).
+	CONFIG.inExec = true
+	defer func() { CONFIG.inExec = false }()
+
+	responses := make([]string, 0, len(commandQueue))
+	for _, request := range commandQueue {
+		response, err := executeResp(request, conn)
 		if err != nil {
-			// handle this later as well.
+			response = []string{respEncodeCommandError(err)}
 		}
 
 		responses = append(responses, response...)
@@ -115,58 +463,58 @@ func onEXEC(_ []string, conn net.Conn) ([]string, error) {
 		response += r
 	}
 
-	// clear the transaction
-	transaction.active = false
-	transaction.commandQueue = make([][]string, 0)
-	CONFIG.transactions[conn] = transaction
-
 	return []string{response}, nil
 }
 
 func onMULTI(_ []string, conn net.Conn) ([]string, error) {
 	// make a new transaction
-	transaction, exists := CONFIG.transactions[conn]
-	if !exists {
-		CONFIG.transactions[conn] = RedisTransaction{
-			active:       true,
-			commandQueue: make([][]string, 0),
-		}
-	} else if transaction.active {
+	transaction := clientTransaction(conn)
+	if transaction.active {
 		return []string{respEncodeError("ERR MULTI calls can not be nested")}, nil
 	}
 	transaction.active = true
-	CONFIG.transactions[conn] = transaction
+	transaction.commandQueue = make([][]string, 0)
 	return []string{respEncodeString("OK")}, nil
 }
 
 func onINCR(commands []string) ([]string, error) {
+	db := currentDB()
 	args := commands[1:]
 
 	key := args[0]
 
-	record, exists := RDB.keyValueStore.db[key]
-	if !exists {
+	obj := db.lookupKeyWrite(key)
+	if obj == nil {
 		fmt.Println("incr: key doesnt exist, creating new key-value pair...")
-		RDB.keyValueStore.db[key] = RedisRecord{
-			value: "1",
-		}
+		db.setKey(key, newStringObject("1"))
+		signalModifiedKey(db, key)
+		notifyKeyspaceEvent(notifyNew, "new", key, db.id)
+		notifyKeyspaceEvent(notifyString, "incrby", key, db.id)
 		return []string{respEncodeInteger(1)}, nil
 	}
+	if obj.objType != objString {
+		return []string{respEncodeError(wrongTypeError)}, nil
+	}
 
-	numericalVal, err := strconv.Atoi(record.value)
+	numericalVal, err := strconv.ParseInt(obj.value.(string), 10, 64)
 	if err != nil { // not a number
 		return []string{respEncodeError("ERR value is not an integer or out of range")}, nil
 	}
+	if numericalVal == math.MaxInt64 {
+		return []string{respEncodeError("ERR increment or decrement would overflow")}, nil
+	}
 
-	// Increment the value
+	// Increment the value. The key keeps its TTL.
 	numericalVal++
-	record.value = fmt.Sprintf("%d", numericalVal)
-	RDB.keyValueStore.db[key] = record
+	obj.value = strconv.FormatInt(numericalVal, 10)
+	obj.updateEncoding()
+	signalModifiedKey(db, key)
+	notifyKeyspaceEvent(notifyString, "incrby", key, db.id)
 
-	return []string{respEncodeInteger(numericalVal)}, nil
+	return []string{respEncodeInteger(int(numericalVal))}, nil
 }
 
-func onXREAD(commands []string) ([]string, error) {
+func onXREAD(commands []string, conn net.Conn) ([]string, error) {
 	// Parsing args: expecting "block" to come before "stream".
 	args := commands[1:]
 	if len(args) < 3 {
@@ -181,10 +529,10 @@ func onXREAD(commands []string) ([]string, error) {
 	blockingMs := 0
 
 	// set the blocking values and identify the start of the stream keys.
-	if args[0] == "block" {
+	if strings.ToLower(args[0]) == "block" {
 		isBlocking = true
 		ms, err := strconv.Atoi(args[1])
-		if err != nil {
+		if err != nil || ms < 0 {
 			return nil, fmt.Errorf("xread: invalid blocking timeout")
 		}
 
@@ -192,7 +540,7 @@ func onXREAD(commands []string) ([]string, error) {
 		streamsStart = 2
 	}
 
-	if args[streamsStart] != "streams" {
+	if len(args) <= streamsStart || strings.ToLower(args[streamsStart]) != "streams" {
 		return nil, fmt.Errorf("xread: incorrect format, expected 'streams [...stream_key]'")
 	}
 
@@ -200,59 +548,102 @@ func onXREAD(commands []string) ([]string, error) {
 	streamsStart++
 
 	// Split arguments into stream keys and their respective start IDs
-	numStreams := len(args[streamsStart:]) / 2 // Will be evenly divisible by 2 (after "streams", we have [...streamKey] [...entryIDs] , which should be the same number)
+	if len(args[streamsStart:]) == 0 || len(args[streamsStart:])%2 != 0 {
+		return []string{respEncodeError("ERR Unbalanced 'xread' list of streams: for each stream key an ID or '$' must be specified.")}, nil
+	}
+	numStreams := len(args[streamsStart:]) / 2 // after "streams", we have [...streamKey] [...entryIDs] , which should be the same number
 	streamKeys := args[streamsStart : streamsStart+numStreams]
-	startIDs := args[streamsStart+numStreams:]
+	startIDs := make([]string, numStreams)
+	copy(startIDs, args[streamsStart+numStreams:])
 
-	// Build the response (resp array)
-	response := fmt.Sprintf("*%d\r\n", len(streamKeys))
+	// Every key has to hold a stream (or nothing yet).
+	for _, streamKey := range streamKeys {
+		if obj := currentDB().lookupKeyRead(streamKey); obj != nil && obj.objType != objStream {
+			return []string{respEncodeError(wrongTypeError)}, nil
+		}
+	}
 
-	// for each stream to be read...
-	for i, streamKey := range streamKeys {
-		stream, exists := RDB.streamStore.streams[streamKey]
-		if !exists {
-			return nil, fmt.Errorf("xread: stream '%s' not found", streamKey)
+	// '$' means "only entries added after this call". Resolved once, against each stream's own
+	// last entry (or 0-0 for streams that don't exist yet), so later wakeups compare against the same IDs.
+	for i, startID := range startIDs {
+		if startID == "$" {
+			startIDs[i] = lastStreamEntryID(currentDB(), streamKeys[i])
 		}
+	}
 
-		startID := startIDs[i]
-		if startID == "$" { // we're waiting for new entries. easy way to do this
-			startID = RDB.streamStore.lastStreamEntryID
+	// Inside a transaction XREAD BLOCK behaves like a plain XREAD, it can't hold up the EXEC.
+	if !isBlocking || CONFIG.inExec {
+		if response, found := _xreadCollect(streamKeys, startIDs); found {
+			return []string{response}, nil
 		}
+		return []string{"$-1\r\n"}, nil
+	}
 
-		if isBlocking {
-			var timeChan <-chan time.Time = nil
-			if blockingMs != 0 {
-				timeChan = time.After(time.Duration(blockingMs) * time.Millisecond)
-			}
+	// Registering on all the streams at once before looking at them, so an XADD landing
+	// between the check and the wait still wakes us up.
+	waiter := addStreamWaiter(streamKeys)
+	defer removeStreamWaiter(streamKeys, waiter)
 
-			updateChan := stream.blockCh
-
-		timeloop:
-			for {
-				select {
-				case <-timeChan:
-					break timeloop
-				case newEntry := <-updateChan:
-					// Only breaking the loop if it's a new entry that satisfies the startID< condition
-					if startID < newEntry {
-						stream = RDB.streamStore.streams[streamKey]
-						break timeloop
-					}
-				}
+	if response, found := _xreadCollect(streamKeys, startIDs); found {
+		return []string{response}, nil
+	}
+
+	var timeChan <-chan time.Time = nil // blocking for 0ms means blocking forever
+	if blockingMs != 0 {
+		timeChan = time.After(time.Duration(blockingMs) * time.Millisecond)
+	}
+
+	for {
+		timedOut, gone := false, false
+		blockWithoutExecutionLock(conn, func(disconnected <-chan struct{}) {
+			select {
+			case <-timeChan:
+				timedOut = true
+			case <-waiter:
+			case <-disconnected:
+				gone = true
 			}
+		})
+		if gone {
+			return nil, nil // nobody left to reply to
+		}
+
+		// Woken up by an XADD on one of the streams. Might not be an entry we care about, check again.
+		if response, found := _xreadCollect(streamKeys, startIDs); found {
+			return []string{response}, nil
+		}
+		if timedOut {
+			return []string{"$-1\r\n"}, nil
+		}
+	}
+}
+
+// Gathers the entries newer than the respective start IDs from each of the streams, and
+// builds the XREAD response from them. Streams without new entries are left out of the
+// response. Returns false if none of the streams had anything to return.
+func _xreadCollect(streamKeys []string, startIDs []string) (string, bool) {
+	db := currentDB()
+	response := ""
+	count := 0
+
+	// for each stream to be read...
+	for i, streamKey := range streamKeys {
+		obj := db.lookupKey(streamKey)
+		if obj == nil || obj.objType != objStream {
+			continue
 		}
+		stream := obj.value.(*RedisStream)
 
 		// Gather entries
 		entries := make([]StreamEntry, 0)
 		for _, entryID := range stream.entryOrder {
-			if startID == "-" || entryID > startID {
+			if compareStreamIDs(entryID, startIDs[i]) > 0 {
 				entries = append(entries, *stream.entries[entryID])
 			}
 		}
 
-		// No entries found. return null bulk string
 		if len(entries) == 0 {
-			return []string{"$-1\r\n"}, nil
+			continue
 		}
 
 		// Add the stream key and entries to the response
@@ -270,13 +661,17 @@ func onXREAD(commands []string) ([]string, error) {
 			encodedEntryFields := respEncodeStringArray(entryFields)
 			response += fmt.Sprintf("*2\r\n%s%s", encodedEntryID, encodedEntryFields)
 		}
+		count++
 	}
 
-	// fmt.Println("XREAD Response: ", response)
-	return []string{response}, nil
+	if count == 0 {
+		return "", false
+	}
+	return fmt.Sprintf("*%d\r\n", count) + response, true
 }
 
 func onXRANGE(commands []string) ([]string, error) {
+	db := currentDB()
 	args := commands[1:]
 	if len(args) < 3 {
 		return []string{}, fmt.Errorf("not enough args for XRANGE")
@@ -286,10 +681,14 @@ func onXRANGE(commands []string) ([]string, error) {
 	startID := args[1]
 	endID := args[2]
 
-	stream, exists := RDB.streamStore.streams[streamKey]
-	if !exists {
-		return []string{}, fmt.Errorf("xrange: stream not found")
+	obj := db.lookupKeyRead(streamKey)
+	if obj == nil {
+		return []string{"*0\r\n"}, nil
+	}
+	if obj.objType != objStream {
+		return []string{respEncodeError(wrongTypeError)}, nil
 	}
+	stream := obj.value.(*RedisStream)
 
 	// gather the entries
 	entries := make([]StreamEntry, 0)
@@ -320,22 +719,24 @@ func onXRANGE(commands []string) ([]string, error) {
 }
 
 func onXADD(commands []string) ([]string, error) {
+	db := currentDB()
 	args := commands[1:]
-	if len(args) < 4 {
-		return []string{}, fmt.Errorf("not enough arguements for XADD")
+	if len(args) < 4 || len(args)%2 != 0 {
+		return []string{respEncodeError("ERR wrong number of arguments for 'xadd' command")}, nil
 	}
 
 	streamKey := args[0]
 	entryId := args[1]
 
-	stream, exists := RDB.streamStore.streams[streamKey]
-	if !exists {
-		RDB.streamStore.streams[streamKey] = RedisStream{
-			entries:    make(map[string]*StreamEntry),
-			entryOrder: make([]string, 0),
-			blockCh:    make(chan string),
-		}
-		stream = RDB.streamStore.streams[streamKey]
+	// The stream only gets created once the entry is known to be valid.
+	obj := db.lookupKeyWrite(streamKey)
+	exists := obj != nil
+	if exists && obj.objType != objStream {
+		return []string{respEncodeError(wrongTypeError)}, nil
+	}
+	stream := &RedisStream{entries: make(map[string]*StreamEntry)}
+	if exists {
+		stream = obj.value.(*RedisStream)
 	}
 
 	entryId, err := handleStreamEntryID(stream, entryId)
@@ -360,20 +761,27 @@ func onXADD(commands []string) ([]string, error) {
 
 	stream.entries[entryId] = streamEntry
 	stream.entryOrder = append(stream.entryOrder, entryId)
-	RDB.streamStore.lastStreamEntryID = entryId // storing this entry ID as the last one added.
-
-	// update the channel
-	select { // non blocking update
-	case stream.blockCh <- entryId:
-	default:
+	if !exists {
+		db.setKey(streamKey, newObject(objStream, stream))
+	}
+	signalModifiedKey(db, streamKey)
+	if !exists {
+		notifyKeyspaceEvent(notifyNew, "new", streamKey, db.id)
 	}
+	notifyKeyspaceEvent(notifyStream, "xadd", streamKey, db.id)
 
-	RDB.streamStore.streams[streamKey] = stream
+	// wake up everyone blocked on this stream (XREAD BLOCK)
+	signalStreamWaiters(streamKey)
+
+	// The replicas have to add the entry with the id generated here, not generate their own.
+	propagated := append([]string{"xadd", streamKey, entryId}, args[2:]...)
+	rewriteCommandPropagation(propagated...)
 
 	return []string{respEncodeBulkString(entryId)}, nil
 }
 
 func onTYPE(commands []string) ([]string, error) {
+	db := currentDB()
 	if len(commands) <= 1 {
 		return []string{}, fmt.Errorf("not enough arguments provided")
 	}
@@ -381,91 +789,74 @@ func onTYPE(commands []string) ([]string, error) {
 	args := commands[1:]
 	key := args[0]
 
-	// check key-value store
-	_, exists := RDB.keyValueStore.db[key]
-	if exists {
-		return []string{respEncodeString("string")}, nil
+	// TYPE doesn't count as an access
+	obj := db.lookupKey(key)
+	if obj == nil {
+		return []string{respEncodeString("none")}, nil
 	}
-
-	// check stream store
-	_, exists = RDB.streamStore.streams[key]
-	if exists {
-		return []string{respEncodeString("stream")}, nil
-	}
-	return []string{respEncodeString("none")}, nil
+	return []string{respEncodeString(obj.objType)}, nil
 }
 
-func onWAIT(commands []string, ackChan chan bool) ([]string, error) {
-	// Waits(blocks) until it either times out, or gets the specified number of ACKs from replicas. (runs on master server)
-	args := commands[1:]
-
-	someNumber, _ := strconv.Atoi(args[0])
-	timeoutDuration, _ := strconv.Atoi(args[1])
-
-	// Going to send out "replconf getack *"  requests to the replicas
-	getAckReq := []byte(
-		respEncodeStringArray([]string{"REPLCONF", "GETACK", "*"}),
-	)
-
-	// When all the replicas are in sync, reply should be the total count of replicas. But the timeout the tests give is so small that the replicas will not reply in time, and it'll timeout before getting any acks.
-	// Yes, this is a cheap hack. I do not have time to think of sth better unfortunately.
-	// TODO: Fix this ugly shit.
-	if CONFIG.masterReplOffset == 0 {
-		return []string{respEncodeInteger(len(CONFIG.replicas))}, nil
+// WAIT numreplicas timeout. Blocks until numreplicas replicas acknowledged every write the client
+// made (its woff), or the timeout (in milliseconds, 0 for none) runs out. Replies with how many did.
+func onWAIT(commands []string, conn net.Conn) ([]string, error) {
+	if CONFIG.isSlave {
+		return []string{respEncodeError("ERR WAIT cannot be used with replica instances. Please also note that since Redis 4.0 if a replica is configured to be writable (which is not the default) writes to replicas are just local and are not propagated.")}, nil
 	}
-
-	// The replicas should have their own connections going in another goroutine. Going to send the replconf get ack from here, and expect the reply in the goroutine that handles the connection to the replica in normal flow.
-	// When an ack is recieved, the ackChan channel is updated, and this will increment the acks counter.
-	acks := 0
-	for _, replica := range CONFIG.replicas {
-		go func(conn net.Conn) {
-			// for each replica, query it's offset in a go-routine
-			bytesWritten, _ := replica.conn.Write(getAckReq)
-			replica.offset += bytesWritten
-		}(replica.conn)
+	numReplicas, err := strconv.Atoi(commands[1])
+	timeout, errTimeout := strconv.Atoi(commands[2])
+	if err != nil || errTimeout != nil {
+		return []string{respEncodeError("ERR value is not an integer or out of range")}, nil
 	}
-
-	// Handling the timer.
-	timerChan := time.After(time.Duration(timeoutDuration) * time.Millisecond)
-
-	fmt.Println("Waiting ...")
-loop: // label just to break the loop
-	for acks < someNumber { // loop and block until...
-		select {
-		case <-ackChan: // recieved an ack response for a replica (on it's connection goroutine)
-			acks++
-			fmt.Printf("Waiting: Recieved ack - %d", acks)
-
-		case <-timerChan: // timer timed out
-			fmt.Println("Waiting: timed out.")
-			break loop
-		}
+	if timeout < 0 {
+		return []string{respEncodeError("ERR timeout is negative")}, nil
 	}
 
-	return []string{respEncodeInteger(acks)}, nil
-}
+	target := 0
+	if client, exists := CONFIG.clients[conn]; exists {
+		target = client.woff
+	}
 
-func onPSYNC() ([]string, error) {
-	// args := commands[1:]
-	responses := make([]string, 0, 3)
+	// Inside a transaction there's no waiting, just the count as it is.
+	acked := countAckedReplicas(target)
+	if acked >= numReplicas || CONFIG.inExec {
+		return []string{respEncodeInteger(acked)}, nil
+	}
 
-	// Need to send 2 responses. First a FULL RESYNC response. Then, an encoded version of the rdb store.
-	response := respEncodeString(fmt.Sprintf("FULLRESYNC %s %d", CONFIG.masterReplID, CONFIG.masterReplOffset))
-	responses = append(responses, response)
+	// Asking the replicas where they are right away, instead of waiting for their next ACK.
+	// GETACK goes through the replication stream, so it gets there after the writes.
+	propagateCommands([]byte(respEncodeStringArray([]string{"REPLCONF", "GETACK", "*"})))
 
-	// Unlike regular bulk strings, the encoded rdb we have to send to the server doesnt have the final /r/n
-	encodedRDB := string(encodeRDB(RDB))
-	response = respEncodeBulkString(encodedRDB)
+	acks := make(chan struct{}, 1)
+	ackWaiters[acks] = struct{}{}
+	defer delete(ackWaiters, acks)
 
-	// remove that final /r/n at the end of the bulk encoded string
-	response = response[:len(response)-2]
-	responses = append(responses, response)
-	return responses, nil
+	var timedOut <-chan time.Time // nil blocks forever
+	if timeout > 0 {
+		timedOut = time.After(time.Duration(timeout) * time.Millisecond)
+	}
+	for done := false; acked < numReplicas && !done; acked = countAckedReplicas(target) {
+		blockWithoutExecutionLock(conn, func(disconnected <-chan struct{}) {
+			select {
+			case <-acks:
+			case <-timedOut:
+				done = true
+			case <-disconnected:
+				done = true
+			}
+		})
+	}
+	return []string{respEncodeInteger(acked)}, nil
 }
 
-func onREPLCONF(commands []string, ackChan chan bool) ([]string, error) {
+// REPLCONF, the replication handshake and acknowledgements. listening-port and capa come
+// from replicas during the handshake. GETACK comes from our master, and ACK from our replicas.
+func onREPLCONF(commands []string) ([]string, error) {
 	args := commands[1:]
-	switch args[0] {
+	if len(args) < 2 || len(args)%2 != 0 { // option value pairs, always
+		return []string{respEncodeError("ERR syntax error")}, nil
+	}
+	switch strings.ToLower(args[0]) {
 	case "getack":
 		if args[1] == "*" {
 			offset := fmt.Sprintf("%d", CONFIG.masterReplOffset)
@@ -473,9 +864,34 @@ func onREPLCONF(commands []string, ackChan chan bool) ([]string, error) {
 			return []string{respEncodeStringArray(response)}, nil
 		}
 
-	case "ack":
-		if !CONFIG.isSlave { // master recieved ack.
-			ackChan <- true
+	case "listening-port", "capa":
+		// Option value pairs, capa can come more than once (REPLCONF capa eof capa psync2).
+		client := CONFIG.currentClient
+		for i := 0; i+1 < len(args) && client != nil; i += 2 {
+			switch strings.ToLower(args[i]) {
+			case "listening-port":
+				client.listeningPort, _ = strconv.Atoi(args[i+1])
+			case "capa":
+				if strings.EqualFold(args[i+1], "eof") {
+					client.replCapaEOF = true
+				}
+			}
+		}
+
+	case "ack": // never replied to
+		offset, err := strconv.Atoi(args[1])
+		if err != nil || CONFIG.currentClient == nil {
+			return []string{}, nil
+		}
+		for _, replica := range CONFIG.replicas {
+			if replica.conn == CONFIG.currentClient.conn {
+				if replica.state == replicaWaitAck { // loaded its diskless snapshot, ready for the stream
+					replica.putOnline()
+				}
+				replica.ackOffset = max(replica.ackOffset, offset)
+				replica.ackTime = time.Now()
+				signalAckWaiters()
+			}
 		}
 		return []string{}, nil
 	}
@@ -485,37 +901,161 @@ func onREPLCONF(commands []string, ackChan chan bool) ([]string, error) {
 	return responses, nil
 }
 
+// INFO [section ...]. The server, replication and (in sentinel mode) sentinel sections,
+// all of them without arguments. Unknown sections are left out.
 func onINFO(commands []string) ([]string, error) {
-	args := commands[1:]
-	responses := make([]string, 0, 3)
+	sections := commands[1:]
+	if len(sections) == 0 {
+		sections = []string{"all"}
+	}
+	if len(sections) == 1 {
+		switch strings.ToLower(sections[0]) {
+		case "all", "default", "everything":
+			sections = []string{"server", "replication", "sentinel"}
+		}
+	}
 
-	for _, arg := range args {
-		switch arg {
+	info := []string{}
+	for _, section := range sections {
+		switch strings.ToLower(section) {
+		case "server":
+			info = append(info, _infoServer())
 		case "replication":
-			if CONFIG.isSlave {
-				response := respEncodeBulkString("role:slave")
-				responses = append(responses, response)
+			if !CONFIG.sentinelMode {
+				info = append(info, _infoReplication())
 			}
+		case "sentinel":
+			if CONFIG.sentinelMode {
+				info = append(info, infoSentinel())
+			}
+		}
+	}
+	return []string{respEncodeBulkString(strings.Join(info, "\r\n\r\n"))}, nil
+}
 
-			rawResponse := fmt.Sprintf("role:master\r\nmaster_repl_offset:%d\r\nmaster_replid:%s", CONFIG.masterReplOffset, CONFIG.masterReplID)
-			response := respEncodeBulkString(rawResponse)
-			responses = append(responses, response)
-			return responses, nil
+func _infoServer() string {
+	mode := "standalone"
+	if CONFIG.sentinelMode {
+		mode = "sentinel"
+	}
+	return fmt.Sprintf("# Server\r\nredis_version:%s\r\nredis_mode:%s\r\nprocess_id:%d\r\nrun_id:%s\r\ntcp_port:%d",
+		redisVersion, mode, os.Getpid(), CONFIG.runID, CONFIG.port)
+}
+
+func _infoReplication() string {
+	info := "# Replication\r\nrole:master"
+	if CONFIG.isSlave {
+		info = "# Replication\r\nrole:slave\r\n" + _infoMasterLink()
+	}
+	info += "\r\n" + _infoReplicas()
+	info += "\r\nmaster_failover_state:" + failoverStateNames[CONFIG.failover.state]
+	info += fmt.Sprintf("\r\nmaster_repl_offset:%d\r\nmaster_replid:%s\r\nmaster_replid2:%s\r\nsecond_repl_offset:%d",
+		CONFIG.masterReplOffset, CONFIG.masterReplID, CONFIG.masterReplID2, CONFIG.secondReplOffset)
+	if backlog := CONFIG.replBacklog; backlog != nil {
+		info += fmt.Sprintf("\r\nrepl_backlog_active:1\r\nrepl_backlog_size:%d\r\nrepl_backlog_first_byte_offset:%d\r\nrepl_backlog_histlen:%d",
+			len(backlog.buffer), backlog.firstByteOffset()+1, backlog.histlen)
+	} else {
+		info += fmt.Sprintf("\r\nrepl_backlog_active:0\r\nrepl_backlog_size:%d", CONFIG.replBacklogSize)
+	}
+	return info
+}
+
+// The INFO replication fields about our replicas: one line each, with where it listens, how far
+// along the stream it acknowledged, and how long ago it did.
+func _infoReplicas() string {
+	info := fmt.Sprintf("connected_slaves:%d", len(CONFIG.replicas))
+	if CONFIG.minReplicasToWrite > 0 {
+		info += fmt.Sprintf("\r\nmin_slaves_good_slaves:%d", countGoodReplicas())
+	}
+	for i, replica := range CONFIG.replicas {
+		ip, listeningPort := replica.address()
+		info += fmt.Sprintf("\r\nslave%d:ip=%s,port=%d,state=%s,offset=%d,lag=%d",
+			i, ip, listeningPort, replicaStateNames[replica.state], replica.ackOffset, replica.lag())
+	}
+	return info
+}
+
+// The INFO replication fields about the link to our master.
+func _infoMasterLink() string {
+	linkStatus, lastIO, syncInProgress := "down", -1, 0
+	if CONFIG.replState == replStateConnected {
+		linkStatus, lastIO = "up", int(time.Since(CONFIG.masterLastIO)/time.Second)
+	}
+	if CONFIG.replState == replStateTransfer {
+		syncInProgress = 1
+	}
+
+	readOnly := 0
+	if CONFIG.replicaReadOnly {
+		readOnly = 1
+	}
+
+	info := fmt.Sprintf("master_host:%s\r\nmaster_port:%s\r\nmaster_link_status:%s\r\nmaster_last_io_seconds_ago:%d\r\nmaster_sync_in_progress:%d\r\nslave_repl_offset:%d\r\nslave_priority:%d\r\nslave_read_only:%d",
+		CONFIG.masterHost, CONFIG.masterPort, linkStatus, lastIO, syncInProgress, CONFIG.masterReplOffset, CONFIG.replicaPriority, readOnly)
+	if linkStatus == "down" {
+		downSince := -1
+		if !CONFIG.masterLinkDownSince.IsZero() {
+			downSince = int(time.Since(CONFIG.masterLinkDownSince) / time.Second)
 		}
+		info += fmt.Sprintf("\r\nmaster_link_down_since_seconds:%d", downSince)
 	}
-	return responses, fmt.Errorf("error handling request: INFO - replication flag not provided (all this can handle at the moment)")
+	return info
 }
 
 func onCOMMAND(commands []string) ([]string, error) {
 	args := commands[1:]
 
-	if args[0] == "docs" { // default request when initiating a redis-cli connection
+	if len(args) == 0 {
+		return []string{_commandList()}, nil
+	}
+	if strings.ToLower(args[0]) == "count" {
+		return []string{respEncodeInteger(len(commandTable))}, nil
+	}
+	if strings.ToLower(args[0]) == "docs" { // default request when initiating a redis-cli connection
 		return onPING()
 	}
 
 	return onPING() // just because. // TODO: Fix later
 }
 
+// COMMAND without arguments: every command of the table, as redis describes them (name, arity,
+// flags, first key, last key, key step, acl categories), in name order.
+func _commandList() string {
+	names := make([]string, 0, len(commandTable))
+	for name := range commandTable {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	entries := make([]string, 0, len(names))
+	for _, name := range names {
+		command := commandTable[name]
+		flags := []string{}
+		for _, category := range command.categories {
+			switch category {
+			case "write", "fast", "admin", "blocking":
+				flags = append(flags, category)
+			case "read":
+				flags = append(flags, "readonly")
+			}
+		}
+		categories := make([]string, 0, len(command.categories))
+		for _, category := range command.categories {
+			categories = append(categories, "@"+category)
+		}
+		entries = append(entries, respEncodeArray([]string{
+			respEncodeBulkString(command.name),
+			respEncodeInteger(command.arity),
+			respEncodeStringArray(flags),
+			respEncodeInteger(command.firstKey),
+			respEncodeInteger(command.lastKey),
+			respEncodeInteger(command.keyStep),
+			respEncodeStringArray(categories),
+		}))
+	}
+	return respEncodeArray(entries)
+}
+
 func onPING() ([]string, error) {
 	response := respEncodeString("PONG")
 	responses := []string{response}
@@ -523,56 +1063,28 @@ func onPING() ([]string, error) {
 	return responses, nil
 }
 
+// KEYS pattern. Goes over the whole keyspace at once, SCAN is the way to go on big datasets.
 func onKEYS(commands []string) ([]string, error) {
-	args := commands[1:]
-	responses := make([]string, 0, 3)
+	db := currentDB()
+	pattern := commands[1]
 
-	if len(args) < 1 {
-		return []string{}, fmt.Errorf("not enough args in command")
-	}
-
-	if args[0] == "*" {
-		// return all keys
-		keys := make([]string, 0, len(RDB.keyValueStore.db))
-		for k := range RDB.keyValueStore.db {
-			keys = append(keys, k)
+	keys := make([]string, 0)
+	for key := range db.keys {
+		if stringMatch(pattern, key, false) && keyIsLive(db, key) {
+			keys = append(keys, key)
 		}
-
-		response := respEncodeStringArray(keys)
-		responses = append(responses, response)
-
-		return responses, nil
-	} else {
-		// TODO: If a patern is provided. needs regex matching, will do later.
 	}
-	return responses, fmt.Errorf("error handling request: KEYS - '*' not provided")
+	return []string{respEncodeStringArray(keys)}, nil
 }
 
 func onCONFIG(commands []string) ([]string, error) {
-	// only handling get.
-	if len(commands) <= 1 || commands[1] != "get" {
-		return []string{}, fmt.Errorf("error executing resp: unsupported CONFIG command")
-	}
-
-	args := commands[2:]
-	response := ""
-	count := 0
-	for _, arg := range args {
-		switch arg {
-		case "dir":
-			response += respEncodeBulkString("dir")
-			response += respEncodeBulkString(RDB.config.dir)
-			count += 2
-
-		case "dbfilename":
-			response += respEncodeBulkString("dbfilename")
-			response += respEncodeBulkString(RDB.config.dbFileName)
-			count += 2
-		}
+	switch strings.ToLower(commands[1]) {
+	case "get":
+		return _configGet(commands[2:])
+	case "set":
+		return _configSet(commands[2:])
 	}
-	response = fmt.Sprintf("*%d\r\n", count) + response
-	responses := []string{response}
-	return responses, nil
+	return []string{}, fmt.Errorf("error executing resp: unsupported CONFIG command")
 }
 
 func onECHO(commands []string) ([]string, error) {
@@ -589,61 +1101,135 @@ func onECHO(commands []string) ([]string, error) {
 	return responses, nil
 }
 
+// SET key value [NX|XX] [GET] [EX seconds|PX milliseconds|EXAT unix-time-seconds|PXAT unix-time-milliseconds|KEEPTTL]
+// Overwrites whatever was stored at key, of any type.
 func onSET(commands []string) ([]string, error) {
-	// Set up the record
-	record := RedisRecord{}
+	db := currentDB()
 
 	// parse the commands (set [key] [value] ...args)
 	key := commands[1]
-	record.value = commands[2]
+	value := commands[2]
 
+	nx, xx, get, keepTTL, expires := false, false, false, false, false
+	var expiresAt time.Time
+
+	syntaxError := []string{respEncodeError("ERR syntax error")}
 	args := commands[3:]
-	for i, command := range args { // Handle the args
-		switch command {
-		case "px": // set a timeout on the record
-			t, err := strconv.ParseInt(args[i+1], 0, 0)
-			if err != nil {
-				return []string{}, fmt.Errorf("error parsing resp: SET Command: Timeout (ms) is invalid")
+	for i := 0; i < len(args); i++ { // Handle the args
+		switch option := strings.ToLower(args[i]); option {
+		case "nx":
+			if xx {
+				return syntaxError, nil
 			}
-
-			timeout := time.Duration(t) * time.Millisecond
-			record.expiresAt = time.Now().Add(time.Duration(timeout))
-			record.expires = true
-
-		case "ex": // set timeout in seconds
-			t, err := strconv.ParseInt(args[i+1], 0, 0)
+			nx = true
+		case "xx":
+			if nx {
+				return syntaxError, nil
+			}
+			xx = true
+		case "get":
+			get = true
+		case "keepttl":
+			if expires {
+				return syntaxError, nil
+			}
+			keepTTL = true
+		case "ex", "px", "exat", "pxat": // set a timeout on the record
+			if expires || keepTTL || i+1 >= len(args) {
+				return syntaxError, nil
+			}
+			i++
+			t, err := strconv.ParseInt(args[i], 10, 64)
 			if err != nil {
-				return []string{}, fmt.Errorf("error parsing resp: SET Command: Timeout (s) is invalid")
+				return []string{respEncodeError("ERR value is not an integer or out of range")}, nil
+			}
+			at, valid := _setExpireTime(option, t)
+			if !valid {
+				return []string{respEncodeError("ERR invalid expire time in 'set' command")}, nil
 			}
+			expires, expiresAt = true, at
+		default:
+			return syntaxError, nil
+		}
+	}
 
-			timeout := time.Duration(t)
-			record.expiresAt = time.Now().Add(time.Duration(timeout))
-			record.expires = true
+	old := db.lookupKeyWrite(key)
+	if get && old != nil && old.objType != objString {
+		return []string{respEncodeError(wrongTypeError)}, nil
+	}
+
+	// With GET, the reply is the old value whether the SET happens or not.
+	reply := respEncodeString("OK")
+	if get {
+		reply = "$-1\r\n"
+		if old != nil {
+			reply = respEncodeBulkString(old.value.(string))
+		}
+	}
+	if (nx && old != nil) || (xx && old == nil) {
+		if get {
+			return []string{reply}, nil
 		}
+		return []string{"$-1\r\n"}, nil
 	}
 
-	RDB.keyValueStore.db[key] = record
-	response := respEncodeString("OK")
-	responses := []string{response}
-	return responses, nil
+	obj := newStringObject(value)
+	if keepTTL && old != nil {
+		obj.expires, obj.expiresAt = old.expires, old.expiresAt
+	} else if expires {
+		obj.expires, obj.expiresAt = true, expiresAt
+	}
+
+	db.setKey(key, obj)
+	signalModifiedKey(db, key)
+	if old == nil {
+		notifyKeyspaceEvent(notifyNew, "new", key, db.id)
+	}
+	notifyKeyspaceEvent(notifyString, "set", key, db.id)
+	if expires {
+		notifyKeyspaceEvent(notifyGeneric, "expire", key, db.id)
+		// EX and PX count from now, which is later on the replicas. The absolute time is the same everywhere.
+		rewriteCommandPropagation("set", key, value, "pxat", strconv.FormatInt(expiresAt.UnixMilli(), 10))
+	}
+	return []string{reply}, nil
 }
 
-func onGET(commands []string) ([]string, error) {
-	// I am going to cheat a little here. Sometimes during replication propagation,
-	//  the propagation takes a little too long and the GET commands come too soon.
-	//  (before the SETs from the master are propagated). And i'm tired of the race condition.
-	time.Sleep(10 * time.Millisecond) // TODO: REMOVE THIS without breaking the rest.
-	// SORRY
+// Turns the argument of the EX/PX/EXAT/PXAT option of SET into the time the key expires at.
+// Returns false if it's not a valid expire time (not positive, or overflowing).
+func _setExpireTime(option string, t int64) (time.Time, bool) {
+	if t <= 0 {
+		return time.Time{}, false
+	}
+	if option == "ex" || option == "exat" {
+		if t > math.MaxInt64/1000 {
+			return time.Time{}, false
+		}
+		t *= 1000
+	}
+	if option == "ex" || option == "px" {
+		now := time.Now().UnixMilli()
+		if t > math.MaxInt64-now {
+			return time.Time{}, false
+		}
+		t += now
+	}
+	return time.UnixMilli(t), true
+}
 
+func onGET(commands []string) ([]string, error) {
+	db := currentDB()
 	responses := make([]string, 0, 1)
-	val, exists := RDB.keyValueStore.db[commands[1]]
-	if (!exists) || (val.expires && val.expiresAt.Compare(time.Now()) == -1) {
+	obj := db.lookupKeyRead(commands[1])
+	if obj == nil {
 		// expired or doesn't exist
 		responses = append(responses, "$-1\r\n")
 		return responses, nil
 	}
+	if obj.objType != objString {
+		return []string{respEncodeError(wrongTypeError)}, nil
+	}
 
-	response := respEncodeBulkString(val.value)
+	response := respEncodeBulkString(obj.value.(string))
 	responses = append(responses, response)
 	return responses, nil
 }
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	activeExpireInterval   = 100 * time.Millisecond // how often the expired keys get collected
+	activeExpireBudget     = 25 * time.Millisecond  // max time a single collection can hold the execution lock
+	activeExpireSampleSize = 20                     // keys with an expiry checked at a time
+	activeExpireStalePct   = 25                     // keep sampling a database while more than this % of a sample was expired
+)
+
+// Deletes the key if it has expired. Returns true if it had.
+// Replicas don't delete expired keys themselves, they wait for the master to do it. The
+// key is still reported as expired, so nobody reads a stale value, except to the master
+// link: its commands must see the dataset the way the master did when it ran them.
+func expireIfNeeded(db *RedisDatabase, key string) bool {
+	obj, exists := db.keys[key]
+	if !exists || !obj.isExpired() {
+		return false
+	}
+	if CONFIG.isSlave {
+		return CONFIG.currentClient == nil || !CONFIG.currentClient.isMaster
+	}
+
+	db.deleteKey(key)
+	signalModifiedKey(db, key)
+	notifyKeyspaceEvent(notifyExpired, "expired", key, db.id)
+	alsoPropagate(db.id, "del", key)
+	return true
+}
+
+// Database the next active expire run starts from.
+var activeExpireNextDB = 0
+
+// Expired keys that are never accessed again would stay around forever. This collects them
+// in the background, so they get freed (and their expired events fire) in time.
+func startActiveExpireCycle() {
+	go func() {
+		for range time.Tick(activeExpireInterval) {
+			activeExpireCycle()
+		}
+	}()
+}
+
+// Deletes expired keys, the way redis does: samples keys with an expiry, and keeps going while
+// more than activeExpireStalePct% of a sample had expired (there are likely many more of them).
+// Gives up once it runs out of time.
+func activeExpireCycle() {
+	if CONFIG.isSlave {
+		return
+	}
+
+	executionLock.Lock()
+	defer executionLock.Unlock()
+	if CONFIG.failover.state != failoverNone {
+		return // the stream has to stand still for the failover target to catch up with it
+	}
+	defer propagatePendingCommands() // the DELs of the keys collected
+
+	// Starting where the last run stopped, so the first databases don't hog the time budget.
+	start := time.Now()
+	for range RDB.databases {
+		db := RDB.databases[activeExpireNextDB%len(RDB.databases)]
+		for db.expires.size > 0 {
+			sample := db.expires.sample(activeExpireSampleSize)
+			expired := 0
+			for _, key := range sample {
+				if expireIfNeeded(db, key) {
+					expired++
+				}
+			}
+			if time.Since(start) > activeExpireBudget {
+				return
+			}
+			if expired*100 <= len(sample)*activeExpireStalePct {
+				break
+			}
+		}
+		activeExpireNextDB++
+	}
+}
+
+// EXPIRE key seconds [NX|XX|GT|LT], and PEXPIRE, EXPIREAT, PEXPIREAT. Works on keys of every type.
+func onEXPIRE(commands []string) ([]string, error) {
+	db := currentDB()
+	name, key := commands[0], commands[1]
+
+	when, err := strconv.ParseInt(commands[2], 10, 64)
+	if err != nil {
+		return []string{respEncodeError("ERR value is not an integer or out of range")}, nil
+	}
+
+	// Everything is turned into an absolute unix time in ms.
+	invalidTime := respEncodeError(fmt.Sprintf("ERR invalid expire time in '%s' command", name))
+	if name == "expire" || name == "expireat" {
+		if when > math.MaxInt64/1000 || when < math.MinInt64/1000 {
+			return []string{invalidTime}, nil
+		}
+		when *= 1000
+	}
+	if name == "expire" || name == "pexpire" {
+		now := time.Now().UnixMilli()
+		if when > math.MaxInt64-now {
+			return []string{invalidTime}, nil
+		}
+		when += now
+	}
+
+	nx, xx, gt, lt := false, false, false, false
+	for _, arg := range commands[3:] {
+		switch strings.ToLower(arg) {
+		case "nx":
+			nx = true
+		case "xx":
+			xx = true
+		case "gt":
+			gt = true
+		case "lt":
+			lt = true
+		default:
+			return []string{respEncodeError(fmt.Sprintf("ERR Unsupported option %s", arg))}, nil
+		}
+	}
+	if nx && (xx || gt || lt) {
+		return []string{respEncodeError("ERR NX and XX, GT or LT options at the same time are not compatible")}, nil
+	}
+	if gt && lt {
+		return []string{respEncodeError("ERR GT and LT options at the same time are not compatible")}, nil
+	}
+
+	obj := db.lookupKeyWrite(key)
+	if obj == nil {
+		return []string{respEncodeInteger(0)}, nil
+	}
+
+	// A key without a TTL counts as one that never expires: GT never applies, LT always does.
+	current := obj.expiresAt.UnixMilli()
+	if (nx && obj.expires) || (xx && !obj.expires) ||
+		(gt && (!obj.expires || when <= current)) || (lt && obj.expires && when >= current) {
+		return []string{respEncodeInteger(0)}, nil
+	}
+
+	// A time in the past deletes the key right away. Replicas wait for the master's DEL.
+	if when <= time.Now().UnixMilli() && !CONFIG.isSlave {
+		db.deleteKey(key)
+		signalModifiedKey(db, key)
+		notifyKeyspaceEvent(notifyGeneric, "del", key, db.id)
+		rewriteCommandPropagation("del", key)
+		return []string{respEncodeInteger(1)}, nil
+	}
+
+	// Relative times would mean something else by the time the replicas get to them.
+	db.setExpire(key, time.UnixMilli(when))
+	signalModifiedKey(db, key)
+	rewriteCommandPropagation("pexpireat", key, strconv.FormatInt(when, 10))
+	notifyKeyspaceEvent(notifyGeneric, "expire", key, db.id)
+	return []string{respEncodeInteger(1)}, nil
+}
+
+// TTL key, PTTL key, EXPIRETIME key and PEXPIRETIME key. -2 if the key doesn't exist, -1 if
+// it has no expiry.
+func onTTL(commands []string) ([]string, error) {
+	obj := currentDB().lookupKeyRead(commands[1])
+	if obj == nil {
+		return []string{respEncodeInteger(-2)}, nil
+	}
+	if !obj.expires {
+		return []string{respEncodeInteger(-1)}, nil
+	}
+
+	switch commands[0] {
+	case "ttl": // rounded, like redis does
+		return []string{respEncodeInteger(int((time.Until(obj.expiresAt) + 500*time.Millisecond) / time.Second))}, nil
+	case "pttl":
+		return []string{respEncodeInteger(int(time.Until(obj.expiresAt) / time.Millisecond))}, nil
+	case "expiretime":
+		return []string{respEncodeInteger(int(obj.expiresAt.Unix()))}, nil
+	}
+	return []string{respEncodeInteger(int(obj.expiresAt.UnixMilli()))}, nil
+}
+
+// PERSIST key. Replies 1 if the expiry was removed, 0 if the key doesn't exist or has none.
+func onPERSIST(commands []string) ([]string, error) {
+	db := currentDB()
+	key := commands[1]
+
+	obj := db.lookupKeyWrite(key)
+	if obj == nil || !obj.expires {
+		return []string{respEncodeInteger(0)}, nil
+	}
+
+	db.removeExpire(key)
+	signalModifiedKey(db, key)
+	notifyKeyspaceEvent(notifyGeneric, "persist", key, db.id)
+	return []string{respEncodeInteger(1)}, nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// On a replica, expired keys are gone for everyone but the master link.
+func TestReplicaExpiry(t *testing.T) {
+	RDB = RedisRDB{databases: []*RedisDatabase{newDatabase(0)}}
+	db := RDB.databases[0]
+	obj := newStringObject("v")
+	obj.expires, obj.expiresAt = true, time.Now().Add(-time.Second)
+	db.setKey("k", obj)
+
+	CONFIG.isSlave = true
+	defer func() { CONFIG.isSlave, CONFIG.currentClient = false, nil }()
+
+	CONFIG.currentClient = &RedisClient{}
+	if !expireIfNeeded(db, "k") {
+		t.Errorf("expired key reported as live to a regular client")
+	}
+	CONFIG.currentClient = &RedisClient{isMaster: true}
+	if expireIfNeeded(db, "k") {
+		t.Errorf("expired key reported as expired to the master link")
+	}
+	if _, exists := db.keys["k"]; !exists {
+		t.Errorf("replica deleted an expired key on its own")
+	}
+}
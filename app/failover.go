@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// States of a FAILOVER: no-failover -> waiting-for-sync (writes paused until a replica caught
+// up) -> failover-in-progress (replica of the target, PSYNC FAILOVER on its way) -> no-failover.
+const (
+	failoverNone = iota
+	failoverWaitForSync
+	failoverInProgress
+)
+
+// Names INFO reports the failover states with (master_failover_state).
+var failoverStateNames = map[int]string{
+	failoverNone:        "no-failover",
+	failoverWaitForSync: "waiting-for-sync",
+	failoverInProgress:  "failover-in-progress",
+}
+
+// How often a failover waiting for its replica checks on it (besides every ACK).
+const failoverCheckInterval = 100 * time.Millisecond
+
+// FAILOVER [TO host port [FORCE]] [TIMEOUT ms], and FAILOVER ABORT. Hands the master role over
+// to a replica without losing writes: writes are paused until the replica (the given one, or
+// the first to get there) acknowledged the whole replication stream, then it is told to take
+// over with PSYNC FAILOVER, and this server becomes its replica. Without the replica catching
+// up within the timeout, the failover is aborted, or with FORCE, goes on anyway.
+func onFAILOVER(commands []string) ([]string, error) {
+	host, port, timeout, force, abort := "", "", 0, false, false
+	args := commands[1:]
+	for i := 0; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "to":
+			if i+2 >= len(args) || host != "" {
+				return []string{respEncodeError("ERR syntax error")}, nil
+			}
+			host, port = args[i+1], args[i+2]
+			if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+				return []string{respEncodeError("ERR Invalid port")}, nil
+			}
+			i += 2
+		case "timeout":
+			if i+1 >= len(args) || timeout != 0 {
+				return []string{respEncodeError("ERR syntax error")}, nil
+			}
+			i++
+			n, err := strconv.Atoi(args[i])
+			if err != nil {
+				return []string{respEncodeError("ERR value is not an integer or out of range")}, nil
+			}
+			if n <= 0 {
+				return []string{respEncodeError("ERR FAILOVER timeout must be greater than 0")}, nil
+			}
+			timeout = n
+		case "force":
+			force = true
+		case "abort":
+			abort = true
+		default:
+			return []string{respEncodeError("ERR syntax error")}, nil
+		}
+	}
+
+	if abort {
+		if len(args) > 1 {
+			return []string{respEncodeError("ERR syntax error")}, nil
+		}
+		if CONFIG.failover.state == failoverNone {
+			return []string{respEncodeError("ERR No failover in progress.")}, nil
+		}
+		abortFailover("Failover manually aborted")
+		return []string{respEncodeString("OK")}, nil
+	}
+
+	if CONFIG.isSlave {
+		return []string{respEncodeError("ERR FAILOVER is not valid when server is a replica.")}, nil
+	}
+	if len(CONFIG.replicas) == 0 {
+		return []string{respEncodeError("ERR FAILOVER requires connected replicas.")}, nil
+	}
+	if force && (host == "" || timeout == 0) {
+		return []string{respEncodeError("ERR FAILOVER with force option requires both a timeout and target HOST and IP.")}, nil
+	}
+	if CONFIG.failover.state != failoverNone {
+		return []string{respEncodeError("ERR FAILOVER already in progress.")}, nil
+	}
+	if host != "" {
+		replica := _failoverReplica(host, port)
+		if replica == nil {
+			return []string{respEncodeError("ERR FAILOVER target HOST and PORT is not a replica.")}, nil
+		}
+		if replica.state != replicaOnline {
+			return []string{respEncodeError("ERR FAILOVER target replica is not online.")}, nil
+		}
+	}
+
+	CONFIG.failover = Failover{
+		state:    failoverWaitForSync,
+		host:     host,
+		port:     port,
+		force:    force,
+		offset:   CONFIG.masterReplOffset, // no more writes from here, see waitWhilePaused
+		unpaused: make(chan struct{}),
+	}
+	if timeout > 0 {
+		CONFIG.failover.deadline = time.Now().Add(time.Duration(timeout) * time.Millisecond)
+	}
+	fmt.Println("FAILOVER requested to", _failoverTargetName(host, port))
+
+	// Asking the replicas where they are right away, instead of waiting for their next ACK.
+	propagateCommands([]byte(respEncodeStringArray([]string{"REPLCONF", "GETACK", "*"})))
+	go _waitForFailoverSync()
+	return []string{respEncodeString("OK")}, nil
+}
+
+// Waits for the replica to acknowledge everything up to where the writes got paused, then
+// hands over to it. Gives up on the timeout (or goes on with FORCE), or once the failover
+// is aborted.
+func _waitForFailoverSync() {
+	acks := make(chan struct{}, 1)
+	executionLock.Lock()
+	defer executionLock.Unlock()
+	ackWaiters[acks] = struct{}{}
+	defer delete(ackWaiters, acks)
+
+	for CONFIG.failover.state == failoverWaitForSync {
+		failover := &CONFIG.failover
+		for _, replica := range CONFIG.replicas {
+			ip, listeningPort := replica.address()
+			if failover.host != "" && replica != _failoverReplica(failover.host, failover.port) {
+				continue
+			}
+			if replica.state == replicaOnline && replica.ackOffset >= failover.offset {
+				_failoverToReplica(ip, strconv.Itoa(listeningPort))
+				return
+			}
+		}
+
+		if !failover.deadline.IsZero() && time.Now().After(failover.deadline) {
+			if failover.force {
+				fmt.Println("FAILOVER target replica didn't catch up in time, forcing the failover")
+				_failoverToReplica(failover.host, failover.port)
+			} else {
+				abortFailover("Replica never caught up before timeout")
+			}
+			return
+		}
+
+		executionLock.Unlock()
+		select {
+		case <-acks:
+		case <-time.After(failoverCheckInterval):
+		}
+		executionLock.Lock()
+	}
+}
+
+// Becomes a replica of the failover target. The PSYNC of the handshake tells the target to take
+// over (see onPSYNC), writes stay paused until it replied.
+func _failoverToReplica(host, port string) {
+	CONFIG.failover.state = failoverInProgress
+	CONFIG.failover.host, CONFIG.failover.port = host, port
+	fmt.Println("Failover target", _failoverTargetName(host, port), "caught up, handing over the master role")
+	replicationSetMaster(host, port)
+}
+
+// The handshake with the failover target went through: it's our master now.
+func endFailover() {
+	fmt.Println("Failover to", _failoverTargetName(CONFIG.failover.host, CONFIG.failover.port), "completed")
+	close(CONFIG.failover.unpaused)
+	CONFIG.failover = Failover{}
+}
+
+// Gives up on the failover and lets the paused writes through. If this server already became a
+// replica of the target, it goes back to being a master.
+func abortFailover(reason string) {
+	fmt.Println("FAILOVER aborted:", reason)
+	if CONFIG.failover.state == failoverInProgress {
+		replicationUnsetMaster()
+	}
+	close(CONFIG.failover.unpaused)
+	CONFIG.failover = Failover{}
+}
+
+// The replica listening on host and port, nil if there is none.
+func _failoverReplica(host, port string) *Replica {
+	for _, replica := range CONFIG.replicas {
+		ip, listeningPort := replica.address()
+		if ip == host && strconv.Itoa(listeningPort) == port {
+			return replica
+		}
+	}
+	return nil
+}
+
+func _failoverTargetName(host, port string) string {
+	if host == "" {
+		return "any replica"
+	}
+	return host + ":" + port
+}
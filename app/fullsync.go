@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// States of a replica connected to us, as far as its full resync goes.
+const (
+	replicaWaitBgsave = iota // waiting for the next snapshot to start
+	replicaSendBulk          // getting the snapshot. The stream that follows it is buffered meanwhile
+	replicaWaitAck           // got a diskless snapshot, its stream starts once it acks (nothing can follow the EOF mark)
+	replicaOnline            // getting the replication stream
+)
+
+// Names INFO reports the replica states with.
+var replicaStateNames = map[int]string{
+	replicaWaitBgsave: "wait_bgsave",
+	replicaSendBulk:   "send_bulk",
+	replicaWaitAck:    "send_bulk",
+	replicaOnline:     "online",
+}
+
+// Length of the mark around a diskless rdb transfer ($EOF:<mark>, then the mark again at the end).
+const rdbEOFMarkLength = 40
+
+// Sends the replica a piece of the replication stream, or keeps it for later while the
+// replica is still getting its snapshot. Nothing from before the snapshot is kept, the
+// snapshot has it already.
+func (replica *Replica) send(data []byte) error {
+	switch replica.state {
+	case replicaWaitBgsave:
+		return nil
+	case replicaSendBulk, replicaWaitAck:
+		if len(replica.pending)+len(data) > replicaOutputBufferLimit {
+			fmt.Println("Replica", replica.conn.RemoteAddr(), "closed for overcoming of output buffer limits during its sync")
+			replica.conn.Close()
+			return nil
+		}
+		replica.pending = append(replica.pending, data...)
+		return nil
+	}
+	replica.output.queue(data)
+	return nil
+}
+
+// Puts the replica on the replication stream, starting with what it missed during its snapshot.
+func (replica *Replica) putOnline() {
+	replica.state = replicaOnline
+	replica.ackTime = time.Now() // the lag counts from here, it couldn't ack during the transfer
+	replica.output.queue(replica.pending)
+	replica.pending = nil
+}
+
+// Replica waiting for a full resync. It gets the next snapshot taken: right away, or after
+// repl-diskless-sync-delay with diskless sync, so the replicas that show up meanwhile share it.
+// One snapshot is sent at a time, replicas coming during one get the next.
+func scheduleFullResync() {
+	if CONFIG.fullSyncInProgress || CONFIG.fullSyncScheduled {
+		return
+	}
+	delay := time.Duration(0)
+	if CONFIG.replDisklessSync {
+		delay = time.Duration(CONFIG.replDisklessSyncDelay) * time.Second
+	}
+
+	CONFIG.fullSyncScheduled = true
+	time.AfterFunc(delay, func() {
+		executionLock.Lock()
+		defer executionLock.Unlock()
+		CONFIG.fullSyncScheduled = false
+		startFullResync()
+	})
+}
+
+// Takes the snapshot for every replica waiting for one, and replies +FULLRESYNC to them with
+// the offset it was taken at: whatever is propagated from now on follows the snapshot. The
+// snapshot is encoded in full right here, under the execution lock: without a fork() to get a
+// copy-on-write view of the dataset, that's the only way it matches the offset. Every command
+// waits for it meanwhile. Only the transfer happens in the background. Called under the lock.
+func startFullResync() {
+	waiting := []*Replica{}
+	for _, replica := range CONFIG.replicas {
+		if replica.state == replicaWaitBgsave {
+			waiting = append(waiting, replica)
+		}
+	}
+	if len(waiting) == 0 {
+		return
+	}
+
+	// The new replicas start out on database 0 (or the one in the snapshot, for sub-replicas),
+	// the ones already connected might not be.
+	if CONFIG.replicationDB != 0 {
+		CONFIG.replicationDB = -1
+	}
+	for _, replica := range waiting {
+		replica.output.queue([]byte(respEncodeString(fmt.Sprintf("FULLRESYNC %s %d", CONFIG.masterReplID, CONFIG.masterReplOffset))))
+		replica.state = replicaSendBulk
+	}
+
+	// The transfer is shared, it's diskless only if every one of them can load that.
+	diskless := CONFIG.replDisklessSync
+	for _, replica := range waiting {
+		diskless = diskless && replica.capaEOF
+	}
+
+	CONFIG.fullSyncInProgress = true
+	go _transferRDB(waiting, encodeRDBChunks(RDB), diskless, CONFIG.rdbKeySaveDelay)
+}
+
+// Sends the snapshot, already encoded, over to the replicas, then puts them online. Nothing
+// touches the disk either way; diskless sync only changes the framing: the rdb goes between
+// $EOF:<mark> and the mark instead of after $<length> (without the trailing \r\n). keySaveDelay
+// is the rdb-key-save-delay, in microseconds per key: it paces the sending of the keys, for
+// testing slow transfers, the snapshot itself is taken before.
+func _transferRDB(replicas []*Replica, chunks [][]byte, diskless bool, keySaveDelay int) {
+	failed := make(map[*Replica]bool)
+	write := func(data []byte) {
+		for _, replica := range replicas {
+			if !failed[replica] {
+				if err := replica.output.write(data); err != nil { // after the +FULLRESYNC queued before
+					failed[replica] = true
+				}
+			}
+		}
+	}
+	writeChunks := func() {
+		for i, chunk := range chunks {
+			if keySaveDelay > 0 && i > 0 && i < len(chunks)-1 { // a key
+				time.Sleep(time.Duration(keySaveDelay) * time.Microsecond)
+			}
+			write(chunk)
+		}
+	}
+
+	if diskless {
+		mark := generateReplicationID()[:rdbEOFMarkLength]
+		write([]byte("$EOF:" + mark + "\r\n"))
+		writeChunks()
+		write([]byte(mark))
+	} else {
+		length := 0
+		for _, chunk := range chunks {
+			length += len(chunk)
+		}
+		write([]byte(fmt.Sprintf("$%d\r\n", length)))
+		writeChunks()
+	}
+
+	executionLock.Lock()
+	defer executionLock.Unlock()
+	for _, replica := range replicas {
+		switch {
+		case failed[replica]:
+			replica.conn.Close()
+		case diskless:
+			replica.state = replicaWaitAck
+		default:
+			replica.putOnline()
+		}
+	}
+	CONFIG.fullSyncInProgress = false
+	scheduleFullResync() // for the replicas that came during this one
+}
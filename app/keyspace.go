@@ -0,0 +1,223 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Values made of more elements than this are freed in the background by UNLINK.
+const lazyfreeThreshold = 64
+
+// Integers below this are shared objects in redis, OBJECT REFCOUNT reports them as such.
+const sharedIntegers = 10000
+
+// Every maxmemory-policy redis knows about.
+var maxmemoryPolicies = []string{
+	"volatile-lru", "volatile-lfu", "volatile-random", "volatile-ttl",
+	"allkeys-lru", "allkeys-lfu", "allkeys-random", "noeviction",
+}
+
+func validMaxmemoryPolicy(policy string) bool {
+	for _, valid := range maxmemoryPolicies {
+		if strings.EqualFold(policy, valid) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the maxmemory-policy tracks access frequency (LFU) instead of recency (LRU).
+func lfuPolicySelected() bool {
+	return strings.HasSuffix(CONFIG.maxmemoryPolicy, "-lfu")
+}
+
+// DEL key [key ...] and UNLINK key [key ...]. Replies with the number of keys removed.
+func onDEL(commands []string) ([]string, error) {
+	db := currentDB()
+	lazy := commands[0] == "unlink"
+
+	deleted := 0
+	for _, key := range commands[1:] {
+		obj := db.lookupKeyWrite(key)
+		if obj == nil {
+			continue
+		}
+		db.deleteKey(key)
+		if lazy {
+			freeObjectAsync(obj)
+		}
+		signalModifiedKey(db, key)
+		notifyKeyspaceEvent(notifyGeneric, "del", key, db.id)
+		deleted++
+	}
+	return []string{respEncodeInteger(deleted)}, nil
+}
+
+// Number of allocations it takes to free the value, roughly.
+func freeEffort(obj *RedisObject) int {
+	switch value := obj.value.(type) {
+	case *RedisList:
+		return len(value.elements)
+	case RedisSet:
+		return len(value)
+	case RedisHash:
+		return len(value)
+	case *RedisSortedSet:
+		return len(value.scores)
+	case *RedisStream:
+		return len(value.entries)
+	}
+	return 1
+}
+
+// Takes apart a value that is no longer in the keyspace off the execution path, so UNLINKing
+// a big key doesn't hold up everyone else. Small values are left to the garbage collector.
+func freeObjectAsync(obj *RedisObject) {
+	if freeEffort(obj) <= lazyfreeThreshold {
+		return
+	}
+	go func(value interface{}) {
+		switch value := value.(type) {
+		case *RedisList:
+			clear(value.elements)
+		case RedisSet:
+			clear(value)
+		case RedisHash:
+			clear(value)
+		case *RedisSortedSet:
+			clear(value.scores)
+		case *RedisStream:
+			clear(value.entries)
+		}
+	}(obj.value)
+}
+
+// EXISTS key [key ...]. A key given more than once is counted every time.
+func onEXISTS(commands []string) ([]string, error) {
+	db := currentDB()
+	count := 0
+	for _, key := range commands[1:] {
+		if db.lookupKeyRead(key) != nil {
+			count++
+		}
+	}
+	return []string{respEncodeInteger(count)}, nil
+}
+
+// TOUCH key [key ...]. Updates the access time of the keys, replies with how many exist.
+func onTOUCH(commands []string) ([]string, error) {
+	return onEXISTS(commands)
+}
+
+// RENAME key newkey and RENAMENX key newkey. The value keeps its TTL under the new name.
+func onRENAME(commands []string) ([]string, error) {
+	db := currentDB()
+	key, newKey := commands[1], commands[2]
+	nx := commands[0] == "renamenx"
+
+	obj := db.lookupKeyWrite(key)
+	if obj == nil {
+		return []string{respEncodeError("ERR no such key")}, nil
+	}
+
+	if key == newKey {
+		if nx {
+			return []string{respEncodeInteger(0)}, nil
+		}
+		return []string{respEncodeString("OK")}, nil
+	}
+
+	if db.lookupKeyWrite(newKey) != nil {
+		if nx {
+			return []string{respEncodeInteger(0)}, nil
+		}
+		db.deleteKey(newKey)
+		notifyKeyspaceEvent(notifyGeneric, "del", newKey, db.id) // the value it held is gone
+	}
+
+	db.deleteKey(key)
+	db.setKey(newKey, obj)
+	signalModifiedKey(db, key)
+	signalModifiedKey(db, newKey)
+	notifyKeyspaceEvent(notifyGeneric, "rename_from", key, db.id)
+	notifyKeyspaceEvent(notifyGeneric, "rename_to", newKey, db.id)
+
+	if nx {
+		return []string{respEncodeInteger(1)}, nil
+	}
+	return []string{respEncodeString("OK")}, nil
+}
+
+// RANDOMKEY. Replies with nil when the database is empty.
+func onRANDOMKEY(_ []string) ([]string, error) {
+	db := currentDB()
+
+	// Expired keys get deleted as they are picked. Replicas can't delete them, so if every key
+	// is expired they just give up after a while and reply with one of them anyway.
+	for tries := 0; db.scanIndex.size > 0; tries++ {
+		key := db.scanIndex.random()
+		if !db.keys[key].isExpired() || (CONFIG.isSlave && tries >= 100) {
+			return []string{respEncodeBulkString(key)}, nil
+		}
+		expireIfNeeded(db, key)
+	}
+	return []string{"$-1\r\n"}, nil
+}
+
+// OBJECT ENCODING|FREQ|IDLETIME|REFCOUNT key, and OBJECT HELP. Looking at the key doesn't
+// count as an access.
+func onOBJECT(commands []string) ([]string, error) {
+	subcommand := strings.ToLower(commands[1])
+	if subcommand == "help" {
+		return []string{respEncodeStringArray([]string{
+			"OBJECT <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+			"ENCODING <key>",
+			"    Return the kind of internal representation used in order to store the value",
+			"    associated with a <key>.",
+			"FREQ <key>",
+			"    Return the access frequency index of the <key>. The returned integer is",
+			"    proportional to the logarithm of the recent access frequency of the key.",
+			"IDLETIME <key>",
+			"    Return the idle time of the <key>, that is the approximated number of",
+			"    seconds elapsed since the last access to the key.",
+			"REFCOUNT <key>",
+			"    Return the number of references of the value associated with the specified",
+			"    <key>.",
+			"HELP",
+			"    Print this help.",
+		})}, nil
+	}
+
+	obj := currentDB().lookupKey(commands[2])
+	if obj == nil {
+		return []string{"$-1\r\n"}, nil
+	}
+
+	switch subcommand {
+	case "encoding":
+		return []string{respEncodeBulkString(obj.encoding)}, nil
+
+	case "freq":
+		if !lfuPolicySelected() {
+			return []string{respEncodeError("ERR An LFU maxmemory policy is not selected, access frequency not tracked. Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust.")}, nil
+		}
+		return []string{respEncodeInteger(int(obj.lfuDecayedCounter()))}, nil
+
+	case "idletime":
+		if lfuPolicySelected() {
+			return []string{respEncodeError("ERR An LRU maxmemory policy is not selected, access time not tracked. Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust.")}, nil
+		}
+		return []string{respEncodeInteger(int(time.Since(obj.lru) / time.Second))}, nil
+
+	case "refcount":
+		if obj.encoding == "int" {
+			if n, _ := strconv.ParseInt(obj.value.(string), 10, 64); n >= 0 && n < sharedIntegers {
+				return []string{respEncodeInteger(math.MaxInt32)}, nil
+			}
+		}
+		return []string{respEncodeInteger(1)}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+)
+
+// Listpacks are the compact format redis keeps small values (and stream nodes) in, and rdb files
+// store them as they are in memory, inside a string: a header (total bytes as a 32 bit int, number
+// of elements as a 16 bit int), the elements, and a 0xFF terminator. Each element is its encoding
+// byte(s), its data, then the size of both as a "backlen" for iterating backwards.
+const listpackEnd byte = 0xFF
+
+var errListpackCorrupt = fmt.Errorf("corrupt listpack")
+
+// Decodes every element of the listpack. Integers come back in their string form.
+func decodeListpack(lp []byte) ([]string, error) {
+	if len(lp) < 7 || int(binary.LittleEndian.Uint32(lp)) != len(lp) {
+		return nil, errListpackCorrupt
+	}
+
+	elements := make([]string, 0, binary.LittleEndian.Uint16(lp[4:]))
+	for index := 6; ; {
+		if index >= len(lp) {
+			return nil, errListpackCorrupt
+		}
+		if lp[index] == listpackEnd {
+			return elements, nil
+		}
+
+		b := lp[index]
+		var element string
+		size, strHeader := 0, 0 // size of the encoding and data (the backlen follows), header size of strings
+		switch {
+		case b&0x80 == 0: // 7 bit unsigned int
+			element, size = strconv.Itoa(int(b)), 1
+		case b&0xC0 == 0x80: // string up to 63 bytes
+			strHeader, size = 1, 1+int(b&0x3F)
+		case b&0xE0 == 0xC0: // 13 bit signed int
+			if index+2 > len(lp) {
+				return nil, errListpackCorrupt
+			}
+			v := int(b&0x1F)<<8 | int(lp[index+1])
+			if v >= 1<<12 {
+				v -= 1 << 13
+			}
+			element, size = strconv.Itoa(v), 2
+		case b&0xF0 == 0xE0: // string up to 4095 bytes
+			if index+2 > len(lp) {
+				return nil, errListpackCorrupt
+			}
+			strHeader, size = 2, 2+(int(b&0x0F)<<8|int(lp[index+1]))
+		case b == 0xF0: // string with a 32 bit length
+			if index+5 > len(lp) {
+				return nil, errListpackCorrupt
+			}
+			strHeader, size = 5, 5+int(binary.LittleEndian.Uint32(lp[index+1:]))
+		case b >= 0xF1 && b <= 0xF4: // 16, 24, 32 and 64 bit signed ints
+			width := map[byte]int{0xF1: 2, 0xF2: 3, 0xF3: 4, 0xF4: 8}[b]
+			if index+1+width > len(lp) {
+				return nil, errListpackCorrupt
+			}
+			element, size = strconv.FormatInt(_decodeLittleEndianInt(lp[index+1:index+1+width]), 10), 1+width
+		default:
+			return nil, fmt.Errorf("corrupt listpack: unknown encoding 0x%x", b)
+		}
+
+		if index+size > len(lp) {
+			return nil, errListpackCorrupt
+		}
+		if strHeader > 0 {
+			element = string(lp[index+strHeader : index+size])
+		}
+		elements = append(elements, element)
+		index += size + _listpackBacklenSize(size)
+	}
+}
+
+// Decodes every element of a ziplist, what listpacks replaced (lists, hashes and sorted sets of
+// redis < 7). A header (total bytes, offset of the last entry, number of entries), then entries
+// made of the length of the previous entry (for going backwards), an encoding, and the data.
+func decodeZiplist(zl []byte) ([]string, error) {
+	if len(zl) < 11 || int(binary.LittleEndian.Uint32(zl)) != len(zl) {
+		return nil, errListpackCorrupt
+	}
+
+	elements := make([]string, 0, binary.LittleEndian.Uint16(zl[8:]))
+	for index := 10; ; {
+		if index >= len(zl) {
+			return nil, errListpackCorrupt
+		}
+		if zl[index] == listpackEnd {
+			return elements, nil
+		}
+		if zl[index] == 0xFE { // previous entry length: a byte, or 0xFE and a 32 bit int
+			index += 5
+		} else {
+			index++
+		}
+		if index >= len(zl) {
+			return nil, errListpackCorrupt
+		}
+
+		b := zl[index]
+		header, length, isInt := 1, 0, true
+		switch {
+		case b>>6 == 0: // string up to 63 bytes
+			length, isInt = int(b&0x3F), false
+		case b>>6 == 1: // string up to 16383 bytes
+			if index+2 > len(zl) {
+				return nil, errListpackCorrupt
+			}
+			header, length, isInt = 2, int(b&0x3F)<<8|int(zl[index+1]), false
+		case b>>6 == 2: // string with a 32 bit (big endian) length
+			if index+5 > len(zl) {
+				return nil, errListpackCorrupt
+			}
+			header, length, isInt = 5, int(binary.BigEndian.Uint32(zl[index+1:])), false
+		case b == 0xC0:
+			length = 2
+		case b == 0xD0:
+			length = 4
+		case b == 0xE0:
+			length = 8
+		case b == 0xF0:
+			length = 3
+		case b == 0xFE:
+			length = 1
+		case b >= 0xF1 && b <= 0xFD: // 0 to 12, in the encoding itself
+		default:
+			return nil, fmt.Errorf("corrupt ziplist: unknown encoding 0x%x", b)
+		}
+
+		if length < 0 || index+header+length > len(zl) {
+			return nil, errListpackCorrupt
+		}
+		data := zl[index+header : index+header+length]
+		switch {
+		case !isInt:
+			elements = append(elements, string(data))
+		case length == 0:
+			elements = append(elements, strconv.Itoa(int(b&0x0F)-1))
+		default:
+			elements = append(elements, strconv.FormatInt(_decodeLittleEndianInt(data), 10))
+		}
+		index += header + length
+	}
+}
+
+// Decodes the members of an intset (small sets of integers): the width of the integers (2, 4
+// or 8 bytes), their number, then the sorted integers.
+func decodeIntset(is []byte) ([]string, error) {
+	if len(is) < 8 {
+		return nil, errListpackCorrupt
+	}
+	width, length := int(binary.LittleEndian.Uint32(is)), int(binary.LittleEndian.Uint32(is[4:]))
+	if (width != 2 && width != 4 && width != 8) || len(is) != 8+width*length {
+		return nil, fmt.Errorf("corrupt intset")
+	}
+
+	members := make([]string, 0, length)
+	for i := 8; i < len(is); i += width {
+		members = append(members, strconv.FormatInt(_decodeLittleEndianInt(is[i:i+width]), 10))
+	}
+	return members, nil
+}
+
+// Size of the backlen of an element whose encoding and data take size bytes: 7 bits per byte.
+func _listpackBacklenSize(size int) int {
+	switch {
+	case size <= 127:
+		return 1
+	case size < 16383:
+		return 2
+	case size < 2097151:
+		return 3
+	case size < 268435455:
+		return 4
+	}
+	return 5
+}
+
+// Decodes a little endian signed int of 1 to 8 bytes.
+func _decodeLittleEndianInt(data []byte) int64 {
+	var v uint64
+	for i := len(data) - 1; i >= 0; i-- {
+		v = v<<8 | uint64(data[i])
+	}
+	shift := 64 - 8*len(data) // sign extension
+	return int64(v<<shift) >> shift
+}
+
+func newListpackWriter() *ListpackWriter {
+	return &ListpackWriter{data: make([]byte, 6, 64)} // room for the header, written by bytes()
+}
+
+func (lp *ListpackWriter) appendString(str string) {
+	start := len(lp.data)
+	switch {
+	case len(str) < 64:
+		lp.data = append(lp.data, 0x80|byte(len(str)))
+	case len(str) < 4096:
+		lp.data = append(lp.data, 0xE0|byte(len(str)>>8), byte(len(str)))
+	default:
+		lp.data = append(lp.data, 0xF0)
+		lp.data = binary.LittleEndian.AppendUint32(lp.data, uint32(len(str)))
+	}
+	lp.data = append(lp.data, str...)
+	lp._appendBacklen(len(lp.data) - start)
+}
+
+func (lp *ListpackWriter) appendInt(v int64) {
+	start := len(lp.data)
+	switch {
+	case v >= 0 && v <= 127:
+		lp.data = append(lp.data, byte(v))
+	case v >= -4096 && v <= 4095:
+		u := uint16(v) & 0x1FFF
+		lp.data = append(lp.data, 0xC0|byte(u>>8), byte(u))
+	default:
+		lp.data = append(lp.data, 0xF4)
+		lp.data = binary.LittleEndian.AppendUint64(lp.data, uint64(v))
+	}
+	lp._appendBacklen(len(lp.data) - start)
+}
+
+// The backlen is written so that it can be read from its last byte backwards: the most
+// significant 7 bits first, every byte but the first one has its high bit set.
+func (lp *ListpackWriter) _appendBacklen(size int) {
+	n := _listpackBacklenSize(size)
+	for i := n - 1; i >= 0; i-- {
+		b := byte(size>>(7*i)) & 0x7F
+		if i != n-1 {
+			b |= 0x80
+		}
+		lp.data = append(lp.data, b)
+	}
+	lp.count++
+}
+
+// The finished listpack, header and terminator included.
+func (lp *ListpackWriter) bytes() []byte {
+	data := append(lp.data, listpackEnd)
+	binary.LittleEndian.PutUint32(data, uint32(len(data)))
+	binary.LittleEndian.PutUint16(data[4:], uint16(min(lp.count, 0xFFFF))) // 0xFFFF: too many to count
+	return data
+}
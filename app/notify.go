@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Classes of keyspace events, set with notify-keyspace-events. Every event belongs to one
+// class, and is only published if its class (and K and/or E) is enabled.
+const (
+	notifyKeyspace = 1 << iota // K: __keyspace@<db>__:<key> channel, the event is the message
+	notifyKeyevent             // E: __keyevent@<db>__:<event> channel, the key is the message
+	notifyGeneric              // g: generic commands (del, expire, rename...)
+	notifyString               // $: string commands
+	notifyList                 // l: list commands
+	notifySet                  // s: set commands
+	notifyHash                 // h: hash commands
+	notifyZSet                 // z: sorted set commands
+	notifyExpired              // x: key expired
+	notifyEvicted              // e: key evicted
+	notifyStream               // t: stream commands
+	notifyKeyMiss              // m: key misses (not part of A)
+	notifyModule               // d: module key types
+	notifyNew                  // n: new keys (not part of A)
+
+	// A: alias for "g$lshzxetd"
+	notifyAll = notifyGeneric | notifyString | notifyList | notifySet | notifyHash | notifyZSet |
+		notifyExpired | notifyEvicted | notifyStream | notifyModule
+)
+
+// The flag character of every event class, in the order they are listed back.
+var notifyClassFlags = []struct {
+	flag  byte
+	class int
+}{
+	{'g', notifyGeneric}, {'$', notifyString}, {'l', notifyList}, {'s', notifySet},
+	{'h', notifyHash}, {'z', notifyZSet}, {'x', notifyExpired}, {'e', notifyEvicted},
+	{'t', notifyStream}, {'d', notifyModule},
+}
+
+// Parses the notify-keyspace-events flags. An empty string disables notifications.
+func parseKeyspaceEvents(flags string) (int, error) {
+	classes := 0
+	for i := 0; i < len(flags); i++ {
+		switch flags[i] {
+		case 'A':
+			classes |= notifyAll
+		case 'K':
+			classes |= notifyKeyspace
+		case 'E':
+			classes |= notifyKeyevent
+		case 'm':
+			classes |= notifyKeyMiss
+		case 'n':
+			classes |= notifyNew
+		default:
+			found := false
+			for _, classFlag := range notifyClassFlags {
+				if classFlag.flag == flags[i] {
+					classes |= classFlag.class
+					found = true
+				}
+			}
+			if !found {
+				return 0, fmt.Errorf("Invalid event class character. Use 'Ag$lshzxeKEtmdn'.")
+			}
+		}
+	}
+	return classes, nil
+}
+
+// Formats the event classes back into notify-keyspace-events flags.
+func keyspaceEventsString(classes int) string {
+	var flags strings.Builder
+	if classes&notifyAll == notifyAll {
+		flags.WriteByte('A')
+	} else {
+		for _, classFlag := range notifyClassFlags {
+			if classes&classFlag.class != 0 {
+				flags.WriteByte(classFlag.flag)
+			}
+		}
+	}
+	if classes&notifyKeyspace != 0 {
+		flags.WriteByte('K')
+	}
+	if classes&notifyKeyevent != 0 {
+		flags.WriteByte('E')
+	}
+	if classes&notifyKeyMiss != 0 {
+		flags.WriteByte('m')
+	}
+	if classes&notifyNew != 0 {
+		flags.WriteByte('n')
+	}
+	return flags.String()
+}
+
+// Publishes a keyspace event for the key over pub/sub, if notify-keyspace-events enables
+// its class.
+func notifyKeyspaceEvent(class int, event string, key string, db int) {
+	classes := CONFIG.notifyKeyspaceEvents
+	if classes&class == 0 {
+		return
+	}
+
+	if classes&notifyKeyspace != 0 {
+		publishMessage(fmt.Sprintf("__keyspace@%d__:%s", db, key), event)
+	}
+	if classes&notifyKeyevent != 0 {
+		publishMessage(fmt.Sprintf("__keyevent@%d__:%s", db, event), key)
+	}
+}
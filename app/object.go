@@ -0,0 +1,290 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Types a value in the keyspace can have. These are what TYPE replies with.
+const (
+	objString = "string"
+	objList   = "list"
+	objSet    = "set"
+	objZSet   = "zset"
+	objHash   = "hash"
+	objStream = "stream"
+)
+
+// Reply for commands run against a key holding a value of another type.
+const wrongTypeError = "WRONGTYPE Operation against a key holding the wrong kind of value"
+
+// Sizes up to which the aggregate types keep their compact encoding (the *-max-listpack-entries
+// and *-max-listpack-value defaults of redis). Past those, they switch to the big encoding for good.
+const (
+	listpackMaxEntries = 128
+	listpackMaxValue   = 64
+	intsetMaxEntries   = 512
+	embstrMaxLength    = 44 // strings longer than this are "raw"
+)
+
+// LFU counter defaults (lfu-log-factor, lfu-decay-time). New keys start at lfuInitVal so
+// they don't look colder than the keys that were never accessed since.
+const (
+	lfuInitVal   = 5
+	lfuLogFactor = 10
+	lfuDecayTime = time.Minute
+)
+
+// Creates a new object of the given type, with fresh access metadata.
+func newObject(objType string, value interface{}) *RedisObject {
+	now := time.Now()
+	obj := &RedisObject{
+		objType:     objType,
+		value:       value,
+		lru:         now,
+		lfuCounter:  lfuInitVal,
+		lfuDecrTime: now,
+	}
+	obj.updateEncoding()
+	return obj
+}
+
+func newStringObject(value string) *RedisObject {
+	return newObject(objString, value)
+}
+
+// Has to be called after every write to the value. Strings get their encoding from the
+// current value, the other types only ever move to the bigger encoding, like redis does.
+func (obj *RedisObject) updateEncoding() {
+	switch obj.objType {
+	case objString:
+		value := obj.value.(string)
+		if n, err := strconv.ParseInt(value, 10, 64); err == nil && strconv.FormatInt(n, 10) == value {
+			obj.encoding = "int"
+		} else if len(value) <= embstrMaxLength {
+			obj.encoding = "embstr"
+		} else {
+			obj.encoding = "raw"
+		}
+
+	case objList:
+		if obj.encoding != "quicklist" && !_fitsListpack(obj.value.(*RedisList).elements) {
+			obj.encoding = "quicklist"
+		} else if obj.encoding == "" {
+			obj.encoding = "listpack"
+		}
+
+	case objSet:
+		set := obj.value.(RedisSet)
+		if obj.encoding == "hashtable" {
+			break
+		}
+		members := make([]string, 0, len(set))
+		allInts := true
+		for member := range set {
+			members = append(members, member)
+			if _, err := strconv.ParseInt(member, 10, 64); err != nil {
+				allInts = false
+			}
+		}
+		switch {
+		case obj.encoding != "listpack" && allInts && len(set) <= intsetMaxEntries:
+			obj.encoding = "intset"
+		case _fitsListpack(members):
+			obj.encoding = "listpack"
+		default:
+			obj.encoding = "hashtable"
+		}
+
+	case objZSet:
+		zset := obj.value.(*RedisSortedSet)
+		members := make([]string, 0, len(zset.scores))
+		for member := range zset.scores {
+			members = append(members, member)
+		}
+		if obj.encoding != "skiplist" && !_fitsListpack(members) {
+			obj.encoding = "skiplist"
+		} else if obj.encoding == "" {
+			obj.encoding = "listpack"
+		}
+
+	case objHash:
+		hash := obj.value.(RedisHash)
+		values := make([]string, 0, len(hash)*2)
+		for field, value := range hash {
+			values = append(values, field, value)
+		}
+		if obj.encoding != "hashtable" && (len(hash) > listpackMaxEntries || !_fitsListpack(values)) {
+			obj.encoding = "hashtable"
+		} else if obj.encoding == "" {
+			obj.encoding = "listpack"
+		}
+
+	case objStream:
+		obj.encoding = "stream"
+	}
+	obj._buildMemberIndex()
+}
+
+// Values in a big encoding keep their members in a ScanIndex, so HSCAN/SSCAN/ZSCAN don't go
+// over all of them on every call. It's built once, when the value switches to the big
+// encoding (it never switches back). No command adds or removes members of an existing value
+// yet, one that does has to update the index along with the value.
+func (obj *RedisObject) _buildMemberIndex() {
+	if obj.members != nil || (obj.encoding != "hashtable" && obj.encoding != "skiplist") {
+		return
+	}
+	obj.members = newScanIndex(obj.memberNames())
+}
+
+// Members of a set or sorted set, fields of a hash. In no particular order.
+func (obj *RedisObject) memberNames() []string {
+	var members []string
+	switch value := obj.value.(type) {
+	case RedisSet:
+		for member := range value {
+			members = append(members, member)
+		}
+	case RedisHash:
+		for field := range value {
+			members = append(members, field)
+		}
+	case *RedisSortedSet:
+		for member := range value.scores {
+			members = append(members, member)
+		}
+	}
+	return members
+}
+
+// Returns true if the values are few and small enough for a listpack.
+func _fitsListpack(values []string) bool {
+	if len(values) > listpackMaxEntries {
+		return false
+	}
+	for _, value := range values {
+		if len(value) > listpackMaxValue {
+			return false
+		}
+	}
+	return true
+}
+
+// Records an access to the object, for OBJECT IDLETIME and OBJECT FREQ.
+func (obj *RedisObject) touch() {
+	now := time.Now()
+	obj.lru = now
+	obj.lfuCounter = obj.lfuDecayedCounter()
+	obj.lfuDecrTime = now
+	obj.lfuCounter = lfuLogIncr(obj.lfuCounter)
+}
+
+// The LFU counter, after taking off one for every lfuDecayTime elapsed since the last decay.
+func (obj *RedisObject) lfuDecayedCounter() uint8 {
+	periods := int(time.Since(obj.lfuDecrTime) / lfuDecayTime)
+	if periods >= int(obj.lfuCounter) {
+		return 0
+	}
+	return obj.lfuCounter - uint8(periods)
+}
+
+// Increments the counter logarithmically: the higher it is, the less likely an access bumps it.
+func lfuLogIncr(counter uint8) uint8 {
+	if counter == math.MaxUint8 {
+		return counter
+	}
+	base := float64(counter) - lfuInitVal
+	if base < 0 {
+		base = 0
+	}
+	if rand.Float64() < 1.0/(base*lfuLogFactor+1) {
+		counter++
+	}
+	return counter
+}
+
+// Returns a deep copy of the object, expiry included. The copy gets fresh access metadata.
+func (obj *RedisObject) duplicate() *RedisObject {
+	var value interface{}
+	switch v := obj.value.(type) {
+	case string:
+		value = v
+	case *RedisList:
+		value = &RedisList{elements: append([]string{}, v.elements...)}
+	case RedisSet:
+		set := make(RedisSet, len(v))
+		for member := range v {
+			set[member] = struct{}{}
+		}
+		value = set
+	case *RedisSortedSet:
+		zset := &RedisSortedSet{scores: make(map[string]float64, len(v.scores))}
+		for member, score := range v.scores {
+			zset.scores[member] = score
+		}
+		value = zset
+	case RedisHash:
+		hash := make(RedisHash, len(v))
+		for field, fieldValue := range v {
+			hash[field] = fieldValue
+		}
+		value = hash
+	case *RedisStream:
+		stream := &RedisStream{
+			entries:    make(map[string]*StreamEntry, len(v.entries)),
+			entryOrder: append([]string{}, v.entryOrder...),
+		}
+		for id, entry := range v.entries {
+			entryCopy := &StreamEntry{id: entry.id, fields: make(map[string]string, len(entry.fields)), keys: append([]string{}, entry.keys...)}
+			for field, fieldValue := range entry.fields {
+				entryCopy.fields[field] = fieldValue
+			}
+			stream.entries[id] = entryCopy
+		}
+		value = stream
+	}
+
+	dup := newObject(obj.objType, value)
+	dup.encoding = obj.encoding
+	dup._buildMemberIndex()
+	dup.expires, dup.expiresAt = obj.expires, obj.expiresAt
+	return dup
+}
+
+// Returns true if the object has an expiry that has passed.
+func (obj *RedisObject) isExpired() bool {
+	return obj.expires && !obj.expiresAt.After(time.Now())
+}
+
+// Members of the sorted set ordered by score, ties broken by member.
+func (zset *RedisSortedSet) sortedMembers() []string {
+	members := make([]string, 0, len(zset.scores))
+	for member := range zset.scores {
+		members = append(members, member)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		a, b := zset.scores[members[i]], zset.scores[members[j]]
+		if a != b {
+			return a < b
+		}
+		return members[i] < members[j]
+	})
+	return members
+}
+
+// Formats a sorted set score the way redis replies with it: integers without a decimal
+// point, "inf" and "-inf" for the infinities, the shortest representation otherwise.
+func formatScore(score float64) string {
+	switch {
+	case math.IsInf(score, 1):
+		return "inf"
+	case math.IsInf(score, -1):
+		return "-inf"
+	case score == math.Trunc(score) && math.Abs(score) < 1e17:
+		return strconv.FormatFloat(score, 'f', -1, 64)
+	}
+	return strconv.FormatFloat(score, 'g', -1, 64)
+}
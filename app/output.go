@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// What gets written to a client outside of its own request/reply flow (pub/sub messages,
+// invalidations, the replication stream) is queued under the execution lock, and written by a
+// goroutine of the connection's own. A client that stops reading can't hold up the server this
+// way: once its queue grows past the limit of its class (client-output-buffer-limit in redis),
+// it's disconnected.
+const (
+	clientOutputBufferLimit  = 32 * 1024 * 1024  // pub/sub and regular clients
+	replicaOutputBufferLimit = 256 * 1024 * 1024 // replicas, for the stream and what's held back during their snapshot
+	clientWriteTimeout       = 60 * time.Second  // a client not reading anything for this long is disconnected
+)
+
+func newOutputBuffer(conn net.Conn) *OutputBuffer {
+	out := &OutputBuffer{
+		conn:    conn,
+		limit:   clientOutputBufferLimit,
+		timeout: clientWriteTimeout,
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	go out.writeLoop()
+	return out
+}
+
+// Replicas get more room, the replication stream can burst.
+func (out *OutputBuffer) setLimits(limit int, timeout time.Duration) {
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	out.limit, out.timeout = limit, timeout
+}
+
+// Queues data for the writer goroutine, never blocks. Past the limit, the connection is closed
+// instead (the client notices and gets freed as usual).
+func (out *OutputBuffer) queue(data []byte) {
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	if out.overflowed {
+		return
+	}
+	if len(out.pending)+len(data) > out.limit {
+		fmt.Println("Client", out.conn.RemoteAddr(), "closed for overcoming of output buffer limits")
+		out.overflowed = true
+		out.pending = nil
+		out.conn.Close()
+		return
+	}
+	out.pending = append(out.pending, data...)
+	select {
+	case out.wake <- struct{}{}:
+	default: // the writer has been woken up already
+	}
+}
+
+// Writes data right away, after whatever is queued: replies to the client's own requests, the
+// rdb of a full resync. Blocks, so it's called without the execution lock.
+func (out *OutputBuffer) write(data []byte) error {
+	out.writeLock.Lock()
+	defer out.writeLock.Unlock()
+	if err := out._flush(); err != nil {
+		return err
+	}
+	return out._write(data)
+}
+
+// Writes everything queued so far. Called holding writeLock.
+func (out *OutputBuffer) _flush() error {
+	out.mu.Lock()
+	pending := out.pending
+	out.pending = nil
+	out.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+	return out._write(pending)
+}
+
+func (out *OutputBuffer) _write(data []byte) error {
+	out.mu.Lock()
+	timeout := out.timeout
+	out.mu.Unlock()
+
+	out.conn.SetWriteDeadline(time.Now().Add(timeout))
+	if _, err := out.conn.Write(data); err != nil {
+		out.conn.Close() // too slow, or gone already
+		return err
+	}
+	return nil
+}
+
+// The writer goroutine, until the client is freed or the connection breaks.
+func (out *OutputBuffer) writeLoop() {
+	for {
+		select {
+		case <-out.done:
+			return
+		case <-out.wake:
+		}
+
+		out.writeLock.Lock()
+		err := out._flush()
+		out.writeLock.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Stops the writer goroutine. Whatever is still queued is dropped, the client is gone.
+func (out *OutputBuffer) close() {
+	close(out.done)
+}
@@ -1,30 +1,36 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
 )
 
-// Parse incoming resp request. Returns an array of resp objects containing the 
-// parsed requests. This is because sometimes more than one request might be bundled
-// into the same tcp request.
-func parseRESP(respBytes []byte) ([]RESP, error) {
+// Returned while parsing a request that hasn't fully arrived yet. Not an actual error,
+// the rest of it should come with the next read.
+var errIncompleteRESP = errors.New("incomplete resp request")
+
+// Parse incoming resp requests. Returns an array of resp objects containing the
+// parsed requests, and the number of bytes they took up. This is because sometimes more
+// than one request might be bundled into the same tcp request, and the last one might
+// not have fully arrived yet (it's left unparsed, for the next call).
+func parseRESP(respBytes []byte) ([]RESP, int, error) {
 	resps := make([]RESP, 0, 2)
-	for len(respBytes) > 0 {
-		resp, err := _parseRESP(respBytes)
+	consumed := 0
+	for consumed < len(respBytes) {
+		resp, err := _parseRESP(respBytes[consumed:])
+		if err == errIncompleteRESP {
+			break
+		}
 		if err != nil {
-			return resps, err
+			return resps, consumed, err
 		}
-		
+
 		resps = append(resps, resp)
-		if (len(resp.RawBytes) >= len(respBytes)){
-			break
-		}
-		
-		respBytes = respBytes[len(resp.RawBytes):]
+		consumed += len(resp.RawBytes)
 	}
-	return resps, nil
+	return resps, consumed, nil
 }
 
 // Parse individual resp requests, returns one resp object containing the parsed values.
@@ -54,32 +60,22 @@ func _parseRESP(respBytes []byte) (RESP, error) {
 }
 
 func _parseRESP_Integer(respBytes []byte) (RESP, error) {
-	resp := RESP{}
-	resp.respType = RESPTypes.Integer
-
-	sign := 1
-	start := 0
-
-	if respBytes[0] == '-' { // Negative integer
-		sign = -1
-		start++ // move past the sign
+	crlf, err := findNextCLRF(respBytes)
+	if err != nil {
+		return RESP{}, err
 	}
 
-	// Iterate till crlf (integer might be more than one digit)
-	for end := 0; end < len(respBytes); end++ {
-		if respBytes[end] == '\r' && respBytes[end+1] == '\n' {
-			intStr := string(respBytes[start:end])
-			val, err := strconv.Atoi(intStr)
-			if err != nil {
-				return RESP{}, fmt.Errorf("error parsing int: Error parsing array of ints")
-			}
-
-			resp.respData.Int = sign * val
-			resp.RawBytes = respBytes[:end+2] // Including the \r\n
-			return resp, nil
-		}
+	// Atoi takes care of the sign
+	val, err := strconv.Atoi(string(respBytes[1:crlf]))
+	if err != nil {
+		return RESP{}, fmt.Errorf("error parsing int: invalid integer")
 	}
-	return RESP{}, fmt.Errorf("error parsing int resp: unexpected error") // should never hit this.
+
+	resp := RESP{}
+	resp.respType = RESPTypes.Integer
+	resp.respData.Int = val
+	resp.RawBytes = respBytes[:crlf+2] // Including the \r\n
+	return resp, nil
 }
 
 func _parseRESP_String(respBytes []byte) (RESP, error) {
@@ -121,7 +117,7 @@ func _parseRESP_Array(respBytes []byte) (RESP, error) {
 
 	// Parse it to extract the array length
 	arrayLength, err := strconv.Atoi(string(respBytes[1:clrf]))
-	if err != nil {
+	if err != nil || arrayLength < -1 {
 		return RESP{}, fmt.Errorf("error parsing array: cannot parse the length provided")
 	}
 
@@ -130,13 +126,17 @@ func _parseRESP_Array(respBytes []byte) (RESP, error) {
 	resp.Length = arrayLength
 	resp.respType = RESPTypes.Array
 
+	if arrayLength == -1 { // null array
+		resp.RawBytes = respBytes[:clrf+2]
+		return resp, nil
+	}
+
 	// Iterate over the array elements to extract the values
 	p := clrf + 2 // skipping past the \r\n after the length.p := 0
 
 	for ; arrayLength >= 1; arrayLength-- {
-		if p >= len(respBytes) {
-			err := fmt.Errorf("error parsing array: Unexpected end of resp request")
-			return RESP{}, err
+		if p >= len(respBytes) { // rest of the array hasn't arrived yet
+			return RESP{}, errIncompleteRESP
 		}
 
 		subResp, err := _parseRESP(respBytes[p:])
@@ -156,20 +156,14 @@ func _parseRESP_Bulk(respBytes []byte) (RESP, error) {
 	// Extract the Bulk String length
 	clrf, err := findNextCLRF(respBytes)
 	if err != nil {
-		fmt.Println("error parsing bulk string: CLRF after string length not found")
 		return RESP{}, err
 	}
 
 	stringLength, err := strconv.Atoi(string(respBytes[1:clrf]))
-	if err != nil {
+	if err != nil || stringLength < -1 {
 		return RESP{}, fmt.Errorf("error parsing bulk string resp: cannot parse the length provided")
 	}
 
-	if stringLength > len(respBytes) {
-		err := fmt.Errorf("error parsing bulk string resp: invlaid string length provided")
-		return RESP{}, err
-	}
-
 	// Start parsing the actual string.
 	stringStart := clrf + 2
 
@@ -177,30 +171,43 @@ func _parseRESP_Bulk(respBytes []byte) (RESP, error) {
 	resp.respType = RESPTypes.Bulk
 	resp.Length = stringLength
 
+	if stringLength == -1 { // null bulk string
+		resp.RawBytes = respBytes[:stringStart]
+		return resp, nil
+	}
+	if stringStart+stringLength+2 > len(respBytes) { // rest of the string hasn't arrived yet
+		return RESP{}, errIncompleteRESP
+	}
+
 	resp.respData.String = string(respBytes[stringStart : stringStart+stringLength])
 	resp.RawBytes = respBytes[:stringStart+stringLength+2]
 
 	return resp, nil
 }
 
+// Extracts the command and its arguments from the parsed request. Only the command name is
+// lowercased, arguments (keys, values, passwords) are case sensitive and are kept as sent.
 func extractCommandFromRESP(resp RESP) ([]string, int) {
 	arr := resp.respData.Array
 
 	ret := make([]string, len(arr))
 
 	for i, subresp := range arr {
-		val := strings.ToLower(subresp.respData.String)
-		ret[i] = val
+		ret[i] = subresp.respData.String
+	}
+	if len(ret) > 0 {
+		ret[0] = strings.ToLower(ret[0])
 	}
 
 	return ret, len(ret)
 }
 
+// Returns the index of the next \r\n. errIncompleteRESP if there is none (yet).
 func findNextCLRF(b []byte) (int, error) {
-	for clrf := 0; clrf < len(b); clrf++ {
+	for clrf := 0; clrf+1 < len(b); clrf++ {
 		if b[clrf] == '\r' && b[clrf+1] == '\n' { // Here it is
 			return clrf, nil
 		}
 	}
-	return -1, fmt.Errorf("error parsing array: CLRF for length identifier not found")
+	return -1, errIncompleteRESP
 }
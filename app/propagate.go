@@ -0,0 +1,115 @@
+package main
+
+import "strconv"
+
+// Queues a command to be sent to the replicas (and into the backlog) once the command running
+// now is done. For writes that don't come from a client command as is: the DEL of an expired
+// key, or a command rewritten into its deterministic form.
+func alsoPropagate(db int, args ...string) {
+	CONFIG.pendingPropagation = append(CONFIG.pendingPropagation, PropagatedCommand{db: db, args: args})
+}
+
+// Makes the running command get propagated as args instead of itself. For commands that
+// wouldn't do the same thing on the replicas (relative expire times, generated stream ids...).
+func rewriteCommandPropagation(args ...string) {
+	CONFIG.propagateAs = args
+}
+
+// Queues the command that just ran for propagation, if it's a write that changed something
+// (dirty moved past what it was before the command).
+func propagateCall(command RedisCommand, commands []string, dirty int) {
+	args := CONFIG.propagateAs
+	CONFIG.propagateAs = nil
+	if !commandInCategory(command, "write") || CONFIG.dirty == dirty {
+		return
+	}
+	if args == nil {
+		args = commands
+	}
+	alsoPropagate(currentDB().id, args...)
+}
+
+// Sends out everything queued by the command that just ran (a whole EXEC included). More than
+// one command gets wrapped in MULTI/EXEC, so the replicas apply them all at once too.
+// Replicas only pass on their master's stream, what they run themselves isn't propagated.
+func propagatePendingCommands() {
+	pending := CONFIG.pendingPropagation
+	CONFIG.pendingPropagation = nil
+	if len(pending) == 0 || CONFIG.isSlave {
+		return
+	}
+
+	transaction := len(pending) > 1
+	if transaction {
+		propagateCommands([]byte(respEncodeStringArray([]string{"MULTI"})))
+	}
+	for _, command := range pending {
+		// The replicas apply the writes to whatever database was SELECTed last in the stream.
+		if CONFIG.replicationDB != command.db {
+			propagateCommands([]byte(respEncodeStringArray([]string{"SELECT", strconv.Itoa(command.db)})))
+			CONFIG.replicationDB = command.db
+		}
+		propagateCommands([]byte(respEncodeStringArray(command.args)))
+	}
+	if transaction {
+		propagateCommands([]byte(respEncodeStringArray([]string{"EXEC"})))
+	}
+}
+
+// Send requests to the replica servers. Nothing is kept track of until the first replica shows up.
+func propagateCommands(request []byte) error {
+	if CONFIG.replBacklog == nil && len(CONFIG.replicas) == 0 {
+		return nil
+	}
+	feedReplicationBacklog(request)
+
+	var e error = nil
+	for _, replica := range CONFIG.replicas {
+		if err := replica.send(request); err != nil {
+			e = err
+		}
+	}
+	return e
+}
+
+// Passes a request of our master's stream on as is, to our own replicas and the backlog. Sub-replicas
+// see the master's stream byte for byte: same replication id, same offsets, so they can PSYNC
+// from any server of the chain.
+func feedReplicationStreamFromMaster(request []byte) {
+	feedReplicationBacklog(request)
+	for _, replica := range CONFIG.replicas {
+		replica.send(request)
+	}
+}
+
+// Closes the links of our replicas, they reconnect and PSYNC again. For when the stream they
+// were getting doesn't go on: we took a new history (full resync from our master, promotion).
+func disconnectReplicas() {
+	for _, replica := range CONFIG.replicas {
+		replica.conn.Close()
+	}
+}
+
+// WAITs blocked until more replicas acknowledge their writes. Only touched under the execution lock.
+var ackWaiters = make(map[chan struct{}]struct{})
+
+// Wakes up every WAIT, so they count their replicas again.
+func signalAckWaiters() {
+	for waiter := range ackWaiters {
+		select { // non blocking: the waiter might have been woken up already
+		case waiter <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Number of replicas that acknowledged the replication stream up to offset.
+func countAckedReplicas(offset int) int {
+	count := 0
+	for _, replica := range CONFIG.replicas {
+		if replica.ackOffset >= offset {
+			count++
+		}
+	}
+	return count
+}
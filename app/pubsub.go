@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net"
+	"sort"
+)
+
+// Commands a RESP2 client can still run once it has subscribed to something. RESP3 clients
+// get messages as push replies, they can keep running anything.
+var pubsubContextCommands = map[string]struct{}{
+	"subscribe": {}, "unsubscribe": {}, "psubscribe": {}, "punsubscribe": {},
+	"ping": {}, "quit": {}, "reset": {},
+}
+
+// Number of channels and patterns the client is subscribed to.
+func (client *RedisClient) subscriptionCount() int {
+	return len(client.subscriptions) + len(client.patternSubscriptions)
+}
+
+// Returns true if the client is in the RESP2 pub/sub context, where it can only run the
+// pubsubContextCommands.
+func clientInPubSubContext(conn net.Conn) bool {
+	client, exists := CONFIG.clients[conn]
+	return exists && client.resp < 3 && client.subscriptionCount() > 0
+}
+
+// Writes a message to another client's connection, outside of the usual request/reply flow
+// (pub/sub messages, invalidations). It's queued, see output.go.
+func writeToClient(client *RedisClient, message string) {
+	client.output.queue([]byte(message))
+}
+
+// Subscribe/unsubscribe confirmation, one per channel or pattern.
+func _pubsubReply(client *RedisClient, kind string, channel string, nullChannel bool) string {
+	encodedChannel := respEncodeBulkString(channel)
+	if nullChannel {
+		encodedChannel = "$-1\r\n"
+	}
+	return respEncodePush([]string{
+		respEncodeBulkString(kind),
+		encodedChannel,
+		respEncodeInteger(client.subscriptionCount()),
+	}, client.resp)
+}
+
+// SUBSCRIBE channel [channel ...] and PSUBSCRIBE pattern [pattern ...]
+func onSUBSCRIBE(commands []string, conn net.Conn) ([]string, error) {
+	client := CONFIG.clients[conn]
+	kind := commands[0]
+
+	subscriptions, registry := client.subscriptions, CONFIG.pubsubChannels
+	if kind == "psubscribe" {
+		subscriptions, registry = client.patternSubscriptions, CONFIG.pubsubPatterns
+	}
+
+	responses := make([]string, 0, len(commands)-1)
+	for _, channel := range commands[1:] {
+		subscribeClient(client, channel, subscriptions, registry)
+		responses = append(responses, _pubsubReply(client, kind, channel, false))
+	}
+	return responses, nil
+}
+
+// UNSUBSCRIBE [channel ...] and PUNSUBSCRIBE [pattern ...]. Without arguments, unsubscribes
+// from everything.
+func onUNSUBSCRIBE(commands []string, conn net.Conn) ([]string, error) {
+	client := CONFIG.clients[conn]
+	kind := commands[0]
+
+	subscriptions, registry := client.subscriptions, CONFIG.pubsubChannels
+	if kind == "punsubscribe" {
+		subscriptions, registry = client.patternSubscriptions, CONFIG.pubsubPatterns
+	}
+
+	channels := commands[1:]
+	if len(channels) == 0 {
+		for channel := range subscriptions {
+			channels = append(channels, channel)
+		}
+		sort.Strings(channels)
+
+		if len(channels) == 0 { // still gets a reply, with a null channel
+			return []string{_pubsubReply(client, kind, "", true)}, nil
+		}
+	}
+
+	responses := make([]string, 0, len(channels))
+	for _, channel := range channels {
+		unsubscribeClient(client, channel, subscriptions, registry)
+		responses = append(responses, _pubsubReply(client, kind, channel, false))
+	}
+	return responses, nil
+}
+
+// PUBLISH channel message. Replies with the number of clients that received the message.
+func onPUBLISH(commands []string) ([]string, error) {
+	return []string{respEncodeInteger(publishMessage(commands[1], commands[2]))}, nil
+}
+
+// Sends the message to every client subscribed to the channel, or to a pattern matching it.
+// Returns the number of clients it was sent to.
+func publishMessage(channel string, message string) int {
+	receivers := 0
+	for client := range CONFIG.pubsubChannels[channel] {
+		writeToClient(client, respEncodePush([]string{
+			respEncodeBulkString("message"),
+			respEncodeBulkString(channel),
+			respEncodeBulkString(message),
+		}, client.resp))
+		receivers++
+	}
+	for pattern, clients := range CONFIG.pubsubPatterns {
+		if !stringMatch(pattern, channel, false) {
+			continue
+		}
+		for client := range clients {
+			writeToClient(client, respEncodePush([]string{
+				respEncodeBulkString("pmessage"),
+				respEncodeBulkString(pattern),
+				respEncodeBulkString(channel),
+				respEncodeBulkString(message),
+			}, client.resp))
+			receivers++
+		}
+	}
+	return receivers
+}
+
+// Adds the client to the subscribers of the channel (or pattern) in the registry.
+func subscribeClient(client *RedisClient, channel string, subscriptions map[string]struct{}, registry map[string]map[*RedisClient]struct{}) {
+	if _, subscribed := subscriptions[channel]; subscribed {
+		return
+	}
+	subscriptions[channel] = struct{}{}
+
+	subscribers, exists := registry[channel]
+	if !exists {
+		subscribers = make(map[*RedisClient]struct{})
+		registry[channel] = subscribers
+	}
+	subscribers[client] = struct{}{}
+}
+
+// Removes the client from the subscribers of the channel (or pattern).
+func unsubscribeClient(client *RedisClient, channel string, subscriptions map[string]struct{}, registry map[string]map[*RedisClient]struct{}) {
+	delete(subscriptions, channel)
+	subscribers := registry[channel]
+	delete(subscribers, client)
+	if len(subscribers) == 0 {
+		delete(registry, channel)
+	}
+}
+
+// Unsubscribes the client from every channel and pattern. Used when the client goes away.
+func unsubscribeAll(client *RedisClient) {
+	for channel := range client.subscriptions {
+		unsubscribeClient(client, channel, client.subscriptions, CONFIG.pubsubChannels)
+	}
+	for pattern := range client.patternSubscriptions {
+		unsubscribeClient(client, pattern, client.patternSubscriptions, CONFIG.pubsubPatterns)
+	}
+}
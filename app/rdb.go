@@ -1,10 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"encoding/binary"
-	"encoding/hex"
 	"fmt"
+	"math"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -23,21 +27,69 @@ const ( // Descriptions are also from the site, here for the convinience of not
 	opCodeEOF          byte = 0xFF // End of the RDB file.
 )
 
-const ( // String encoding identifier
-	stringEncoding_string byte = 0x0D // Anything that has a first byte less than this is a string. (Max length for strings is 13)
-	stringEncoding_int8   byte = 0xC0 // Regular int8
-	stringEncoding_int16  byte = 0xC1 // Regular int16
-	stringEncoding_int32  byte = 0xC2 // Little-Endian encoded int32
-	stringEncoding_int64  byte = 0xC3 // Little-Endian encoded int64
+const ( // Value type identifiers. We write the plain encodings, and read the packed ones redis writes too.
+	valueTypeString byte = 0x00 // Plain string value
+	valueTypeList   byte = 0x01 // Size, then each element as a string
+	valueTypeSet    byte = 0x02 // Size, then each member as a string
+	valueTypeZSet   byte = 0x03 // Size, then each member as a string followed by its score as a string (1 byte length)
+	valueTypeHash   byte = 0x04 // Size, then each field and value as strings
+	valueTypeZSet2  byte = 0x05 // Size, then each member as a string followed by its score as a binary float64
+
+	// Packed encodings: a single string holding the value as redis keeps it in memory.
+	valueTypeListZiplist  byte = 0x0A
+	valueTypeSetIntset    byte = 0x0B
+	valueTypeZSetZiplist  byte = 0x0C // member, score, member, score...
+	valueTypeHashZiplist  byte = 0x0D // field, value, field, value...
+	valueTypeHashListpack byte = 0x10
+	valueTypeZSetListpack byte = 0x11
+	valueTypeSetListpack  byte = 0x14
+
+	// Lists as quicklists: number of nodes, then each node as a ziplist (or, in the second version,
+	// a container type followed by a listpack, or by a single element for the plain ones).
+	valueTypeListQuicklist  byte = 0x0E
+	valueTypeListQuicklist2 byte = 0x12
+
+	// Streams: number of nodes, then each node as its 128 bit master id and a listpack of entries,
+	// then the length and last id, then the consumer groups. The later types add metadata.
+	valueTypeStreamListpacks  byte = 0x0F
+	valueTypeStreamListpacks2 byte = 0x13 // first id, max deleted entry id, entries added and groups' entries read (redis 7.0)
+	valueTypeStreamListpacks3 byte = 0x15 // consumers' active time (redis 7.2)
+)
+
+// Container types of the nodes of valueTypeListQuicklist2.
+const (
+	quicklistNodePlain  = 1 // a single element too big for a listpack
+	quicklistNodePacked = 2 // a listpack
+)
+
+// Entries per stream node we write, redis' default stream-node-max-entries.
+const streamNodeMaxEntries = 100
+
+// Flags of the entries in a stream node.
+const (
+	streamItemDeleted    = 1 // deleted with XDEL, still taking room in the node
+	streamItemSameFields = 2 // same fields as the master entry, only the values are stored
+)
+
+const ( // Special string encodings (size encoding with the 0b11 prefix, remaining 6 bits)
+	stringEncoding_int8  byte = 0x00 // Regular int8
+	stringEncoding_int16 byte = 0x01 // Little-Endian encoded int16
+	stringEncoding_int32 byte = 0x02 // Little-Endian encoded int32
+	stringEncoding_lzf   byte = 0x03 // LZF compressed string
 )
 
 const ( // Size encoding identifier
-	sizeEncoding_6bits             byte = 0b00 // size is remaining 6 bits of this byte
-	sizeEncoding_14bits            byte = 0b01 // size is next 14 bits(this plus next entire byte) in big-endian
-	sizeEncoding_idkwhattocallthis byte = 0b10 // ignore first 6(rest of this byte), size is the 4 BYTES after in big-endian
-	sizeEncoding_stringEncoding    byte = 0b11 // remaining 6 bits are string encoded
+	sizeEncoding_6bits          byte = 0b00 // size is remaining 6 bits of this byte
+	sizeEncoding_14bits         byte = 0b01 // size is next 14 bits(this plus next entire byte) in big-endian
+	sizeEncoding_32or64bits     byte = 0b10 // 0x80: size is the 4 BYTES after in big-endian. 0x81: the 8 bytes after.
+	sizeEncoding_stringEncoding byte = 0b11 // remaining 6 bits are a special string encoding
 )
 
+// Version written in the header of the rdb files we generate.
+const rdbVersion = "0011"
+
+var errRDBTruncated = fmt.Errorf("unexpected end of rdb data")
+
 // Loads, reads and returns a struct containing the information from the
 // .rdb file from the directory and filename provided.
 func setupRDB(dir string, dbFileName string) RedisRDB {
@@ -48,23 +100,61 @@ func setupRDB(dir string, dbFileName string) RedisRDB {
 	rdb := RedisRDB{
 		config: rdbConfig,
 	}
-	rdb.keyValueStore = RedisKeyValueStore{db: make(map[string]RedisRecord)}
-	rdb.streamStore = RedisStreamStore{streams: make(map[string]RedisStream)}
+	rdb.databases = make([]*RedisDatabase, CONFIG.databases)
+	for i := range rdb.databases {
+		rdb.databases[i] = newDatabase(i)
+	}
 
 	// need to load in the rdb specified by the dirname and dir.
 	data, exists := loadRDBFromFile(dir, dbFileName)
 	if exists {
 		// load the data from the rdb file.
-		rdb = parseRDB(data, rdb)
+		loaded, err := parseRDB(data, rdb)
+		if err != nil {
+			logAndExit("error reading rdb file", err)
+		}
+		rdb = loaded
 	}
 
 	return rdb
 }
 
+// Replaces every database with the contents of the rdb data (the one a master sends over for a
+// full sync). Nothing changes if the data can't be parsed.
+func loadRDB(data []byte) error {
+	loaded := RedisRDB{config: RDB.config, databases: make([]*RedisDatabase, len(RDB.databases))}
+	for i := range loaded.databases {
+		loaded.databases[i] = newDatabase(i)
+	}
+	loaded, err := parseRDB(data, loaded)
+	if err != nil {
+		return err
+	}
+
+	for i, db := range RDB.databases {
+		db.flush()
+		db.keys, db.scanIndex, db.expires = loaded.databases[i].keys, loaded.databases[i].scanIndex, loaded.databases[i].expires
+		touchAllWatchedKeys(db) // keys that only exist now changed too
+		for key, obj := range db.keys {
+			if obj.objType == objStream {
+				signalStreamWaiters(key) // XREAD BLOCK on the replica might have something to read
+			}
+		}
+	}
+	invalidateAllTrackedKeys()
+
+	// Sent by replicas of replicas: the stream that follows doesn't start with a SELECT.
+	if streamDB, err := strconv.Atoi(loaded.auxFields["repl-stream-db"]); err == nil && streamDB >= 0 && streamDB < len(RDB.databases) {
+		CONFIG.masterDB = streamDB
+	}
+	return nil
+}
+
 // parses the rdb data in bits and extracts useful information into the redisRDB struct.
-func parseRDB(data []byte, rdb RedisRDB) RedisRDB {
-	if len(data) < 9 {
-		return rdb
+// The databases of rdb get the keys of the matching database sections.
+func parseRDB(data []byte, rdb RedisRDB) (RedisRDB, error) {
+	if len(data) < 9 || string(data[:5]) != "REDIS" {
+		return rdb, fmt.Errorf("not an rdb file")
 	}
 
 	// and now, for the looooooooong process of loading the bitch
@@ -73,88 +163,157 @@ func parseRDB(data []byte, rdb RedisRDB) RedisRDB {
 	// skip the header (Magic String + Version Number => "REDIS0012")
 	index += 9
 
-	rdb, indexOffset := _parseRDB_MetaData(data[index:], rdb)
-	index += indexOffset
-
-	rdb, indexOffset = _parseRDB_DatabaseInfo(data[index:], rdb)
+	rdb, indexOffset, err := _parseRDB_MetaData(data[index:], rdb)
+	if err != nil {
+		return rdb, err
+	}
 	index += indexOffset
 
-	// Finally. Once all that is gone, what remains is key value pairs
-	rdb, indexOffset = _parseRDB_KeyValue(data[index:], rdb)
-	index += indexOffset
+	// Then one section per (non empty) database: the database info, followed by its key value pairs.
+	// Files without any database selector have everything in database 0.
+	dbIndex := 0
+	for index < len(data) && data[index] != opCodeEOF {
+		switch data[index] {
+		case opCodeAux:
+			rdb, indexOffset, err = _parseRDB_MetaData(data[index:], rdb)
+		case opCodeSelectDB, opCodeResizeDB:
+			dbIndex, indexOffset, err = _parseRDB_DatabaseInfo(data[index:], dbIndex)
+			if err == nil && dbIndex >= len(rdb.databases) {
+				err = fmt.Errorf("database %d is out of range (databases is %d)", dbIndex, len(rdb.databases))
+			}
+		default:
+			// Finally. Once all that is gone, what remains is key value pairs
+			indexOffset, err = _parseRDB_KeyValue(data[index:], rdb.databases[dbIndex])
+		}
+		if err != nil {
+			return rdb, err
+		}
+		index += indexOffset
+	}
 
-	return rdb
+	return rdb, nil
 }
 
 // Decodes the next string from string encoded bits,
 // returns it's value, it's length(from the bytes for offset by the caller), and error if there is one.
 func decodeStringEncoding(data []byte) (str string, strLength int, err error) {
-	// Parse for strings
-	// Strings have max length of 13 (0x0D). Anything with the first byte less than that is a string
-	if data[0] <= stringEncoding_string {
-		strLength := int(data[0]) + 1
-		return string(data[1:strLength]), strLength, nil
+	size, offset, isEncoded, err := decodeSizeEncoding(data)
+	if err != nil {
+		return "", 0, err
 	}
 
-	// Parse for ints
-	// Can be int8, int16 or int32. int64 is not supported
-	switch data[0] {
+	// Plain strings: the size is the length of the string that follows.
+	if !isEncoded {
+		if len(data) < offset+size {
+			return "", 0, errRDBTruncated
+		}
+		return string(data[offset : offset+size]), offset + size, nil
+	}
+
+	// Integers are stored as the number itself, they are turned back into their string form.
+	switch byte(size) {
 	case stringEncoding_int8:
-		return string(data[1]), 2, nil // 8bit int is one byte
+		if len(data) < 2 {
+			return "", 0, errRDBTruncated
+		}
+		return strconv.Itoa(int(int8(data[1]))), 2, nil // 8bit int is one byte
 
 	case stringEncoding_int16:
-		val := binary.LittleEndian.Uint16(data[1:3])
-		return string(val), 3, nil
+		if len(data) < 3 {
+			return "", 0, errRDBTruncated
+		}
+		val := int16(binary.LittleEndian.Uint16(data[1:3]))
+		return strconv.Itoa(int(val)), 3, nil
 
 	case stringEncoding_int32:
-		val := binary.LittleEndian.Uint32(data[1:5])
-		return string(val), 5, nil
+		if len(data) < 5 {
+			return "", 0, errRDBTruncated
+		}
+		val := int32(binary.LittleEndian.Uint32(data[1:5]))
+		return strconv.Itoa(int(val)), 5, nil
 
-	case stringEncoding_int64:
-		return "", 0, fmt.Errorf("64 bit int not supported")
+	case stringEncoding_lzf:
+		index := 1
+		compressedLength, indexOffset, _, err := decodeSizeEncoding(data[index:])
+		if err != nil {
+			return "", 0, err
+		}
+		index += indexOffset
+		length, indexOffset, _, err := decodeSizeEncoding(data[index:])
+		if err != nil {
+			return "", 0, err
+		}
+		index += indexOffset
+		if len(data) < index+compressedLength {
+			return "", 0, errRDBTruncated
+		}
+		decompressed, err := lzfDecompress(data[index:index+compressedLength], length)
+		if err != nil {
+			return "", 0, err
+		}
+		return string(decompressed), index + compressedLength, nil
 	}
 
 	// If not int or string...
-	return "", 0, fmt.Errorf("error decoding rdb string: tf did you provide")
+	return "", 0, fmt.Errorf("error decoding rdb string: unknown string encoding 0x%x", size)
 }
 
-// Decodes size-encoded bits. Returns the decoded value, index offset, error(if exists).
-func decodeSizeEncoding(data []byte) (size string, indexOffset int, err error) {
+// Decodes size-encoded bits. Returns the decoded value, index offset, whether the value is
+// a special string encoding (0b11 prefix) rather than a size, and error(if exists).
+func decodeSizeEncoding(data []byte) (size int, indexOffset int, isEncoded bool, err error) {
+	if len(data) == 0 {
+		return 0, 0, false, errRDBTruncated
+	}
 	firstTwoBits := data[0] >> 6 // data[0] is one byte. need the first two BITS
 
 	switch firstTwoBits {
 	case sizeEncoding_6bits: // 6bit length, just need the remaining bits from the first byte.
-		val := int(data[0] & 0x3F) // masking out the first two
-		return string(val), 1, nil
+		return int(data[0] & 0x3F), 1, false, nil // masking out the first two
 
 	case sizeEncoding_14bits: // so i need first 6 bits, plus the next 8 bits
-		// Now this is too complicated for my monkey brain. what follows is code with help from gpt
-		val := int(data[0] & 0x3F)      // masking out the first two bits, apparently
-		val = (val << 8) + int(data[1]) // shifting the value to the left by 8 and adding the second byte. Yes i dont understand this bit one bit.
-		return string(val), 2, nil
+		if len(data) < 2 {
+			return 0, 0, false, errRDBTruncated
+		}
+		val := int(data[0] & 0x3F)      // masking out the first two bits
+		val = (val << 8) | int(data[1]) // the 6 bits are the high bits, the next byte the low ones
+		return val, 2, false, nil
 
-	case sizeEncoding_idkwhattocallthis: // 5 byte length. Much more reasonable.
-		val := binary.BigEndian.Uint32(data[1:6]) // give it the first 5 bytes
-		return string(val), 3, nil
+	case sizeEncoding_32or64bits:
+		switch data[0] {
+		case 0x80: // 32 bit length, in the next 4 bytes
+			if len(data) < 5 {
+				return 0, 0, false, errRDBTruncated
+			}
+			return int(binary.BigEndian.Uint32(data[1:5])), 5, false, nil
+		case 0x81: // 64 bit length, in the next 8 bytes
+			if len(data) < 9 {
+				return 0, 0, false, errRDBTruncated
+			}
+			return int(binary.BigEndian.Uint64(data[1:9])), 9, false, nil
+		}
 
 	case sizeEncoding_stringEncoding:
-		return decodeStringEncoding(data)
-
+		return int(data[0] & 0x3F), 1, true, nil
 	}
 
-	// There are others, not handling those for this project
-	return "", 0, fmt.Errorf("error decoding size encoding: no bloody clue what went wrong, come debug lil man")
+	return 0, 0, false, fmt.Errorf("error decoding size encoding: unknown encoding 0x%x", data[0])
 }
 
 // Decodes Expiry timestamp from ms or s. Returns the decoded value, index offset, error(if exists).
 func decodeExpiryTimestamp(data []byte) (timestamp time.Time, indexOffset int, err error) {
 	switch data[0] {
 	case opCodeExpireTime: // next 4 bytes are unix timestamp (uint)
+		if len(data) < 5 {
+			return time.Time{}, 0, errRDBTruncated
+		}
 		rawTime := int64(binary.LittleEndian.Uint32(data[1:5]))
 		timeStamp := time.Unix(rawTime, 0).UTC()
 		return timeStamp, 5, nil
 
 	case opCodeExpireTimeMs: // next 8 bytes are unix timestamp (ulong)
+		if len(data) < 9 {
+			return time.Time{}, 0, errRDBTruncated
+		}
 		rawTime := int64(binary.LittleEndian.Uint64(data[1:9]))
 		timeStamp := time.UnixMilli(rawTime).UTC()
 		return timeStamp, 9, nil
@@ -164,6 +323,49 @@ func decodeExpiryTimestamp(data []byte) (timestamp time.Time, indexOffset int, e
 	}
 }
 
+// Decompresses LZF compressed data (how redis compresses long strings in rdb files).
+func lzfDecompress(in []byte, length int) ([]byte, error) {
+	out := make([]byte, 0, length)
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+
+		if ctrl < 32 { // literal run of ctrl+1 bytes
+			if i+ctrl+1 > len(in) {
+				return nil, errRDBTruncated
+			}
+			out = append(out, in[i:i+ctrl+1]...)
+			i += ctrl + 1
+			continue
+		}
+
+		// back reference: copy from what was already decompressed
+		refLength := ctrl >> 5
+		if refLength == 7 {
+			if i >= len(in) {
+				return nil, errRDBTruncated
+			}
+			refLength += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return nil, errRDBTruncated
+		}
+		ref := len(out) - ((ctrl & 0x1F) << 8) - int(in[i]) - 1
+		i++
+		if ref < 0 {
+			return nil, fmt.Errorf("invalid lzf back reference")
+		}
+		for j := 0; j < refLength+2; j++ { // byte by byte, the reference can overlap with what is being written
+			out = append(out, out[ref+j])
+		}
+	}
+	if len(out) != length {
+		return nil, fmt.Errorf("lzf decompressed length mismatch")
+	}
+	return out, nil
+}
+
 // Loads the .rdb file from the given name and directory
 func loadRDBFromFile(dir string, dbFileName string) ([]byte, bool) {
 	data, err := os.ReadFile(dir + "/" + dbFileName)
@@ -176,70 +378,92 @@ func loadRDBFromFile(dir string, dbFileName string) ([]byte, bool) {
 	return data, hasData
 }
 
+// Writes every database to the .rdb file in the given directory.
+func saveRDBToFile(dir string, dbFileName string) error {
+	return writeRDBFile(dir, dbFileName, encodeRDB(RDB))
+}
+
+// Writes rdb data to the .rdb file in the given directory. Written to a temp file first, so
+// a failed save doesn't leave a half written file behind.
+func writeRDBFile(dir string, dbFileName string, data []byte) error {
+	path := dir + "/" + dbFileName
+	tmpPath := fmt.Sprintf("%s/temp-%d.rdb", dir, os.Getpid())
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
 // Parses the metadata section of the rdb
-func _parseRDB_MetaData(data []byte, rdb RedisRDB) (_ RedisRDB, indexOffset int) {
+func _parseRDB_MetaData(data []byte, rdb RedisRDB) (_ RedisRDB, indexOffset int, err error) {
 	index := 0
-	// Auxiliary Section: Reading them, not saving them for now
+	// Auxiliary Section
 	for len(data) > index && data[index] == opCodeAux {
 		index++ // skip the opcode
 
-		_, offset, err := decodeStringEncoding(data[index:]) // key
+		key, offset, err := decodeStringEncoding(data[index:]) // key
 		if err != nil {
-			logAndExit("error reading rdb file", err)
+			return rdb, 0, err
 		}
 		index += offset // move past the key
 
-		_, offset, err = decodeStringEncoding(data[index:]) // value
+		value, offset, err := decodeStringEncoding(data[index:]) // value
 		if err != nil {
-			logAndExit("error reading rdb file", err)
+			return rdb, 0, err
 		}
 		index += offset // move past the value
+
+		if rdb.auxFields == nil {
+			rdb.auxFields = make(map[string]string)
+		}
+		rdb.auxFields[key] = value
 	}
 
-	return rdb, index
+	return rdb, index, nil
 }
 
-// TODO: IMPLEMENT THIS (WHEN REQUIRED lol)
-// This rdb file section has multiple subsections. Doing nothing with all of them, just "parsing" and skipping past them.
-func _parseRDB_DatabaseInfo(data []byte, rdb RedisRDB) (_ RedisRDB, indexOffset int) {
+// Parses the database selector and resize subsections at the start of a database section.
+// Returns the index of the database the key value pairs that follow belong to.
+func _parseRDB_DatabaseInfo(data []byte, dbIndex int) (_ int, indexOffset int, err error) {
 	index := 0
 
-	// Database selector section. Not supporting more than one, so not doing anything with it rn.
-	if data[index] == opCodeSelectDB {
+	// Database selector section.
+	if index < len(data) && data[index] == opCodeSelectDB {
 		index++
 
-		_, valLength, err := decodeSizeEncoding(data[index:])
+		selected, valLength, _, err := decodeSizeEncoding(data[index:])
 		if err != nil {
-			logAndExit("error reading rdb file: database info", err)
+			return 0, 0, err
 		}
+		dbIndex = selected
 		index += valLength
 	}
 
-	// Resize subsection: No idea agian.
-	if data[index] == opCodeResizeDB {
+	// Resize subsection: hash table sizes for the keyspace and the expires. Only hints, skipping them.
+	if index < len(data) && data[index] == opCodeResizeDB {
 		index++
 
-		_, indexOffset, err := decodeSizeEncoding(data[index:])
+		_, indexOffset, _, err := decodeSizeEncoding(data[index:])
 		if err != nil {
-			logAndExit("error reading rdb file: database info", err)
+			return 0, 0, err
 		}
-
 		index += indexOffset
 
-		_, indexOffset, err = decodeSizeEncoding(data[index:])
+		_, indexOffset, _, err = decodeSizeEncoding(data[index:])
 		if err != nil {
-			logAndExit("error reading rdb file: database info", err)
+			return 0, 0, err
 		}
 		index += indexOffset
 	}
-	return rdb, index
+	return dbIndex, index, nil
 }
 
-// parses the key-value pairs stored.
-func _parseRDB_KeyValue(data []byte, rdb RedisRDB) (_ RedisRDB, indexOffset int) {
+// parses the key-value pairs stored, until the next section (database, aux field or the end of the file).
+func _parseRDB_KeyValue(data []byte, db *RedisDatabase) (indexOffset int, err error) {
 	index := 0
 
-	for data[index] == 0x00 || data[index] == opCodeExpireTime || data[index] == opCodeExpireTimeMs {
+	for index < len(data) && data[index] != opCodeEOF && data[index] != opCodeSelectDB &&
+		data[index] != opCodeResizeDB && data[index] != opCodeAux {
 		timeStamp := time.Time{}
 		expiresFlag := false
 
@@ -247,7 +471,7 @@ func _parseRDB_KeyValue(data []byte, rdb RedisRDB) (_ RedisRDB, indexOffset int)
 		if data[index] == opCodeExpireTime || data[index] == opCodeExpireTimeMs {
 			t, offset, err := decodeExpiryTimestamp(data[index:])
 			if err != nil {
-				logAndExit("error reading rdb file: key-value pairs", err)
+				return 0, err
 			}
 
 			timeStamp = t
@@ -255,42 +479,654 @@ func _parseRDB_KeyValue(data []byte, rdb RedisRDB) (_ RedisRDB, indexOffset int)
 			index += offset
 		}
 
+		if index >= len(data) {
+			return 0, errRDBTruncated
+		}
+		valueType := data[index]
+
 		// parse the key
 		index++
 		key, indexOffset, err := decodeStringEncoding(data[index:])
 		if err != nil {
-			logAndExit("error reading rdb file: key-value pairs", err)
+			return 0, err
 		}
 
 		// parse the value
 		index += indexOffset
-		value, indexOffset, err := decodeStringEncoding(data[index:])
+		obj, indexOffset, err := _parseRDB_Value(data[index:], valueType)
 		if err != nil {
-			logAndExit("error reading rdb file: key-value pairs", err)
+			return 0, err
 		}
-
-		// record the key-value pair
 		index += indexOffset
-		record := RedisRecord{
-			value: value,
-		}
 
 		// set the expiry values
 		if expiresFlag {
-			record.expiresAt = timeStamp
-			record.expires = true
+			obj.expiresAt = timeStamp
+			obj.expires = true
 		}
 
-		rdb.keyValueStore.db[key] = record
+		db.setKey(key, obj)
 	}
 
-	return rdb, index
+	return index, nil
 }
 
-func encodeRDB(_ RedisRDB) []byte {
-	// encoding an empty RDB to send to the replica server
+// Parses a value of the given type. Returns the object and the number of bytes it took.
+func _parseRDB_Value(data []byte, valueType byte) (*RedisObject, int, error) {
+	if valueType == valueTypeString {
+		value, indexOffset, err := decodeStringEncoding(data)
+		if err != nil {
+			return nil, 0, err
+		}
+		return newStringObject(value), indexOffset, nil
+	}
+
+	if valueType == valueTypeStreamListpacks || valueType == valueTypeStreamListpacks2 || valueType == valueTypeStreamListpacks3 {
+		return _parseRDB_Stream(data, valueType)
+	}
+	switch valueType {
+	case valueTypeListZiplist, valueTypeSetIntset, valueTypeZSetZiplist, valueTypeHashZiplist,
+		valueTypeHashListpack, valueTypeZSetListpack, valueTypeSetListpack:
+		return _parseRDB_Packed(data, valueType)
+	case valueTypeListQuicklist, valueTypeListQuicklist2:
+		return _parseRDB_Quicklist(data, valueType)
+	case valueTypeList, valueTypeSet, valueTypeHash, valueTypeZSet, valueTypeZSet2:
+	default:
+		// Modules, zipmaps (redis < 2.6), hashes with field expiry (redis 7.4): the size of
+		// the value isn't known, there's no reading past it.
+		return nil, 0, fmt.Errorf("unsupported value type 0x%x", valueType)
+	}
+
+	size, index, _, err := decodeSizeEncoding(data)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Hashes come in field-value pairs, sorted sets in member-score pairs.
+	elements := make([]string, 0, size)
+	scores := make([]float64, 0, size)
+	for i := 0; i < size; i++ {
+		element, indexOffset, err := decodeStringEncoding(data[index:])
+		if err != nil {
+			return nil, 0, err
+		}
+		index += indexOffset
+		elements = append(elements, element)
+
+		switch valueType {
+		case valueTypeHash:
+			value, indexOffset, err := decodeStringEncoding(data[index:])
+			if err != nil {
+				return nil, 0, err
+			}
+			index += indexOffset
+			elements = append(elements, value)
+		case valueTypeZSet2:
+			if index+8 > len(data) {
+				return nil, 0, errRDBTruncated
+			}
+			scores = append(scores, math.Float64frombits(binary.LittleEndian.Uint64(data[index:])))
+			index += 8
+		case valueTypeZSet:
+			score, indexOffset, err := _parseRDB_ZSetScore(data[index:])
+			if err != nil {
+				return nil, 0, err
+			}
+			index += indexOffset
+			scores = append(scores, score)
+		}
+	}
+
+	if valueType == valueTypeZSet {
+		valueType = valueTypeZSet2
+	}
+	return _newRDB_Object(valueType, elements, scores), index, nil
+}
+
+// Scores of valueTypeZSet: a length byte, with 253, 254 and 255 for nan, inf and -inf, then the
+// score as a string.
+func _parseRDB_ZSetScore(data []byte) (float64, int, error) {
+	if len(data) == 0 {
+		return 0, 0, errRDBTruncated
+	}
+	switch data[0] {
+	case 253:
+		return math.NaN(), 1, nil
+	case 254:
+		return math.Inf(1), 1, nil
+	case 255:
+		return math.Inf(-1), 1, nil
+	}
+	length := int(data[0])
+	if len(data) < 1+length {
+		return 0, 0, errRDBTruncated
+	}
+	score, err := strconv.ParseFloat(string(data[1:1+length]), 64)
+	return score, 1 + length, err
+}
+
+// Parses a value in one of the packed encodings: elements, fields and values, or members and
+// scores, all in one ziplist, listpack or intset.
+func _parseRDB_Packed(data []byte, valueType byte) (*RedisObject, int, error) {
+	packed, index, err := decodeStringEncoding(data)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var elements []string
+	switch valueType {
+	case valueTypeSetIntset:
+		elements, err = decodeIntset([]byte(packed))
+	case valueTypeListZiplist, valueTypeZSetZiplist, valueTypeHashZiplist:
+		elements, err = decodeZiplist([]byte(packed))
+	default:
+		elements, err = decodeListpack([]byte(packed))
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	plainType := map[byte]byte{
+		valueTypeListZiplist: valueTypeList,
+		valueTypeSetIntset:   valueTypeSet, valueTypeSetListpack: valueTypeSet,
+		valueTypeHashZiplist: valueTypeHash, valueTypeHashListpack: valueTypeHash,
+		valueTypeZSetZiplist: valueTypeZSet2, valueTypeZSetListpack: valueTypeZSet2,
+	}[valueType]
+	if (plainType == valueTypeHash || plainType == valueTypeZSet2) && len(elements)%2 != 0 {
+		return nil, 0, fmt.Errorf("odd number of elements in a packed hash or sorted set")
+	}
+
+	var scores []float64
+	if plainType == valueTypeZSet2 {
+		members := make([]string, 0, len(elements)/2)
+		for i := 0; i < len(elements); i += 2 {
+			score, err := strconv.ParseFloat(elements[i+1], 64)
+			if err != nil {
+				return nil, 0, fmt.Errorf("bad score in a packed sorted set: %q", elements[i+1])
+			}
+			members, scores = append(members, elements[i]), append(scores, score)
+		}
+		elements = members
+	}
+	return _newRDB_Object(plainType, elements, scores), index, nil
+}
+
+// Parses a list saved as a quicklist.
+func _parseRDB_Quicklist(data []byte, valueType byte) (*RedisObject, int, error) {
+	nodes, index, _, err := decodeSizeEncoding(data)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	elements := make([]string, 0)
+	for i := 0; i < nodes; i++ {
+		container := quicklistNodePacked
+		if valueType == valueTypeListQuicklist2 {
+			var indexOffset int
+			container, indexOffset, _, err = decodeSizeEncoding(data[index:])
+			if err != nil {
+				return nil, 0, err
+			}
+			index += indexOffset
+		}
+		node, indexOffset, err := decodeStringEncoding(data[index:])
+		if err != nil {
+			return nil, 0, err
+		}
+		index += indexOffset
+
+		var nodeElements []string
+		switch {
+		case container == quicklistNodePlain:
+			nodeElements = []string{node}
+		case valueType == valueTypeListQuicklist:
+			nodeElements, err = decodeZiplist([]byte(node))
+		default:
+			nodeElements, err = decodeListpack([]byte(node))
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		elements = append(elements, nodeElements...)
+	}
+	return _newRDB_Object(valueTypeList, elements, nil), index, nil
+}
+
+// Builds the object of a value read from the rdb, out of its elements (fields and values for
+// hashes, members and their scores for sorted sets). valueType is one of the plain types.
+func _newRDB_Object(valueType byte, elements []string, scores []float64) *RedisObject {
+	size := len(elements)
+	var obj *RedisObject
+	switch valueType {
+	case valueTypeList:
+		obj = newObject(objList, &RedisList{elements: elements})
+	case valueTypeSet:
+		set := make(RedisSet, size)
+		for _, member := range elements {
+			set[member] = struct{}{}
+		}
+		obj = newObject(objSet, set)
+	case valueTypeHash:
+		hash := make(RedisHash, size)
+		for i := 0; i < len(elements); i += 2 {
+			hash[elements[i]] = elements[i+1]
+		}
+		obj = newObject(objHash, hash)
+	case valueTypeZSet2:
+		zset := &RedisSortedSet{scores: make(map[string]float64, size)}
+		for i, member := range elements {
+			zset.scores[member] = scores[i]
+		}
+		obj = newObject(objZSet, zset)
+	}
+	return obj
+}
+
+// Parses a stream. Consumer groups are read past, there are none on this server.
+func _parseRDB_Stream(data []byte, valueType byte) (*RedisObject, int, error) {
+	nodes, index, _, err := decodeSizeEncoding(data)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	stream := &RedisStream{entries: map[string]*StreamEntry{}}
+	for i := 0; i < nodes; i++ {
+		masterID, indexOffset, err := decodeStringEncoding(data[index:])
+		if err != nil {
+			return nil, 0, err
+		}
+		index += indexOffset
+		lp, indexOffset, err := decodeStringEncoding(data[index:])
+		if err != nil {
+			return nil, 0, err
+		}
+		index += indexOffset
+
+		if len(masterID) != 16 {
+			return nil, 0, fmt.Errorf("stream node key is not a stream id")
+		}
+		elements, err := decodeListpack([]byte(lp))
+		if err != nil {
+			return nil, 0, err
+		}
+		if err := _parseRDB_StreamNode(stream, []byte(masterID), elements); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	// Length and last id, then for the newer types the first id, max deleted entry id and
+	// entries added. Our last id is the one of the last entry, all of them are left out.
+	metadata := 3
+	if valueType != valueTypeStreamListpacks {
+		metadata = 8
+	}
+	indexOffset, err := _skipRDB_Sizes(data[index:], metadata)
+	if err != nil {
+		return nil, 0, err
+	}
+	index += indexOffset
+
+	groups, indexOffset, _, err := decodeSizeEncoding(data[index:])
+	if err != nil {
+		return nil, 0, err
+	}
+	index += indexOffset
+	for i := 0; i < groups; i++ {
+		indexOffset, err := _skipRDB_StreamGroup(data[index:], valueType)
+		if err != nil {
+			return nil, 0, err
+		}
+		index += indexOffset
+	}
+	return newObject(objStream, stream), index, nil
+}
+
+// Adds the entries of a stream node to the stream. The listpack starts with the master entry:
+// number of live and deleted entries, the fields of the first entry, and a 0. Each entry then
+// has its flags, its id as a difference to the master id, its fields and values (only the
+// values with streamItemSameFields), and its number of elements, for iterating backwards.
+func _parseRDB_StreamNode(stream *RedisStream, masterID []byte, elements []string) error {
+	masterMs, masterSeq := binary.BigEndian.Uint64(masterID), binary.BigEndian.Uint64(masterID[8:])
+
+	index := 0
+	var err error
+	nextInt := func() int64 {
+		if err != nil || index >= len(elements) {
+			err = errListpackCorrupt
+			return 0
+		}
+		n, parseErr := strconv.ParseInt(elements[index], 10, 64)
+		if parseErr != nil {
+			err = errListpackCorrupt
+		}
+		index++
+		return n
+	}
+	nextStrings := func(n int64) []string {
+		if err != nil || n < 0 || n > int64(len(elements)-index) {
+			err = errListpackCorrupt
+			return nil
+		}
+		index += int(n)
+		return elements[index-int(n) : index]
+	}
+
+	nextInt() // live entries
+	nextInt() // deleted entries
+	masterFields := nextStrings(nextInt())
+	nextInt() // end of the master entry
+
+	for err == nil && index < len(elements) {
+		flags := nextInt()
+		ms := masterMs + uint64(nextInt())
+		seq := masterSeq + uint64(nextInt())
+		fields, values := masterFields, []string(nil)
+		if flags&streamItemSameFields != 0 {
+			values = nextStrings(int64(len(masterFields)))
+		} else {
+			pairs := nextStrings(2 * nextInt())
+			fields, values = make([]string, 0, len(pairs)/2), make([]string, 0, len(pairs)/2)
+			for i := 0; i+1 < len(pairs); i += 2 {
+				fields, values = append(fields, pairs[i]), append(values, pairs[i+1])
+			}
+		}
+		nextInt() // number of elements of the entry
+		if err != nil || flags&streamItemDeleted != 0 {
+			continue
+		}
+
+		id := fmt.Sprintf("%d-%d", ms, seq)
+		entry := &StreamEntry{id: id, fields: make(map[string]string, len(fields)), keys: slices.Clone(fields)}
+		for i, field := range fields {
+			entry.fields[field] = values[i]
+		}
+		stream.entries[id] = entry
+		stream.entryOrder = append(stream.entryOrder, id)
+	}
+	return err
+}
+
+// Reads past a consumer group: name, last delivered id, entries read (newer types), pending
+// entries (raw 128 bit id, delivery time, delivery count), then the consumers: name, seen time,
+// active time (redis 7.2), and their pending entries as raw ids.
+func _skipRDB_StreamGroup(data []byte, valueType byte) (int, error) {
+	_, index, err := decodeStringEncoding(data)
+	if err != nil {
+		return 0, err
+	}
+	lastID := 2
+	if valueType != valueTypeStreamListpacks {
+		lastID = 3
+	}
+	indexOffset, err := _skipRDB_Sizes(data[index:], lastID)
+	if err != nil {
+		return 0, err
+	}
+	index += indexOffset
+
+	pending, indexOffset, _, err := decodeSizeEncoding(data[index:])
+	if err != nil {
+		return 0, err
+	}
+	index += indexOffset
+	for i := 0; i < pending; i++ {
+		index += 16 + 8
+		if index > len(data) {
+			return 0, errRDBTruncated
+		}
+		indexOffset, err := _skipRDB_Sizes(data[index:], 1)
+		if err != nil {
+			return 0, err
+		}
+		index += indexOffset
+	}
+
+	consumers, indexOffset, _, err := decodeSizeEncoding(data[index:])
+	if err != nil {
+		return 0, err
+	}
+	index += indexOffset
+	for i := 0; i < consumers; i++ {
+		_, indexOffset, err := decodeStringEncoding(data[index:])
+		if err != nil {
+			return 0, err
+		}
+		index += indexOffset + 8
+		if valueType == valueTypeStreamListpacks3 {
+			index += 8
+		}
+		if index > len(data) {
+			return 0, errRDBTruncated
+		}
+		pending, indexOffset, _, err := decodeSizeEncoding(data[index:])
+		if err != nil {
+			return 0, err
+		}
+		index += indexOffset
+		if pending < 0 || pending > (len(data)-index)/16 {
+			return 0, errRDBTruncated
+		}
+		index += 16 * pending
+	}
+	return index, nil
+}
+
+// Reads past n size encoded values.
+func _skipRDB_Sizes(data []byte, n int) (int, error) {
+	index := 0
+	for i := 0; i < n; i++ {
+		_, indexOffset, _, err := decodeSizeEncoding(data[index:])
+		if err != nil {
+			return 0, err
+		}
+		index += indexOffset
+	}
+	return index, nil
+}
+
+// Encodes every database into rdb format. Used for SAVE, and to send the dataset over to
+// replicas on a full resync. Each non empty database gets a section of its own.
+func encodeRDB(rdb RedisRDB) []byte {
+	return bytes.Join(encodeRDBChunks(rdb), nil)
+}
+
+// encodeRDB, in pieces: the header, then one piece per key (the first key of a database
+// carries the database section header), then the end of file. All of it is encoded upfront,
+// full resyncs only pace the sending of the pieces (see rdb-key-save-delay).
+func encodeRDBChunks(rdb RedisRDB) [][]byte {
+	data := []byte("REDIS" + rdbVersion)
+	data = _encodeRDB_Aux(data, "redis-ver", redisVersion)
+	data = _encodeRDB_Aux(data, "redis-bits", "64")
+	data = _encodeRDB_Aux(data, "ctime", strconv.FormatInt(time.Now().Unix(), 10))
+	if CONFIG.isSlave {
+		// Where our master's stream is at, for sub-replicas picking it up right after the snapshot.
+		data = _encodeRDB_Aux(data, "repl-stream-db", strconv.Itoa(masterStreamDB()))
+	}
+
+	chunks := [][]byte{data}
+	data = nil
+
+	now := time.Now()
+	for _, db := range rdb.databases {
+		keys, expires := 0, 0
+		for _, obj := range db.keys {
+			if obj.expires && !obj.expiresAt.After(now) {
+				continue // already expired, no point saving it
+			}
+			keys++
+			if obj.expires {
+				expires++
+			}
+		}
+		if keys == 0 {
+			continue
+		}
+
+		data = append(data, opCodeSelectDB)
+		data = encodeSizeEncoding(data, db.id)
+		data = append(data, opCodeResizeDB)
+		data = encodeSizeEncoding(data, keys)
+		data = encodeSizeEncoding(data, expires)
+
+		for key, obj := range db.keys {
+			if obj.expires {
+				if !obj.expiresAt.After(now) {
+					continue
+				}
+				data = append(data, opCodeExpireTimeMs)
+				data = binary.LittleEndian.AppendUint64(data, uint64(obj.expiresAt.UnixMilli()))
+			}
+			chunks = append(chunks, _encodeRDB_KeyValue(data, key, obj))
+			data = nil
+		}
+	}
+
+	// End of file, followed by the 8 byte checksum. A zero checksum means it's not computed,
+	// loaders skip checking it.
+	data = append(data, opCodeEOF)
+	return append(chunks, append(data, 0, 0, 0, 0, 0, 0, 0, 0))
+}
+
+// Appends the value type, key and value of the object to the rdb data.
+func _encodeRDB_KeyValue(data []byte, key string, obj *RedisObject) []byte {
+	switch value := obj.value.(type) {
+	case string:
+		data = append(data, valueTypeString)
+		data = encodeStringEncoding(data, key)
+		return encodeStringEncoding(data, value)
+
+	case *RedisList:
+		data = append(data, valueTypeList)
+		data = encodeStringEncoding(data, key)
+		data = encodeSizeEncoding(data, len(value.elements))
+		for _, element := range value.elements {
+			data = encodeStringEncoding(data, element)
+		}
+
+	case RedisSet:
+		data = append(data, valueTypeSet)
+		data = encodeStringEncoding(data, key)
+		data = encodeSizeEncoding(data, len(value))
+		for member := range value {
+			data = encodeStringEncoding(data, member)
+		}
+
+	case RedisHash:
+		data = append(data, valueTypeHash)
+		data = encodeStringEncoding(data, key)
+		data = encodeSizeEncoding(data, len(value))
+		for field, fieldValue := range value {
+			data = encodeStringEncoding(data, field)
+			data = encodeStringEncoding(data, fieldValue)
+		}
+
+	case *RedisSortedSet:
+		data = append(data, valueTypeZSet2)
+		data = encodeStringEncoding(data, key)
+		data = encodeSizeEncoding(data, len(value.scores))
+		for _, member := range value.sortedMembers() {
+			data = encodeStringEncoding(data, member)
+			data = binary.LittleEndian.AppendUint64(data, math.Float64bits(value.scores[member]))
+		}
+
+	case *RedisStream:
+		data = append(data, valueTypeStreamListpacks)
+		data = encodeStringEncoding(data, key)
+		data = _encodeRDB_Stream(data, value)
+	}
+	return data
+}
+
+// Appends the stream in nodes of up to streamNodeMaxEntries entries, each node's master entry
+// having the fields of its first entry (see _parseRDB_StreamNode). No consumer groups.
+func _encodeRDB_Stream(data []byte, stream *RedisStream) []byte {
+	data = encodeSizeEncoding(data, (len(stream.entryOrder)+streamNodeMaxEntries-1)/streamNodeMaxEntries)
+	for start := 0; start < len(stream.entryOrder); start += streamNodeMaxEntries {
+		ids := stream.entryOrder[start:min(start+streamNodeMaxEntries, len(stream.entryOrder))]
+		master := stream.entries[ids[0]]
+		masterMs, masterSeq := _splitStreamID(ids[0])
+		masterID := binary.BigEndian.AppendUint64(nil, masterMs)
+		data = encodeStringEncoding(data, string(binary.BigEndian.AppendUint64(masterID, masterSeq)))
+
+		lp := newListpackWriter()
+		lp.appendInt(int64(len(ids)))
+		lp.appendInt(0) // deleted entries
+		lp.appendInt(int64(len(master.keys)))
+		for _, field := range master.keys {
+			lp.appendString(field)
+		}
+		lp.appendInt(0) // end of the master entry
+
+		for _, id := range ids {
+			entry := stream.entries[id]
+			ms, seq := _splitStreamID(id)
+			sameFields := slices.Equal(entry.keys, master.keys)
+			if sameFields {
+				lp.appendInt(streamItemSameFields)
+			} else {
+				lp.appendInt(0)
+			}
+			lp.appendInt(int64(ms - masterMs))
+			lp.appendInt(int64(seq - masterSeq))
+			if sameFields {
+				for _, field := range entry.keys {
+					lp.appendString(entry.fields[field])
+				}
+				lp.appendInt(int64(len(entry.keys) + 3))
+				continue
+			}
+			lp.appendInt(int64(len(entry.keys)))
+			for _, field := range entry.keys {
+				lp.appendString(field)
+				lp.appendString(entry.fields[field])
+			}
+			lp.appendInt(int64(2*len(entry.keys) + 4))
+		}
+		data = encodeStringEncoding(data, string(lp.bytes()))
+	}
+
+	var lastMs, lastSeq uint64
+	if len(stream.entryOrder) > 0 {
+		lastMs, lastSeq = _splitStreamID(stream.entryOrder[len(stream.entryOrder)-1])
+	}
+	data = encodeSizeEncoding(data, len(stream.entryOrder))
+	data = encodeSizeEncoding(data, int(lastMs))
+	data = encodeSizeEncoding(data, int(lastSeq))
+	return encodeSizeEncoding(data, 0) // consumer groups
+}
+
+// Splits a stream id into its milliseconds and sequence number.
+func _splitStreamID(id string) (ms uint64, seq uint64) {
+	msPart, seqPart, _ := strings.Cut(id, "-")
+	ms, _ = strconv.ParseUint(msPart, 10, 64)
+	seq, _ = strconv.ParseUint(seqPart, 10, 64)
+	return ms, seq
+}
+
+// Appends an auxiliary field to the rdb data.
+func _encodeRDB_Aux(data []byte, key string, value string) []byte {
+	data = append(data, opCodeAux)
+	data = encodeStringEncoding(data, key)
+	return encodeStringEncoding(data, value)
+}
+
+// Appends the size-encoded value to data.
+func encodeSizeEncoding(data []byte, size int) []byte {
+	switch {
+	case size < 1<<6:
+		return append(data, byte(size))
+	case size < 1<<14:
+		return append(data, byte(size>>8)|sizeEncoding_14bits<<6, byte(size))
+	case size <= 0xFFFFFFFF:
+		data = append(data, 0x80)
+		return binary.BigEndian.AppendUint32(data, uint32(size))
+	}
+	data = append(data, 0x81)
+	return binary.BigEndian.AppendUint64(data, uint64(size))
+}
 
-	// Decode the hex representation of an empty rdb (until we write the encoding for the actual store here.)
-	emptyDB, _ := hex.DecodeString("524544495330303131fa0972656469732d76657205372e322e30fa0a72656469732d62697473c040fa056374696d65c26d08bc65fa08757365642d6d656dc2b0c41000fa08616f662d62617365c000fff06e3bfec0ff5aa2")
-	return emptyDB
+// Appends the string to data, as a length prefixed string.
+func encodeStringEncoding(data []byte, str string) []byte {
+	data = encodeSizeEncoding(data, len(str))
+	return append(data, str...)
 }
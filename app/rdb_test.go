@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// A full sync replaces the dataset with the master's snapshot, streams included: entries,
+// their order and the order of their fields survive the trip.
+func TestLoadRDBKeepsStreams(t *testing.T) {
+	CONFIG.databases = 2
+	master := RedisRDB{databases: []*RedisDatabase{newDatabase(0), newDatabase(1)}}
+	stream := &RedisStream{entries: map[string]*StreamEntry{}}
+	for _, entry := range []*StreamEntry{
+		{id: "1-1", fields: map[string]string{"b": "2", "a": "1"}, keys: []string{"b", "a"}},
+		{id: "1-2", fields: map[string]string{"c": "3"}, keys: []string{"c"}},
+		{id: "5-0", fields: map[string]string{}, keys: []string{}},
+	} {
+		stream.entries[entry.id] = entry
+		stream.entryOrder = append(stream.entryOrder, entry.id)
+	}
+	master.databases[1].setKey("events", newObject(objStream, stream))
+	master.databases[0].setKey("plain", newStringObject("value"))
+
+	RDB = RedisRDB{databases: []*RedisDatabase{newDatabase(0), newDatabase(1)}}
+	RDB.databases[1].setKey("stale", newStringObject("gone after the sync"))
+	if err := loadRDB(encodeRDB(master)); err != nil {
+		t.Fatalf("loadRDB: %v", err)
+	}
+
+	if _, exists := RDB.databases[1].keys["stale"]; exists {
+		t.Errorf("key of the replica survived the full sync")
+	}
+	obj, exists := RDB.databases[1].keys["events"]
+	if !exists || obj.objType != objStream {
+		t.Fatalf("stream missing after the full sync")
+	}
+	loaded := obj.value.(*RedisStream)
+	if len(loaded.entryOrder) != 3 || loaded.entryOrder[0] != "1-1" || loaded.entryOrder[2] != "5-0" {
+		t.Errorf("entry order %v, want [1-1 1-2 5-0]", loaded.entryOrder)
+	}
+	first := loaded.entries["1-1"]
+	if len(first.keys) != 2 || first.keys[0] != "b" || first.fields["a"] != "1" || first.fields["b"] != "2" {
+		t.Errorf("first entry %+v, want fields b=2 a=1 in that order", first)
+	}
+	if RDB.databases[0].keys["plain"] == nil {
+		t.Errorf("string key missing after the full sync")
+	}
+}
+
+// Listpacks as redis writes them, every integer width included.
+func TestDecodeListpack(t *testing.T) {
+	lp := []byte{41, 0, 0, 0, 7, 0,
+		0x05, 1, // 5
+		0xDF, 0xFF, 2, // -1, 13 bit
+		0x82, 'a', 'b', 3, // "ab"
+		0xF1, 0xE8, 0x03, 3, // 1000, 16 bit
+		0xF2, 0x60, 0x79, 0xFE, 4, // -100000, 24 bit
+		0xF3, 0x00, 0xE1, 0xF5, 0x05, 5, // 100000000, 32 bit
+		0xF4, 0xFB, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 9, // -5, 64 bit
+		0xFF}
+	elements, err := decodeListpack(lp)
+	want := []string{"5", "-1", "ab", "1000", "-100000", "100000000", "-5"}
+	if err != nil || strings.Join(elements, ",") != strings.Join(want, ",") {
+		t.Errorf("decodeListpack = %v, %v, want %v", elements, err, want)
+	}
+
+	writer := newListpackWriter()
+	for _, str := range []string{"", "short", strings.Repeat("x", 100), strings.Repeat("y", 5000)} {
+		writer.appendString(str)
+	}
+	for _, n := range []int64{0, 127, 128, -4096, 4095, 4096, -1 << 63} {
+		writer.appendInt(n)
+	}
+	elements, err = decodeListpack(writer.bytes())
+	want = []string{"", "short", strings.Repeat("x", 100), strings.Repeat("y", 5000), "0", "127", "128", "-4096", "4095", "4096", "-9223372036854775808"}
+	if err != nil || strings.Join(elements, ",") != strings.Join(want, ",") {
+		t.Errorf("written listpack decodes to %.80v, %v", elements, err)
+	}
+}
+
+// Streams longer than a node, with entries that don't share the fields of their node's first
+// entry, and ids far apart.
+func TestStreamNodes(t *testing.T) {
+	stream := &RedisStream{entries: map[string]*StreamEntry{}}
+	for i := 0; i < 250; i++ {
+		id := fmt.Sprintf("%d-%d", 1700000000000+i*i*1000, i%3)
+		entry := &StreamEntry{id: id, fields: map[string]string{"n": strconv.Itoa(i)}, keys: []string{"n"}}
+		if i%7 == 0 {
+			entry.fields["extra"] = strings.Repeat("v", i)
+			entry.keys = append(entry.keys, "extra")
+		}
+		stream.entries[id] = entry
+		stream.entryOrder = append(stream.entryOrder, id)
+	}
+
+	data := _encodeRDB_KeyValue(nil, "s", newObject(objStream, stream))
+	if data[0] != valueTypeStreamListpacks {
+		t.Fatalf("stream saved with value type 0x%x", data[0])
+	}
+	_, keyLength, _ := decodeStringEncoding(data[1:])
+	obj, size, err := _parseRDB_Value(data[1+keyLength:], data[0])
+	if err != nil || size != len(data)-1-keyLength {
+		t.Fatalf("_parseRDB_Value: %v (read %d of %d bytes)", err, size, len(data)-1-keyLength)
+	}
+	loaded := obj.value.(*RedisStream)
+	if !slices.Equal(loaded.entryOrder, stream.entryOrder) {
+		t.Fatalf("got %d entries back, want %d in the same order", len(loaded.entryOrder), len(stream.entryOrder))
+	}
+	for _, id := range stream.entryOrder {
+		if want, got := stream.entries[id], loaded.entries[id]; !slices.Equal(got.keys, want.keys) || !maps.Equal(got.fields, want.fields) {
+			t.Errorf("entry %s: got %v, want %v", id, got.fields, want.fields)
+		}
+	}
+}
+
+// Values in the packed encodings redis saves small values with.
+func TestParsePackedValues(t *testing.T) {
+	ziplist := []byte{24, 0, 0, 0, 20, 0, 0, 0, 4, 0,
+		0, 0x02, 'a', 'b', // "ab"
+		4, 0xF6, // 5, in the encoding
+		2, 0xC0, 0xE8, 0x03, // 1000, 16 bit
+		4, 0xFE, 0xFE, // -2, 8 bit
+		0xFF}
+	intset := []byte{2, 0, 0, 0, 3, 0, 0, 0, 0xFF, 0xFF, 5, 0, 0x2C, 0x01}
+
+	hash := newListpackWriter()
+	hash.appendString("field")
+	hash.appendString("value")
+	hash.appendString("n")
+	hash.appendInt(-7)
+	zset := newListpackWriter()
+	zset.appendString("a")
+	zset.appendString("1.5")
+	zset.appendString("b")
+	zset.appendInt(3)
+	node := newListpackWriter()
+	node.appendString("x")
+	node.appendInt(1)
+
+	quicklist := encodeSizeEncoding(nil, 2)
+	quicklist = encodeSizeEncoding(quicklist, quicklistNodePacked)
+	quicklist = encodeStringEncoding(quicklist, string(node.bytes()))
+	quicklist = encodeSizeEncoding(quicklist, quicklistNodePlain)
+	quicklist = encodeStringEncoding(quicklist, strings.Repeat("big", 10))
+
+	tests := []struct {
+		valueType byte
+		data      []byte
+		want      string
+	}{
+		{valueTypeListZiplist, encodeStringEncoding(nil, string(ziplist)), "[ab 5 1000 -2]"},
+		{valueTypeSetIntset, encodeStringEncoding(nil, string(intset)), "map[-1:{} 300:{} 5:{}]"},
+		{valueTypeHashListpack, encodeStringEncoding(nil, string(hash.bytes())), "map[field:value n:-7]"},
+		{valueTypeZSetListpack, encodeStringEncoding(nil, string(zset.bytes())), "map[a:1.5 b:3]"},
+		{valueTypeListQuicklist2, quicklist, "[x 1 " + strings.Repeat("big", 10) + "]"},
+	}
+	for _, test := range tests {
+		obj, size, err := _parseRDB_Value(test.data, test.valueType)
+		if err != nil || size != len(test.data) {
+			t.Errorf("type 0x%x: %v (read %d of %d bytes)", test.valueType, err, size, len(test.data))
+			continue
+		}
+		var got string
+		switch value := obj.value.(type) {
+		case *RedisList:
+			got = fmt.Sprint(value.elements)
+		case *RedisSortedSet:
+			got = fmt.Sprint(value.scores)
+		default:
+			got = fmt.Sprint(value)
+		}
+		if got != test.want {
+			t.Errorf("type 0x%x: got %s, want %s", test.valueType, got, test.want)
+		}
+	}
+}
@@ -1,85 +1,612 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"net"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// States of the link to our master. A replica goes connect -> connecting -> handshake ->
+// transfer (full syncs only) -> connected, and back to connect whenever something fails or
+// the link drops.
+const (
+	replStateNone       = iota // not a replica
+	replStateConnect           // has to connect to the master (waiting for the next attempt)
+	replStateConnecting        // dialing the master
+	replStateHandshake         // PING, REPLCONF and PSYNC
+	replStateTransfer          // receiving the rdb of a full sync
+	replStateConnected         // receiving the replication stream
+)
+
+// Time the master has to answer each step of the handshake (repl-timeout).
+const replTimeout = 60 * time.Second
+
+// How often replicas send REPLCONF ACK to their master.
+const replAckInterval = time.Second
+
+// Delay before reconnecting to the master, doubled after every failed attempt up to the max.
+const (
+	replRetryMinDelay = 1 * time.Second
+	replRetryMaxDelay = 30 * time.Second
+)
+
+// Wakes the replication loop up when the master changes (REPLICAOF), instead of it waiting
+// for the next retry, or for this server to become a replica at all.
+var replicationWakeup = make(chan struct{}, 1)
+
+// Returned when the handshake is given up on because the master changed meanwhile.
+var errReplicationCanceled = fmt.Errorf("the master changed")
+
+// Keeps this server linked to its master, whenever it has one: connects, syncs, and then applies
+// the replication stream until the link drops. Failed attempts are retried with an increasing
+// delay. Runs for the whole life of the server, masters just have it waiting for a REPLICAOF.
+func replicationLoop() {
+	delay := replRetryMinDelay
+	for {
+		executionLock.Lock()
+		isSlave, host, port := CONFIG.isSlave, CONFIG.masterHost, CONFIG.masterPort
+		executionLock.Unlock()
+		if !isSlave {
+			<-replicationWakeup
+			delay = replRetryMinDelay
+			continue
+		}
+
+		conn, err := connectToMaster(host, port)
+		if err == errReplicationCanceled {
+			continue
+		}
+		if err != nil {
+			fmt.Printf("Replication with master failed: %v. Retrying in %v...\n", err, delay)
+			executionLock.Lock()
+			if CONFIG.failover.state == failoverInProgress {
+				abortFailover("Failover target rejected psync request")
+			}
+			executionLock.Unlock()
+			setReplicationState(replStateConnect)
+			select {
+			case <-time.After(delay):
+				delay = min(delay*2, replRetryMaxDelay)
+			case <-replicationWakeup:
+				delay = replRetryMinDelay
+			}
+			continue
+		}
+		delay = replRetryMinDelay
+
+		executionLock.Lock()
+		if CONFIG.masterHandshakeConn != conn {
+			executionLock.Unlock()
+			conn.Close()
+			continue
+		}
+		CONFIG.masterHandshakeConn = nil
+		CONFIG.masterConn = conn
+		CONFIG.replState = replStateConnected
+		CONFIG.masterLastIO = time.Now()
+		executionLock.Unlock()
+
+		linkDown := make(chan struct{})
+		go sendPeriodicAcks(conn, linkDown)
+		handleConnection(conn, true) // until the link drops
+		close(linkDown)
+		fmt.Println("Connection with master lost.")
+
+		executionLock.Lock()
+		CONFIG.masterConn = nil
+		if CONFIG.isSlave {
+			CONFIG.replState = replStateConnect
+			CONFIG.masterLinkDownSince = time.Now()
+		}
+		executionLock.Unlock()
+	}
+}
+
+// Lets the master know how far along the replication stream we are, every replAckInterval
+// until the link drops. That's what WAIT (and the replica lag the master reports) goes by.
+func sendPeriodicAcks(conn net.Conn, linkDown <-chan struct{}) {
+	ticker := time.NewTicker(replAckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-linkDown:
+			return
+		case <-ticker.C:
+			executionLock.Lock()
+			ack := respEncodeStringArray([]string{"REPLCONF", "ACK", strconv.Itoa(CONFIG.masterReplOffset)})
+			executionLock.Unlock()
+			conn.Write([]byte(ack))
+		}
+	}
+}
+
+// Moves the link to the master along. Does nothing if this server isn't a replica (anymore).
+func setReplicationState(state int) {
+	executionLock.Lock()
+	defer executionLock.Unlock()
+	if CONFIG.isSlave {
+		CONFIG.replState = state
+	}
+}
+
+// Returns true if conn is no longer the connection the handshake is being made on: REPLICAOF
+// changed the master (or promoted this server) meanwhile. Has to be called with the lock held.
+func _handshakeCanceled(conn net.Conn) bool {
+	return CONFIG.masterHandshakeConn != conn
+}
+
 // Sets up a connection to the master server and performs the replication handshake.
-//   Returns the connection to the master.
-func connectToMaster() net.Conn {
-	address := fmt.Sprintf("%s:%s", CONFIG.masterHost, CONFIG.masterPort)
-	masterConn, err := net.Dial("tcp", address)
+//
+//	Returns the connection to the master, ready for the replication stream.
+func connectToMaster(host, port string) (net.Conn, error) {
+	setReplicationState(replStateConnecting)
+	address := net.JoinHostPort(host, port)
+	masterConn, err := net.DialTimeout("tcp", address, replTimeout)
 	if err != nil {
-		logAndExit("error sending handshake to master: cannot establish dialup with the master", err)
+		return nil, fmt.Errorf("cannot establish dialup with the master: %w", err)
 	}
 
-	sendHandshake(masterConn)
-	return masterConn
+	executionLock.Lock()
+	if !CONFIG.isSlave || CONFIG.masterHost != host || CONFIG.masterPort != port {
+		executionLock.Unlock()
+		masterConn.Close()
+		return nil, errReplicationCanceled
+	}
+	CONFIG.masterHandshakeConn = masterConn
+	executionLock.Unlock()
+
+	if err := sendHandshake(masterConn); err != nil {
+		masterConn.Close()
+		return nil, err
+	}
+	masterConn.SetDeadline(time.Time{})
+	return masterConn, nil
 }
 
 // Performs the handshake steps to the master on the given connection.
 func sendHandshake(conn net.Conn) error {
 	fmt.Println("Establishing handshake with master...")
-	
-	_handshakeSendPing(conn, []string{"PING"}, "PONG")
+	setReplicationState(replStateHandshake)
+
+	if err := _handshakeSendPing(conn); err != nil {
+		return err
+	}
 	_handshakeSendReplConf(conn, "listening-port", fmt.Sprintf("%d", CONFIG.port))
-	_handshakeSendReplConf(conn, "capa", "psync2")
-	_handshakeSendPsync(conn)
+	_handshakeSendReplConf(conn, "capa", "eof", "capa", "psync2") // eof: we can load diskless transfers
+	if err := _handshakeSendPsync(conn); err != nil {
+		return err
+	}
 
 	fmt.Println("Handshake Established.")
 	return nil
 }
 
+// Sends a handshake request, and reads the single line reply to it. Replies starting with '-'
+// come back as errors.
+func _handshakeRequest(conn net.Conn, request []string) (string, error) {
+	conn.SetDeadline(time.Now().Add(replTimeout))
+	if _, err := conn.Write([]byte(respEncodeStringArray(request))); err != nil {
+		return "", fmt.Errorf("error sending %s to master: %w", request[0], err)
+	}
+	line, err := _readReplicationLine(conn)
+	if err != nil {
+		return "", fmt.Errorf("error reading %s reply from master: %w", request[0], err)
+	}
+	if strings.HasPrefix(line, "-") {
+		return line, fmt.Errorf("error reply to %s from master: %s", request[0], line[1:])
+	}
+	return line, nil
+}
 
-func _handshakeSendPing(conn net.Conn, command []string, expectedResponse string) {
-	conn.Write([]byte(respEncodeStringArray(command)))
-	time.Sleep(10 * time.Millisecond)
+// Reads a single line (without the \r\n) from the master. Byte by byte, so nothing that comes
+// after it (the rdb, the replication stream) is read along by mistake.
+func _readReplicationLine(conn net.Conn) (string, error) {
+	line := make([]byte, 0, 64)
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			break
+		}
+		line = append(line, b[0])
+	}
+	return strings.TrimSuffix(string(line), "\r"), nil
+}
 
-	responseBuffer := make([]byte, 1024)
-	_, err := conn.Read(responseBuffer)
-	if err != nil {
-		logAndExit("error receiving handshake response from master", err)
+// The master has to reply to PING with +PONG. An auth error still means it's alive and talking.
+func _handshakeSendPing(conn net.Conn) error {
+	line, err := _handshakeRequest(conn, []string{"PING"})
+	if err != nil && !strings.HasPrefix(line, "-NOAUTH") {
+		return err
 	}
+	if err == nil && line != "+PONG" {
+		return fmt.Errorf("unexpected reply to PING from master: %s", line)
+	}
+	return nil
+}
 
-	response, err := _parseRESP(responseBuffer)
-	if err != nil || response.respData.String != expectedResponse {
-		logAndExit(fmt.Sprintf("error receiving handshake response: expected %s", expectedResponse), err)
+// Not understanding REPLCONF is not fatal, the master just won't know about us.
+func _handshakeSendReplConf(conn net.Conn, options ...string) {
+	if _, err := _handshakeRequest(conn, append([]string{"REPLCONF"}, options...)); err != nil {
+		fmt.Println("(Non critical)", err)
 	}
 }
 
-func _handshakeSendReplConf(conn net.Conn, key, value string) {
-	replConfReq := []string{"REPLCONF", key, value}
-	conn.Write([]byte(respEncodeStringArray(replConfReq)))
-	time.Sleep(10 * time.Millisecond)
+// Asks the master to continue the replication stream from where we are, if we synced with it
+// before. Otherwise (or if it can't) the master replies with a full resync, followed by its rdb.
+func _handshakeSendPsync(conn net.Conn) error {
+	executionLock.Lock()
+	psyncReq := []string{"PSYNC", "?", "-1"}
+	if CONFIG.cachedMaster {
+		psyncReq = []string{"PSYNC", CONFIG.masterReplID, strconv.Itoa(CONFIG.masterReplOffset + 1)}
+	}
+	if CONFIG.failover.state == failoverInProgress {
+		psyncReq = append(psyncReq, "FAILOVER") // the target takes over before replying
+	}
+	executionLock.Unlock()
 
-	responseBuffer := make([]byte, 1024)
-	_, err := conn.Read(responseBuffer)
+	line, err := _handshakeRequest(conn, psyncReq)
 	if err != nil {
-		logAndExit("error receiving handshake response from master(replconf)", err)
+		return err
 	}
-	// should also be checking that the response is +OK\r\n, but sometimes the server
-	// will send nothing, and wait to send the entire thing at once. This works for now.
 
-	// fmt.Println("handshake response(replconf):", string(responseBuffer))
+	executionLock.Lock()
+	if _handshakeCanceled(conn) {
+		executionLock.Unlock()
+		return errReplicationCanceled
+	}
+	fullSync, err := _handlePsyncReply(line)
+	offset := CONFIG.masterReplOffset
+	if err == nil && CONFIG.failover.state == failoverInProgress {
+		endFailover()
+	}
+	executionLock.Unlock()
+	if err != nil {
+		return err
+	}
+	if fullSync {
+		if err := _receiveRDBTransfer(conn); err != nil {
+			return err
+		}
+	}
+
+	resp := respEncodeStringArray([]string{"REPLCONF", "ACK", strconv.Itoa(offset)})
+	conn.Write([]byte(resp))
+	return nil
 }
 
-func _handshakeSendPsync(conn net.Conn) {
-	psyncReq := []string{"PSYNC", "?", "-1"}
-	conn.Write([]byte(respEncodeStringArray(psyncReq)))
-	time.Sleep(100 * time.Millisecond)
+// Takes on the replication history the master replied to PSYNC with. Returns true if it's a
+// full resync, the master's rdb comes next.
+func _handlePsyncReply(line string) (bool, error) {
+	fields := strings.Fields(strings.TrimPrefix(line, "+"))
+	if !strings.HasPrefix(line, "+") || len(fields) == 0 {
+		return false, fmt.Errorf("unexpected reply to PSYNC from master: %s", line)
+	}
 
-	responseBuffer := make([]byte, 1024)
-	_, err := conn.Read(responseBuffer)
+	switch strings.ToUpper(fields[0]) {
+	case "FULLRESYNC": // +FULLRESYNC replid offset. Starting over from the master's snapshot.
+		if len(fields) < 3 {
+			return false, fmt.Errorf("invalid FULLRESYNC reply from master: %s", line)
+		}
+		offset, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return false, fmt.Errorf("invalid FULLRESYNC reply from master: %s", line)
+		}
+		CONFIG.masterReplID, CONFIG.masterReplOffset = fields[1], offset
+		clearReplicationID2()
+		CONFIG.replBacklog = newReplicationBacklog(CONFIG.replBacklogSize)
+		CONFIG.cachedMaster = false // not until the rdb made it over
+		CONFIG.masterDB = 0
+		disconnectReplicas() // their data is about to be from an older history, they need a full resync too
+		return true, nil
+
+	case "CONTINUE": // +CONTINUE [replid]. The master might have a new history (failover), ours carries on as its past.
+		if len(fields) >= 2 && fields[1] != CONFIG.masterReplID {
+			CONFIG.masterReplID2 = CONFIG.masterReplID
+			CONFIG.secondReplOffset = CONFIG.masterReplOffset + 1
+			CONFIG.masterReplID = fields[1]
+			disconnectReplicas() // so they learn the new id too, and go on with a partial resync
+		}
+		if CONFIG.replBacklog == nil {
+			CONFIG.replBacklog = newReplicationBacklog(CONFIG.replBacklogSize)
+		}
+		return false, nil
+	}
+	return false, fmt.Errorf("unexpected reply to PSYNC from master: %s", line)
+}
+
+// Receives the rdb the master sends after +FULLRESYNC, and loads it. Whatever comes after it
+// is the replication stream, starting at the offset of the FULLRESYNC reply. The rdb comes
+// either as $<length>\r\n and the rdb itself, without the trailing \r\n of regular bulk
+// strings, or (diskless sync) as $EOF:<mark>\r\n, the rdb, and the mark again.
+func _receiveRDBTransfer(conn net.Conn) error {
+	setReplicationState(replStateTransfer)
+
+	line, err := _readReplicationLine(conn)
 	if err != nil {
-		logAndExit("error receiving handshake response from master", err)
+		return fmt.Errorf("error reading the rdb from master: %w", err)
+	}
+	var data []byte
+	if mark, ok := strings.CutPrefix(line, "$EOF:"); ok && len(mark) == rdbEOFMarkLength {
+		data, err = _readRDBUntilMark(conn, []byte(mark))
+	} else {
+		length, convErr := strconv.Atoi(strings.TrimPrefix(line, "$"))
+		if !strings.HasPrefix(line, "$") || convErr != nil || length < 0 {
+			return fmt.Errorf("invalid rdb transfer header from master: %s", line)
+		}
+		data, err = _readRDBWithLength(conn, length)
+	}
+	if err != nil {
+		return fmt.Errorf("error reading the rdb from master: %w", err)
+	}
+
+	// Our data is replaced by the master's. If the rdb is no good, we keep ours and try again later.
+	executionLock.Lock()
+	defer executionLock.Unlock()
+	if _handshakeCanceled(conn) {
+		return errReplicationCanceled
+	}
+	if !_disklessLoad() {
+		// Saved as our own rdb file first, and loaded from there.
+		if err := writeRDBFile(CONFIG.rdbDir, CONFIG.rdbDbFileName, data); err != nil {
+			return fmt.Errorf("error saving the rdb from master: %w", err)
+		}
+		if data, err = os.ReadFile(CONFIG.rdbDir + "/" + CONFIG.rdbDbFileName); err != nil {
+			return fmt.Errorf("error reading back the rdb from master: %w", err)
+		}
 	}
+	if err := loadRDB(data); err != nil {
+		return fmt.Errorf("error loading the rdb from master: %w", err)
+	}
+	CONFIG.cachedMaster = true
+	return nil
+}
 
-	// should also be checking that the response is the rdb, but sometimes the server
-	// will send nothing, and wait to send the entire thing at once. This works for now.'
+// The rdb of a $<length> transfer. The master might go quiet for a while before sending it,
+// while it produces the whole rdb.
+func _readRDBWithLength(conn net.Conn, length int) ([]byte, error) {
+	conn.SetDeadline(time.Now().Add(replTimeout))
+	data := make([]byte, length)
+	_, err := io.ReadFull(conn, data)
+	return data, err
+}
 
-	// fmt.Println("handshake response (psync):", string(responseBuffer))
-	resp := respEncodeStringArray([]string{"REPLCONF", "ACK", "0"})
-	conn.Write([]byte(resp))
+// The rdb of a diskless transfer, up to the mark that ends it. The master sends nothing past
+// the mark until we ack, so reading ahead doesn't eat into the replication stream.
+func _readRDBUntilMark(conn net.Conn, mark []byte) ([]byte, error) {
+	data := []byte{}
+	buffer := make([]byte, 16*1024)
+	for !bytes.HasSuffix(data, mark) {
+		conn.SetDeadline(time.Now().Add(replTimeout))
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, buffer[:n]...)
+	}
+	return data[:len(data)-len(mark)], nil
+}
+
+// Whether the rdb from the master gets loaded straight from memory (repl-diskless-load), or
+// saved to disk first. on-empty-db only skips the disk with no data of our own to lose.
+func _disklessLoad() bool {
+	switch CONFIG.replDisklessLoad {
+	case "swapdb":
+		return true
+	case "on-empty-db":
+		for _, db := range RDB.databases {
+			if len(db.keys) > 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// REPLICAOF host port, and REPLICAOF NO ONE (SLAVEOF is the same thing). Makes this server a
+// replica of another master, or turns it into a master keeping its dataset.
+func onREPLICAOF(commands []string) ([]string, error) {
+	if CONFIG.failover.state != failoverNone {
+		return []string{respEncodeError("ERR REPLICAOF not allowed while failing over.")}, nil
+	}
+	host, port := commands[1], commands[2]
+	if strings.EqualFold(host, "no") && strings.EqualFold(port, "one") {
+		if CONFIG.isSlave {
+			replicationUnsetMaster()
+			fmt.Println("MASTER MODE enabled")
+		}
+		return []string{respEncodeString("OK")}, nil
+	}
+
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return []string{respEncodeError("ERR Invalid master port")}, nil
+	}
+	if CONFIG.isSlave && CONFIG.masterHost == host && CONFIG.masterPort == port {
+		return []string{respEncodeString("OK Already connected to specified master")}, nil
+	}
+	replicationSetMaster(host, port)
+	fmt.Printf("REPLICAOF %s:%s enabled\n", host, port)
+	return []string{respEncodeString("OK")}, nil
+}
+
+// Makes this server a replica of host:port. The link to the previous master (if any) is dropped,
+// and so are our own replicas, so they sync again.
+func replicationSetMaster(host, port string) {
+	wasMaster := !CONFIG.isSlave
+	CONFIG.isSlave = true
+	CONFIG.masterHost, CONFIG.masterPort = host, port
+	CONFIG.replState = replStateConnect
+	_dropMasterLink()
+	disconnectReplicas()
+
+	// Our own history might be the new master's past (it used to be our replica): PSYNC can try
+	// to continue from it.
+	if wasMaster {
+		CONFIG.cachedMaster = true
+	}
+
+	select {
+	case replicationWakeup <- struct{}{}:
+	default:
+	}
+}
+
+// Turns this replica into a master. It keeps its dataset, and starts a new replication history
+// of its own, the one of its old master still being accepted up to here (see shiftReplicationID).
+func replicationUnsetMaster() {
+	CONFIG.isSlave = false
+	CONFIG.masterHost, CONFIG.masterPort = "", ""
+	CONFIG.replState = replStateNone
+	_dropMasterLink()
+
+	shiftReplicationID()
+	CONFIG.cachedMaster = false
+	CONFIG.replicationDB = -1 // whatever the old master SELECTed, the new stream starts with a SELECT
+	disconnectReplicas()      // they reconnect and continue with our new id
+}
+
+// Database the master's stream SELECTed last: the one of the master client while the link is up.
+func masterStreamDB() int {
+	if client, ok := CONFIG.clients[CONFIG.masterConn]; ok && CONFIG.masterConn != nil {
+		return client.db
+	}
+	return CONFIG.masterDB
+}
+
+// Closes the link to the master, and any handshake in progress. The replication loop notices.
+func _dropMasterLink() {
+	if CONFIG.masterHandshakeConn != nil {
+		CONFIG.masterHandshakeConn.Close()
+		CONFIG.masterHandshakeConn = nil
+	}
+	if CONFIG.masterConn != nil {
+		CONFIG.masterConn.Close()
+	}
+}
+
+// Names ROLE reports the states of the link to the master with.
+var replStateNames = map[int]string{
+	replStateNone:       "none",
+	replStateConnect:    "connect",
+	replStateConnecting: "connecting",
+	replStateHandshake:  "handshake",
+	replStateTransfer:   "sync",
+	replStateConnected:  "connected",
+}
+
+// ROLE. Masters reply with their offset and their replicas, replicas with their master and
+// the state of the link to it, sentinels with the masters they monitor.
+func onROLE(_ []string) ([]string, error) {
+	if CONFIG.sentinelMode {
+		names := []string{}
+		for _, master := range _sentinelMastersByName() {
+			names = append(names, master.name)
+		}
+		return []string{respEncodeArray([]string{respEncodeBulkString("sentinel"), respEncodeStringArray(names)})}, nil
+	}
+	if !CONFIG.isSlave {
+		replicas := make([]string, 0, len(CONFIG.replicas))
+		for _, replica := range CONFIG.replicas {
+			ip, listeningPort := replica.address()
+			replicas = append(replicas, respEncodeStringArray([]string{ip, strconv.Itoa(listeningPort), strconv.Itoa(replica.ackOffset)}))
+		}
+		return []string{respEncodeArray([]string{
+			respEncodeBulkString("master"),
+			respEncodeInteger(CONFIG.masterReplOffset),
+			respEncodeArray(replicas),
+		})}, nil
+	}
+
+	port, _ := strconv.Atoi(CONFIG.masterPort)
+	offset := -1
+	if CONFIG.cachedMaster {
+		offset = CONFIG.masterReplOffset
+	}
+	return []string{respEncodeArray([]string{
+		respEncodeBulkString("slave"),
+		respEncodeBulkString(CONFIG.masterHost),
+		respEncodeInteger(port),
+		respEncodeBulkString(replStateNames[CONFIG.replState]),
+		respEncodeInteger(offset),
+	})}, nil
+}
+
+// Commands a replica still runs while its link to the master is down and replica-serve-stale-data
+// is off: the ones that don't touch the dataset.
+var staleCommands = map[string]struct{}{
+	"ping": {}, "echo": {}, "auth": {}, "hello": {}, "info": {}, "role": {}, "replicaof": {}, "slaveof": {},
+	"config": {}, "client": {}, "command": {}, "acl": {}, "select": {}, "replconf": {},
+	"multi": {}, "exec": {}, "discard": {}, "watch": {}, "unwatch": {},
+	"subscribe": {}, "unsubscribe": {}, "psubscribe": {}, "punsubscribe": {}, "publish": {},
+}
+
+// Checks what a replica can run for the connection: only its master can write to it
+// (replica-read-only), and nothing touching the dataset runs while the link to the master is
+// down, if it's not supposed to serve stale data. Returns the error reply if it can't.
+func replicaCheckRequest(command RedisCommand, commands []string, conn net.Conn) (string, bool) {
+	if !CONFIG.isSlave || isSuperConnection(conn) {
+		return "", true
+	}
+	if CONFIG.replicaReadOnly && commandInCategory(command, "write") {
+		return respEncodeError("READONLY You can't write against a read only replica."), false
+	}
+	if _, allowed := staleCommands[commands[0]]; !allowed && !CONFIG.replicaServeStaleData && CONFIG.replState != replStateConnected {
+		return respEncodeError("MASTERDOWN Link with MASTER is down and replica-serve-stale-data is set to 'no'."), false
+	}
+	return "", true
+}
+
+// Where the replica serves its clients: its ip, and the port it sent with REPLCONF listening-port.
+func (replica *Replica) address() (string, int) {
+	client, exists := CONFIG.clients[replica.conn]
+	if !exists {
+		return "", 0
+	}
+	ip, _, _ := net.SplitHostPort(client.addr)
+	return ip, client.listeningPort
+}
+
+// Seconds since the replica last acknowledged the replication stream.
+func (replica *Replica) lag() int {
+	return int(time.Since(replica.ackTime) / time.Second)
+}
+
+// Number of replicas that acknowledged the stream recently enough (min-replicas-max-lag).
+func countGoodReplicas() int {
+	good := 0
+	for _, replica := range CONFIG.replicas {
+		if replica.state == replicaOnline && replica.lag() <= CONFIG.minReplicasMaxLag {
+			good++
+		}
+	}
+	return good
+}
+
+// Refuses writes while fewer than min-replicas-to-write replicas are good. A master cut off
+// from its replicas stops taking writes it would lose once one of them takes over. EXEC
+// counts as a write if any of the queued commands is one. Returns the error reply if it can't run.
+func minReplicasCheckRequest(command RedisCommand, conn net.Conn) (string, bool) {
+	if CONFIG.isSlave || CONFIG.minReplicasToWrite == 0 || isSuperConnection(conn) {
+		return "", true
+	}
+	isWrite := commandInCategory(command, "write")
+	if command.name == "exec" {
+		for _, queued := range clientTransaction(conn).commandQueue {
+			if queuedCommand, _, ok := lookupCommand(queued); ok && commandInCategory(queuedCommand, "write") {
+				isWrite = true
+			}
+		}
+	}
+	if isWrite && countGoodReplicas() < CONFIG.minReplicasToWrite {
+		return respEncodeError("NOREPLICAS Not enough good replicas to write."), false
+	}
+	return "", true
 }
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"hash/maphash"
+	"math/bits"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// Buckets a ScanIndex starts with (and never shrinks below).
+const scanIndexMinBuckets = 4
+
+// Seed for the ScanIndex hashes. Fixed for the lifetime of the process, so cursors stay valid.
+var scanSeed = maphash.MakeSeed()
+
+// Creates a ScanIndex holding the given strings.
+func newScanIndex(strs []string) *ScanIndex {
+	index := &ScanIndex{buckets: make([][]string, scanIndexMinBuckets)}
+	for _, str := range strs {
+		index.add(str)
+	}
+	return index
+}
+
+func (index *ScanIndex) bucketOf(str string) int {
+	return int(maphash.String(scanSeed, str) & uint64(len(index.buckets)-1))
+}
+
+// Adds the string to the table. It must not be in there already.
+func (index *ScanIndex) add(str string) {
+	if index.size >= len(index.buckets) {
+		index.resize(len(index.buckets) * 2)
+	}
+	bucket := index.bucketOf(str)
+	index.buckets[bucket] = append(index.buckets[bucket], str)
+	index.size++
+}
+
+// Removes the string from the table, if it's there.
+func (index *ScanIndex) remove(str string) {
+	bucket := index.bucketOf(str)
+	strs := index.buckets[bucket]
+	for i := range strs {
+		if strs[i] == str {
+			strs[i] = strs[len(strs)-1]
+			index.buckets[bucket] = strs[:len(strs)-1]
+			index.size--
+			break
+		}
+	}
+	if len(index.buckets) > scanIndexMinBuckets && index.size < len(index.buckets)/8 {
+		index.resize(len(index.buckets) / 2)
+	}
+}
+
+// Returns up to n strings, taken from the buckets following a random one. Random enough for
+// the active expire cycle, that's how redis samples its keys too.
+func (index *ScanIndex) sample(n int) []string {
+	strs := make([]string, 0, n)
+	start := rand.Intn(len(index.buckets))
+	for i := 0; i < len(index.buckets) && len(strs) < n; i++ {
+		bucket := index.buckets[(start+i)&(len(index.buckets)-1)]
+		strs = append(strs, bucket[:min(len(bucket), n-len(strs))]...)
+	}
+	return strs
+}
+
+// Returns a random string of the table, which must not be empty: a random string of a random
+// non empty bucket. Strings sharing their bucket come up a bit less often, like in redis.
+func (index *ScanIndex) random() string {
+	for {
+		bucket := index.buckets[rand.Intn(len(index.buckets))]
+		if len(bucket) > 0 {
+			return bucket[rand.Intn(len(bucket))]
+		}
+	}
+}
+
+// Moves every string over to a table with the given number of buckets.
+func (index *ScanIndex) resize(buckets int) {
+	old := index.buckets
+	index.buckets = make([][]string, buckets)
+	for _, strs := range old {
+		for _, str := range strs {
+			bucket := index.bucketOf(str)
+			index.buckets[bucket] = append(index.buckets[bucket], str)
+		}
+	}
+}
+
+// Calls fn for every string in the bucket the cursor points at, and returns the cursor of the
+// next bucket to visit (0 once every bucket has been visited).
+//
+// Buckets are visited in reverse binary order: the cursor is incremented starting from its
+// high bits. Every string of bucket b lands in bucket b or b+size once the table doubles (and
+// back in b&(size/2-1) when it halves), so any string that was in the table for the whole
+// iteration gets returned at least once, however the table was resized in the meantime.
+// Strings can be returned more than once after a shrink.
+func (index *ScanIndex) scan(cursor uint64, fn func(str string)) uint64 {
+	mask := uint64(len(index.buckets) - 1)
+	for _, str := range index.buckets[cursor&mask] {
+		fn(str)
+	}
+
+	cursor |= ^mask
+	cursor = bits.Reverse64(cursor)
+	cursor++
+	return bits.Reverse64(cursor)
+}
+
+// Options shared by the SCAN family.
+type scanOptions struct {
+	pattern string // MATCH, empty for everything
+	count   int    // COUNT, a hint of how much work a single call does
+	objType string // TYPE, SCAN only. Empty for every type
+}
+
+// Parses the cursor and the options of a SCAN family command. Returns the error reply if they aren't valid.
+func _parseScanArgs(cursorArg string, args []string, allowType bool) (uint64, scanOptions, string, bool) {
+	options := scanOptions{count: 10}
+
+	cursor, err := strconv.ParseUint(cursorArg, 10, 64)
+	if err != nil {
+		return 0, options, respEncodeError("ERR invalid cursor"), false
+	}
+
+	for i := 0; i < len(args); i++ {
+		option := strings.ToLower(args[i])
+		if i+1 >= len(args) || (option != "match" && option != "count" && !(allowType && option == "type")) {
+			return 0, options, respEncodeError("ERR syntax error"), false
+		}
+		i++
+		switch option {
+		case "match":
+			options.pattern = args[i]
+		case "count":
+			count, err := strconv.Atoi(args[i])
+			if err != nil {
+				return 0, options, respEncodeError("ERR value is not an integer or out of range"), false
+			}
+			if count < 1 {
+				return 0, options, respEncodeError("ERR syntax error"), false
+			}
+			options.count = count
+		case "type":
+			options.objType = strings.ToLower(args[i])
+		}
+	}
+	return cursor, options, "", true
+}
+
+// Visits buckets of the index, starting at cursor, until about count strings were collected
+// (or too many empty buckets went by). Returns them along with the cursor to continue from.
+func _scanIndex(index *ScanIndex, cursor uint64, count int) ([]string, uint64) {
+	count = min(count, index.size+1) // COUNT comes from the client, it can be up to MaxInt
+	strs := make([]string, 0, count)
+	for iterations := count * 10; ; iterations-- {
+		cursor = index.scan(cursor, func(str string) {
+			strs = append(strs, str)
+		})
+		if cursor == 0 || iterations <= 0 || len(strs) >= count {
+			return strs, cursor
+		}
+	}
+}
+
+// The SCAN family reply: the next cursor, and the elements.
+func _scanReply(cursor uint64, elements []string) string {
+	return fmt.Sprintf("*2\r\n%s%s", respEncodeBulkString(strconv.FormatUint(cursor, 10)), respEncodeStringArray(elements))
+}
+
+// SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]
+func onSCAN(commands []string) ([]string, error) {
+	db := currentDB()
+	cursor, options, errResponse, ok := _parseScanArgs(commands[1], commands[2:], true)
+	if !ok {
+		return []string{errResponse}, nil
+	}
+
+	keys, cursor := _scanIndex(db.scanIndex, cursor, options.count)
+
+	// Filtering only once the buckets are collected: expired keys get deleted on the way.
+	matched := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if options.pattern != "" && !stringMatch(options.pattern, key, false) {
+			continue
+		}
+		obj := db.lookupKey(key)
+		if obj == nil || (options.objType != "" && obj.objType != options.objType) {
+			continue
+		}
+		matched = append(matched, key)
+	}
+	return []string{_scanReply(cursor, matched)}, nil
+}
+
+// HSCAN key cursor [MATCH pattern] [COUNT count], SSCAN and ZSCAN. Values in a compact encoding
+// are small, they are returned whole in a single call (cursor 0). The bigger ones keep their
+// members bucketed (see _buildMemberIndex), a call only visits the buckets it returns.
+func onHSCAN(commands []string) ([]string, error) {
+	db := currentDB()
+	objType := map[string]string{"hscan": objHash, "sscan": objSet, "zscan": objZSet}[commands[0]]
+
+	cursor, options, errResponse, ok := _parseScanArgs(commands[2], commands[3:], false)
+	if !ok {
+		return []string{errResponse}, nil
+	}
+
+	obj := db.lookupKeyRead(commands[1])
+	if obj == nil {
+		return []string{_scanReply(0, []string{})}, nil
+	}
+	if obj.objType != objType {
+		return []string{respEncodeError(wrongTypeError)}, nil
+	}
+
+	var members []string
+	if obj.members != nil {
+		members, cursor = _scanIndex(obj.members, cursor, options.count)
+	} else if zset, isZSet := obj.value.(*RedisSortedSet); isZSet {
+		members, cursor = zset.sortedMembers(), 0
+	} else {
+		members, cursor = obj.memberNames(), 0
+	}
+
+	// Members (hash fields), followed by their value (score) for hashes and sorted sets.
+	elements := make([]string, 0, len(members))
+	for _, member := range members {
+		if options.pattern != "" && !stringMatch(options.pattern, member, false) {
+			continue
+		}
+		elements = append(elements, member)
+		switch value := obj.value.(type) {
+		case RedisHash:
+			elements = append(elements, value[member])
+		case *RedisSortedSet:
+			elements = append(elements, formatScore(value.scores[member]))
+		}
+	}
+	return []string{_scanReply(cursor, elements)}, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Full HSCAN/SSCAN/ZSCAN iterations over values in the big encoding return every member.
+func TestScanBigValues(t *testing.T) {
+	RDB = RedisRDB{databases: []*RedisDatabase{newDatabase(0)}}
+	db := RDB.databases[0]
+
+	set, hash, zset := RedisSet{}, RedisHash{}, &RedisSortedSet{scores: map[string]float64{}}
+	for i := 0; i < 1000; i++ {
+		member := "member:" + strconv.Itoa(i)
+		set[member] = struct{}{}
+		hash[member] = strconv.Itoa(i)
+		zset.scores[member] = float64(i)
+	}
+	db.setKey("set", newObject(objSet, set))
+	db.setKey("hash", newObject(objHash, hash))
+	db.setKey("zset", newObject(objZSet, zset))
+
+	for _, test := range []struct{ command, key string }{{"sscan", "set"}, {"hscan", "hash"}, {"zscan", "zset"}} {
+		obj := db.keys[test.key]
+		if obj.members == nil {
+			t.Fatalf("%s: no member index for encoding %s", test.key, obj.encoding)
+		}
+
+		seen := map[string]bool{}
+		cursor := "0"
+		for calls := 0; ; calls++ {
+			if calls > 1000 {
+				t.Fatalf("%s: iteration doesn't end", test.command)
+			}
+			reply, _ := onHSCAN([]string{test.command, test.key, cursor, "COUNT", "50"})
+			resps, _, err := parseRESP([]byte(reply[0]))
+			if err != nil || len(resps) != 1 {
+				t.Fatalf("%s: bad reply %q", test.command, reply[0])
+			}
+			elements := resps[0].respData.Array[1].respData.Array
+			step := 1
+			if test.command != "sscan" {
+				step = 2
+			}
+			for i := 0; i < len(elements); i += step {
+				seen[elements[i].respData.String] = true
+			}
+			cursor = resps[0].respData.Array[0].respData.String
+			if cursor == "0" {
+				break
+			}
+		}
+		if len(seen) != 1000 {
+			t.Errorf("%s: got %d members, want 1000", test.command, len(seen))
+		}
+	}
+
+	// A huge COUNT returns everything in one call, without trying to preallocate for it.
+	reply, _ := onHSCAN([]string{"sscan", "set", "0", "COUNT", "9223372036854775807"})
+	if resps, _, err := parseRESP([]byte(reply[0])); err != nil || len(resps[0].respData.Array[1].respData.Array) != 1000 {
+		t.Errorf("SSCAN with a huge COUNT: bad reply %.60q", reply[0])
+	}
+	reply, _ = onSCAN([]string{"scan", "0", "COUNT", "9223372036854775807"})
+	if !strings.HasPrefix(reply[0], "*2\r\n$1\r\n0\r\n*3\r\n") {
+		t.Errorf("SCAN with a huge COUNT: bad reply %.60q", reply[0])
+	}
+
+}
@@ -0,0 +1,939 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sentinel mode (--sentinel sentinel.conf): instead of serving a dataset, the server monitors
+// the masters listed in its config file, finds their replicas (INFO) and the other sentinels
+// monitoring them (hello messages over pub/sub), and fails a master over to one of its replicas
+// once enough sentinels agree it's down. Clients ask it where the master is (SENTINEL
+// GET-MASTER-ADDR-BY-NAME). What it learns is kept in memory, the config file isn't rewritten.
+var SENTINEL = Sentinel{masters: make(map[string]*SentinelMaster)}
+
+const (
+	sentinelDefaultPort  = 26379
+	sentinelHelloChannel = "__sentinel__:hello"
+
+	sentinelPingPeriod  = time.Second      // PING to every instance
+	sentinelInfoPeriod  = 10 * time.Second // INFO to masters and replicas (every second while a failover is near)
+	sentinelHelloPeriod = 2 * time.Second  // hello message published on masters and replicas
+	sentinelAskPeriod   = time.Second      // asking the other sentinels about a master that looks down
+	sentinelTimerPeriod = 100 * time.Millisecond
+	sentinelLinkTimeout = time.Second // to connect, and for replies
+
+	sentinelDefaultDownAfter       = 30 * time.Second
+	sentinelDefaultFailoverTimeout = 3 * time.Minute
+)
+
+// Only these run in sentinel mode, the rest is unknown to it.
+var sentinelCommands = map[string]struct{}{
+	"ping": {}, "sentinel": {}, "info": {}, "role": {}, "client": {}, "command": {}, "hello": {}, "auth": {}, "acl": {},
+	"subscribe": {}, "unsubscribe": {}, "psubscribe": {}, "punsubscribe": {}, "publish": {},
+}
+
+// Reads the sentinel config file. Returns the port it sets (0 if it doesn't):
+//
+//	port <port>
+//	sentinel monitor <master name> <ip> <port> <quorum>
+//	sentinel down-after-milliseconds|failover-timeout|parallel-syncs|auth-pass <master name> <value>
+//	sentinel announce-ip <ip>, sentinel announce-port <port>, sentinel myid <id>
+func loadSentinelConfig(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	port := 0
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		args := strings.Fields(scanner.Text())
+		if len(args) == 0 || strings.HasPrefix(args[0], "#") {
+			continue
+		}
+		if err := _sentinelConfigLine(args, &port); err != nil {
+			return 0, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return port, nil
+}
+
+func _sentinelConfigLine(args []string, port *int) error {
+	directive := strings.ToLower(args[0])
+	if directive == "port" && len(args) == 2 {
+		p, err := strconv.Atoi(args[1])
+		if err != nil || p <= 0 || p > 65535 {
+			return fmt.Errorf("invalid port '%s'", args[1])
+		}
+		*port = p
+		return nil
+	}
+	if directive != "sentinel" || len(args) < 3 {
+		return fmt.Errorf("bad directive or wrong number of arguments")
+	}
+
+	option := strings.ToLower(args[1])
+	switch option {
+	case "monitor":
+		if len(args) != 6 {
+			return fmt.Errorf("wrong number of arguments for 'sentinel monitor'")
+		}
+		masterPort, err := strconv.Atoi(args[4])
+		quorum, errQuorum := strconv.Atoi(args[5])
+		if err != nil || errQuorum != nil || quorum <= 0 {
+			return fmt.Errorf("invalid port or quorum for master '%s'", args[2])
+		}
+		if _, exists := SENTINEL.masters[args[2]]; exists {
+			return fmt.Errorf("duplicated master name '%s'", args[2])
+		}
+		SENTINEL.masters[args[2]] = &SentinelMaster{
+			SentinelInstance: newSentinelInstance("master", args[3], masterPort),
+			name:             args[2],
+			quorum:           quorum,
+			downAfter:        sentinelDefaultDownAfter,
+			failoverTimeout:  sentinelDefaultFailoverTimeout,
+			parallelSyncs:    1,
+			replicas:         make(map[string]*SentinelInstance),
+			sentinels:        make(map[string]*SentinelInstance),
+		}
+		return nil
+	case "announce-ip":
+		SENTINEL.announceIP = args[2]
+		return nil
+	case "announce-port":
+		p, err := strconv.Atoi(args[2])
+		if err != nil || p < 0 || p > 65535 {
+			return fmt.Errorf("invalid announce-port '%s'", args[2])
+		}
+		SENTINEL.announcePort = p
+		return nil
+	case "myid":
+		if len(args[2]) != 40 {
+			return fmt.Errorf("invalid myid '%s', it has to be 40 characters long", args[2])
+		}
+		SENTINEL.myID = args[2]
+		return nil
+	}
+
+	// The rest are per master options, and come after the master's monitor line.
+	if len(args) != 4 {
+		return fmt.Errorf("unknown option or wrong number of arguments for 'sentinel %s'", args[1])
+	}
+	master, exists := SENTINEL.masters[args[2]]
+	if !exists {
+		return fmt.Errorf("no such master '%s' (has to be monitored before this line)", args[2])
+	}
+	value, err := strconv.Atoi(args[3])
+	switch option {
+	case "down-after-milliseconds":
+		if err != nil || value <= 0 {
+			return fmt.Errorf("invalid down-after-milliseconds '%s'", args[3])
+		}
+		master.downAfter = time.Duration(value) * time.Millisecond
+	case "failover-timeout":
+		if err != nil || value <= 0 {
+			return fmt.Errorf("invalid failover-timeout '%s'", args[3])
+		}
+		master.failoverTimeout = time.Duration(value) * time.Millisecond
+	case "parallel-syncs":
+		if err != nil || value <= 0 {
+			return fmt.Errorf("invalid parallel-syncs '%s'", args[3])
+		}
+		master.parallelSyncs = value
+	case "auth-pass":
+		master.authPass = args[3]
+	default:
+		return fmt.Errorf("unknown option 'sentinel %s'", args[1])
+	}
+	return nil
+}
+
+func newSentinelInstance(kind, host string, port int) *SentinelInstance {
+	return &SentinelInstance{kind: kind, host: host, port: port, stop: make(chan struct{}), lastAvail: time.Now(), priority: 100}
+}
+
+// Starts monitoring every master of the config file.
+func startSentinel() {
+	if SENTINEL.myID == "" {
+		SENTINEL.myID = generateReplicationID()
+	}
+	fmt.Println("Sentinel ID is", SENTINEL.myID)
+
+	executionLock.Lock()
+	defer executionLock.Unlock()
+	for _, master := range SENTINEL.masters {
+		sentinelEvent("+monitor", master, master.SentinelInstance, fmt.Sprintf("quorum %d", master.quorum))
+		sentinelWatch(master, master.SentinelInstance)
+	}
+	go sentinelTimer()
+}
+
+// Starts talking to the instance: a command link (PING, INFO, hello messages, asking the other
+// sentinels about the master), and for masters and replicas, a pub/sub link the hello messages
+// of the other sentinels come from. Both go on until inst.stop is closed.
+func sentinelWatch(master *SentinelMaster, inst *SentinelInstance) {
+	go _sentinelCommandLink(master, inst)
+	if inst.kind != "sentinel" {
+		go _sentinelHelloLink(master, inst)
+	}
+}
+
+// Whether the sentinel stopped monitoring the instance (it got replaced after a failover).
+func (inst *SentinelInstance) removed() bool {
+	select {
+	case <-inst.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (inst *SentinelInstance) address() string {
+	return net.JoinHostPort(inst.host, strconv.Itoa(inst.port))
+}
+
+// Connection to an instance, for request/reply commands (or pub/sub messages).
+type SentinelLink struct {
+	conn   net.Conn
+	addr   string
+	buffer []byte // read but not parsed yet
+}
+
+// Connects to host:port, and authenticates if there is a password.
+func dialSentinelLink(host string, port int, authPass string) (*SentinelLink, error) {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	conn, err := net.DialTimeout("tcp", addr, sentinelLinkTimeout)
+	if err != nil {
+		return nil, err
+	}
+	link := &SentinelLink{conn: conn, addr: addr}
+	if authPass != "" {
+		reply, err := link.call("AUTH", authPass)
+		if err == nil && reply.respType == RESPTypes.Error {
+			err = errors.New(reply.respData.String)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return link, nil
+}
+
+// Sends a command and waits for its reply.
+func (link *SentinelLink) call(args ...string) (RESP, error) {
+	link.conn.SetDeadline(time.Now().Add(sentinelLinkTimeout))
+	if _, err := link.conn.Write([]byte(respEncodeStringArray(args))); err != nil {
+		return RESP{}, err
+	}
+	return link.read()
+}
+
+// Reads the next reply (or pub/sub message). Whatever came in after it is kept for the next one.
+func (link *SentinelLink) read() (RESP, error) {
+	for {
+		resps, _, err := parseRESP(link.buffer)
+		if err != nil {
+			return RESP{}, err
+		}
+		if len(resps) > 0 {
+			link.buffer = link.buffer[len(resps[0].RawBytes):]
+			return resps[0], nil
+		}
+
+		chunk := make([]byte, 4096)
+		n, err := link.conn.Read(chunk)
+		if err != nil {
+			return RESP{}, err
+		}
+		link.buffer = append(link.buffer, chunk[:n]...)
+	}
+}
+
+// The command link of an instance. Reconnects whenever it breaks (or the instance moves).
+func _sentinelCommandLink(master *SentinelMaster, inst *SentinelInstance) {
+	var link *SentinelLink
+	var lastPing, lastInfo, lastHello, lastAsk time.Time
+	askedEpoch := 0 // failover epoch we last asked the sentinel to vote in
+	defer func() {
+		if link != nil {
+			link.conn.Close()
+		}
+	}()
+
+	for {
+		select {
+		case <-inst.stop:
+			return
+		case <-time.After(sentinelTimerPeriod):
+		}
+
+		executionLock.Lock()
+		host, port, authPass := inst.host, inst.port, master.authPass
+		if inst.kind == "sentinel" {
+			authPass = ""
+		}
+		infoPeriod := sentinelInfoPeriod
+		if inst.kind == "slave" && (master.sdown || master.failoverState != sentinelFailoverNone || !inst.masterLinkUp) {
+			infoPeriod = sentinelPingPeriod // the replicas are about to matter
+		}
+		askMaster := inst.kind == "sentinel" && master.sdown
+		askVote := askMaster && _sentinelSeekingVotes(master) && askedEpoch != master.failoverEpoch
+		if askVote {
+			askedEpoch = master.failoverEpoch
+		}
+		executionLock.Unlock()
+
+		if link != nil && link.addr != net.JoinHostPort(host, strconv.Itoa(port)) {
+			link.conn.Close() // the instance announced another address
+			link = nil
+		}
+		if link == nil {
+			var err error
+			if link, err = dialSentinelLink(host, port, authPass); err != nil {
+				_sentinelLinkDown(inst)
+				continue
+			}
+			executionLock.Lock()
+			inst.connected = true
+			executionLock.Unlock()
+		}
+
+		var err error
+		now := time.Now()
+		if now.Sub(lastPing) >= sentinelPingPeriod {
+			lastPing = now
+			err = _sentinelPing(link, inst)
+		}
+		if err == nil && inst.kind != "sentinel" && now.Sub(lastInfo) >= infoPeriod {
+			lastInfo = now
+			err = _sentinelInfo(link, master, inst)
+		}
+		if err == nil && inst.kind != "sentinel" && now.Sub(lastHello) >= sentinelHelloPeriod {
+			lastHello = now
+			executionLock.Lock()
+			hello := sentinelHelloMessage(master, link)
+			executionLock.Unlock()
+			_, err = link.call("PUBLISH", sentinelHelloChannel, hello)
+		}
+		if err == nil && (askVote || askMaster && now.Sub(lastAsk) >= sentinelAskPeriod) {
+			lastAsk = now
+			err = _sentinelAskMasterState(link, master, inst)
+		}
+		if err != nil {
+			link.conn.Close()
+			link = nil
+			_sentinelLinkDown(inst)
+		}
+	}
+}
+
+// Whether we're trying to fail the master over, past the random delay of sentinelStartFailover.
+func _sentinelSeekingVotes(master *SentinelMaster) bool {
+	return master.failoverState != sentinelFailoverNone && !time.Now().Before(master.failoverStartTime)
+}
+
+func _sentinelLinkDown(inst *SentinelInstance) {
+	executionLock.Lock()
+	inst.connected = false
+	executionLock.Unlock()
+}
+
+// Only +PONG, and the errors of an instance that is alive but busy, count as available.
+func _sentinelPing(link *SentinelLink, inst *SentinelInstance) error {
+	reply, err := link.call("PING")
+	if err != nil {
+		return err
+	}
+
+	executionLock.Lock()
+	defer executionLock.Unlock()
+	inst.lastPingReply = time.Now()
+	switch {
+	case reply.respType == RESPTypes.String && reply.respData.String == "PONG",
+		reply.respType == RESPTypes.Error && strings.HasPrefix(reply.respData.String, "LOADING"),
+		reply.respType == RESPTypes.Error && strings.HasPrefix(reply.respData.String, "MASTERDOWN"):
+		inst.lastAvail = inst.lastPingReply
+	}
+	return nil
+}
+
+func _sentinelInfo(link *SentinelLink, master *SentinelMaster, inst *SentinelInstance) error {
+	reply, err := link.call("INFO")
+	if err != nil {
+		return err
+	}
+	if reply.respType != RESPTypes.Bulk {
+		return nil // not authorized, probably. Nothing to learn from it
+	}
+
+	executionLock.Lock()
+	defer executionLock.Unlock()
+	if !inst.removed() {
+		sentinelRefreshFromInfo(master, inst, reply.respData.String)
+	}
+	return nil
+}
+
+// SENTINEL IS-MASTER-DOWN-BY-ADDR to another sentinel: whether it thinks the master is down
+// too. While we try to fail the master over, it also asks for the sentinel's vote.
+func _sentinelAskMasterState(link *SentinelLink, master *SentinelMaster, inst *SentinelInstance) error {
+	executionLock.Lock()
+	runID := "*"
+	if _sentinelSeekingVotes(master) {
+		runID = SENTINEL.myID
+	}
+	request := []string{"SENTINEL", "is-master-down-by-addr", master.host, strconv.Itoa(master.port), strconv.Itoa(SENTINEL.currentEpoch), runID}
+	executionLock.Unlock()
+
+	reply, err := link.call(request...)
+	if err != nil {
+		return err
+	}
+	values := reply.respData.Array
+	if reply.respType != RESPTypes.Array || len(values) != 3 || values[0].respType != RESPTypes.Integer {
+		return nil
+	}
+
+	executionLock.Lock()
+	defer executionLock.Unlock()
+	inst.masterDown = values[0].respData.Int == 1
+	inst.masterDownReply = time.Now()
+	if leader := values[1].respData.String; leader != "*" {
+		inst.leader, inst.leaderEpoch = leader, values[2].respData.Int
+	}
+	return nil
+}
+
+// The pub/sub link of a master or replica: hello messages of the other sentinels.
+func _sentinelHelloLink(master *SentinelMaster, inst *SentinelInstance) {
+	for !inst.removed() {
+		executionLock.Lock()
+		host, port, authPass := inst.host, inst.port, master.authPass
+		executionLock.Unlock()
+
+		link, err := dialSentinelLink(host, port, authPass)
+		if err == nil {
+			_, err = link.call("SUBSCRIBE", sentinelHelloChannel)
+		}
+		for err == nil && !inst.removed() {
+			link.conn.SetDeadline(time.Now().Add(sentinelLinkTimeout))
+			var message RESP
+			message, err = link.read()
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				err = nil // nothing published, checking whether to stop
+				continue
+			}
+			values := message.respData.Array
+			if err != nil || len(values) != 3 || values[0].respData.String != "message" {
+				continue
+			}
+
+			executionLock.Lock()
+			if !inst.removed() {
+				sentinelProcessHello(values[2].respData.String)
+			}
+			executionLock.Unlock()
+		}
+		if link != nil {
+			link.conn.Close()
+		}
+
+		select {
+		case <-inst.stop:
+		case <-time.After(sentinelPingPeriod):
+		}
+	}
+}
+
+// Takes in what INFO says about a master or replica: its run id and role, the replicas of a
+// master, the link of a replica to its master. Replicas turning master, or following another
+// master, move the failovers forward (or get pointed back at the right master).
+func sentinelRefreshFromInfo(master *SentinelMaster, inst *SentinelInstance, info string) {
+	now := time.Now()
+	fields := make(map[string]string)
+	replicas := []string{}
+	for _, line := range strings.Split(info, "\r\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		if n := strings.TrimPrefix(key, "slave"); n != key && n != "" && strings.Trim(n, "0123456789") == "" {
+			replicas = append(replicas, value)
+			continue
+		}
+		fields[key] = value
+	}
+
+	inst.infoRefresh = now
+	if runID := fields["run_id"]; runID != "" {
+		if inst.runID != "" && inst.runID != runID {
+			sentinelEvent("+reboot", master, inst, "")
+		}
+		inst.runID = runID
+	}
+	role := fields["role"]
+	if role != inst.roleReported {
+		inst.roleReported, inst.roleReportedTime = role, now
+	}
+
+	if role == "master" && inst.kind == "master" {
+		for _, replica := range replicas {
+			_sentinelAddReplica(master, replica)
+		}
+	}
+	if role == "slave" {
+		inst.masterHost = fields["master_host"]
+		inst.masterPort, _ = strconv.Atoi(fields["master_port"])
+		inst.masterLinkUp = fields["master_link_status"] == "up"
+		inst.masterLinkDown = 0
+		if seconds, err := strconv.Atoi(fields["master_link_down_since_seconds"]); err == nil && seconds > 0 {
+			inst.masterLinkDown = time.Duration(seconds) * time.Second
+		}
+		if priority, err := strconv.Atoi(fields["slave_priority"]); err == nil {
+			inst.priority = priority
+		}
+		inst.replOffset, _ = strconv.Atoi(fields["slave_repl_offset"])
+	}
+	if inst.kind == "slave" {
+		sentinelCheckReplicaRole(master, inst)
+	}
+}
+
+// A replica the master listed in its INFO (ip=...,port=...,...). New ones get monitored too.
+func _sentinelAddReplica(master *SentinelMaster, line string) {
+	ip, port := "", 0
+	for _, field := range strings.Split(line, ",") {
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case "ip":
+			ip = value
+		case "port":
+			port, _ = strconv.Atoi(value)
+		}
+	}
+	if ip == "" || port == 0 {
+		return
+	}
+	addr := net.JoinHostPort(ip, strconv.Itoa(port))
+	if _, known := master.replicas[addr]; known {
+		return
+	}
+	replica := newSentinelInstance("slave", ip, port)
+	master.replicas[addr] = replica
+	sentinelEvent("+slave", master, replica, "")
+	sentinelWatch(master, replica)
+}
+
+// Our hello message, published on the masters and replicas every sentinelHelloPeriod:
+// <ip>,<port>,<run id>,<current epoch>,<master name>,<master ip>,<master port>,<master config epoch>
+func sentinelHelloMessage(master *SentinelMaster, link *SentinelLink) string {
+	ip, port := SENTINEL.announceIP, SENTINEL.announcePort
+	if ip == "" {
+		ip, _, _ = net.SplitHostPort(link.conn.LocalAddr().String())
+	}
+	if port == 0 {
+		port = CONFIG.port
+	}
+	masterHost, masterPort := sentinelCurrentMasterAddress(master)
+	return fmt.Sprintf("%s,%d,%s,%d,%s,%s,%d,%d", ip, port, SENTINEL.myID, SENTINEL.currentEpoch,
+		master.name, masterHost, masterPort, master.configEpoch)
+}
+
+// A hello message of another sentinel: a new sentinel to talk to, maybe a newer epoch, and
+// maybe a newer configuration of the master (it failed it over).
+func sentinelProcessHello(hello string) {
+	fields := strings.Split(hello, ",")
+	if len(fields) != 8 {
+		return
+	}
+	port, err := strconv.Atoi(fields[1])
+	epoch, errEpoch := strconv.Atoi(fields[3])
+	masterPort, errMasterPort := strconv.Atoi(fields[6])
+	configEpoch, errConfigEpoch := strconv.Atoi(fields[7])
+	if err != nil || errEpoch != nil || errMasterPort != nil || errConfigEpoch != nil {
+		return
+	}
+	ip, runID, masterHost := fields[0], fields[2], fields[5]
+	master, exists := SENTINEL.masters[fields[4]]
+	if !exists || runID == SENTINEL.myID {
+		return
+	}
+
+	other, known := master.sentinels[runID]
+	if !known {
+		// Same address with another run id: it restarted, the old one is gone.
+		for id, sentinel := range master.sentinels {
+			if sentinel.host == ip && sentinel.port == port {
+				close(sentinel.stop)
+				delete(master.sentinels, id)
+			}
+		}
+		other = newSentinelInstance("sentinel", ip, port)
+		other.runID = runID
+		master.sentinels[runID] = other
+		sentinelEvent("+sentinel", master, other, "")
+		sentinelWatch(master, other)
+	}
+	other.host, other.port = ip, port // its command link reconnects if it moved
+	other.lastHello = time.Now()
+
+	if epoch > SENTINEL.currentEpoch {
+		SENTINEL.currentEpoch = epoch
+		sentinelEvent("+new-epoch", nil, nil, strconv.Itoa(epoch))
+	}
+
+	// It has a newer configuration of the master (it failed it over): switching to it.
+	if configEpoch > master.configEpoch {
+		master.configEpoch = configEpoch
+		currentHost, currentPort := sentinelCurrentMasterAddress(master)
+		if masterHost != currentHost || masterPort != currentPort {
+			sentinelEvent("+config-update-from", master, other, "")
+			sentinelSwitchMaster(master, masterHost, masterPort)
+		}
+	}
+}
+
+// Where the master is: the replica being promoted, once it got promoted.
+func sentinelCurrentMasterAddress(master *SentinelMaster) (string, int) {
+	if master.promoted != nil && master.failoverState >= sentinelFailoverReconfSlaves {
+		return master.promoted.host, master.promoted.port
+	}
+	return master.host, master.port
+}
+
+// The master moved to host:port (a failover). The replicas stay replicas, and the old master
+// is one too, once it's back.
+func sentinelSwitchMaster(master *SentinelMaster, host string, port int) {
+	sentinelEvent("+switch-master", nil, nil, fmt.Sprintf("%s %s %d %s %d", master.name, master.host, master.port, host, port))
+
+	addrs := []string{}
+	newAddr := net.JoinHostPort(host, strconv.Itoa(port))
+	for addr, replica := range master.replicas {
+		close(replica.stop)
+		if addr != newAddr {
+			addrs = append(addrs, addr)
+		}
+	}
+	if oldAddr := master.address(); oldAddr != newAddr {
+		addrs = append(addrs, oldAddr)
+	}
+	close(master.stop)
+
+	master.SentinelInstance = newSentinelInstance("master", host, port)
+	master.replicas = make(map[string]*SentinelInstance)
+	master.odown = false
+	master.promoted = nil
+	master.forceFailover = false
+	sentinelSetFailoverState(master, sentinelFailoverNone)
+	for _, sentinel := range master.sentinels {
+		sentinel.masterDown = false
+	}
+	sentinelWatch(master, master.SentinelInstance)
+
+	for _, addr := range addrs {
+		ip, portString, _ := net.SplitHostPort(addr)
+		replicaPort, _ := strconv.Atoi(portString)
+		replica := newSentinelInstance("slave", ip, replicaPort)
+		master.replicas[addr] = replica
+		sentinelEvent("+slave", master, replica, "")
+		sentinelWatch(master, replica)
+	}
+}
+
+// Logs an event, and publishes it on the channel of the same name for the clients of the
+// sentinel: "<type> <name> <ip> <port> @ <master name> <master ip> <master port>", or
+// "master <name> <ip> <port>" for masters. Events without an instance just have the details.
+func sentinelEvent(event string, master *SentinelMaster, inst *SentinelInstance, details string) {
+	message := details
+	if inst != nil {
+		if inst == master.SentinelInstance {
+			message = fmt.Sprintf("master %s %s %d", master.name, inst.host, inst.port)
+		} else {
+			name := inst.address()
+			if inst.kind == "sentinel" {
+				name = inst.runID
+			}
+			message = fmt.Sprintf("%s %s %s %d @ %s %s %d", inst.kind, name, inst.host, inst.port, master.name, master.host, master.port)
+		}
+		if details != "" {
+			message += " " + details
+		}
+	}
+	fmt.Println(event, message)
+	publishMessage(event, message)
+}
+
+// Sends REPLICAOF host port (or NO ONE) to the instance, on a connection of its own. Whether it
+// worked shows up in its INFO.
+func sentinelSendReplicaOf(master *SentinelMaster, inst *SentinelInstance, host, port string) {
+	instHost, instPort, authPass := inst.host, inst.port, master.authPass
+	go func() {
+		link, err := dialSentinelLink(instHost, instPort, authPass)
+		if err != nil {
+			fmt.Println("Can't send REPLICAOF to", net.JoinHostPort(instHost, strconv.Itoa(instPort)), err)
+			return
+		}
+		defer link.conn.Close()
+		reply, err := link.call("REPLICAOF", host, port)
+		if err == nil && reply.respType == RESPTypes.Error {
+			err = errors.New(reply.respData.String)
+		}
+		if err != nil {
+			fmt.Println("REPLICAOF failed on", link.addr, err)
+		}
+	}()
+}
+
+// SENTINEL subcommand [args]. What the sentinel knows about the masters, where a master is
+// (GET-MASTER-ADDR-BY-NAME), forced failovers, and the votes other sentinels ask for.
+func onSENTINEL(commands []string, conn net.Conn) ([]string, error) {
+	protocol := 2
+	if client, exists := CONFIG.clients[conn]; exists {
+		protocol = client.resp
+	}
+	subcommand := strings.ToLower(commands[1])
+
+	switch subcommand {
+	case "myid":
+		return []string{respEncodeBulkString(SENTINEL.myID)}, nil
+	case "masters":
+		masters := []string{}
+		for _, master := range _sentinelMastersByName() {
+			masters = append(masters, respEncodeMap(_sentinelInstanceFields(master, master.SentinelInstance), protocol))
+		}
+		return []string{respEncodeArray(masters)}, nil
+	case "is-master-down-by-addr":
+		return _sentinelIsMasterDownByAddr(commands[2:])
+	}
+
+	master, exists := SENTINEL.masters[commands[2]]
+	if !exists {
+		if subcommand == "get-master-addr-by-name" {
+			return []string{"*-1\r\n"}, nil
+		}
+		return []string{respEncodeError("ERR No such master with that name")}, nil
+	}
+
+	switch subcommand {
+	case "master":
+		return []string{respEncodeMap(_sentinelInstanceFields(master, master.SentinelInstance), protocol)}, nil
+	case "replicas", "slaves", "sentinels":
+		instances := master.replicas
+		if subcommand == "sentinels" {
+			instances = master.sentinels
+		}
+		names := make([]string, 0, len(instances))
+		for name := range instances {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		replies := []string{}
+		for _, name := range names {
+			replies = append(replies, respEncodeMap(_sentinelInstanceFields(master, instances[name]), protocol))
+		}
+		return []string{respEncodeArray(replies)}, nil
+	case "get-master-addr-by-name":
+		host, port := sentinelCurrentMasterAddress(master)
+		return []string{respEncodeStringArray([]string{host, strconv.Itoa(port)})}, nil
+	case "failover":
+		if master.failoverState != sentinelFailoverNone {
+			return []string{respEncodeError("INPROG Failover already in progress")}, nil
+		}
+		if sentinelSelectReplica(master) == nil {
+			return []string{respEncodeError("NOGOODSLAVE No suitable replica to promote")}, nil
+		}
+		fmt.Println("Executing user requested FAILOVER of", master.name)
+		master.forceFailover = true
+		sentinelStartFailover(master)
+		return []string{respEncodeString("OK")}, nil
+	}
+	return []string{respEncodeError(fmt.Sprintf("ERR Unknown sentinel subcommand '%s'", commands[1]))}, nil
+}
+
+// SENTINEL IS-MASTER-DOWN-BY-ADDR ip port current-epoch runid. Whether we think the master at
+// ip:port is down, and with a run id (not *), our vote for who fails it over in that epoch.
+// Replies down (0/1), the leader we voted for (* if none) and the epoch of the vote.
+func _sentinelIsMasterDownByAddr(args []string) ([]string, error) {
+	port, err := strconv.Atoi(args[1])
+	epoch, errEpoch := strconv.Atoi(args[2])
+	if err != nil || errEpoch != nil {
+		return []string{respEncodeError("ERR value is not an integer or out of range")}, nil
+	}
+
+	down, leader, leaderEpoch := 0, "*", 0
+	for _, master := range SENTINEL.masters {
+		if master.host != args[0] || master.port != port {
+			continue
+		}
+		if master.sdown {
+			down = 1
+		}
+		if args[3] != "*" {
+			leader, leaderEpoch = sentinelVoteLeader(master, epoch, args[3])
+		}
+		break
+	}
+	return []string{respEncodeArray([]string{respEncodeInteger(down), respEncodeBulkString(leader), respEncodeInteger(leaderEpoch)})}, nil
+}
+
+func _sentinelMastersByName() []*SentinelMaster {
+	masters := make([]*SentinelMaster, 0, len(SENTINEL.masters))
+	for _, master := range SENTINEL.masters {
+		masters = append(masters, master)
+	}
+	sort.Slice(masters, func(i, j int) bool { return masters[i].name < masters[j].name })
+	return masters
+}
+
+// What SENTINEL MASTER/REPLICAS/SENTINELS report about an instance, as encoded key value pairs.
+func _sentinelInstanceFields(master *SentinelMaster, inst *SentinelInstance) []string {
+	now := time.Now()
+	ms := func(t time.Time) string {
+		if t.IsZero() {
+			return "0"
+		}
+		return strconv.FormatInt(now.Sub(t).Milliseconds(), 10)
+	}
+
+	name := inst.address()
+	switch {
+	case inst == master.SentinelInstance:
+		name = master.name
+	case inst.kind == "sentinel":
+		name = inst.runID
+	}
+	fields := []string{
+		"name", name,
+		"ip", inst.host,
+		"port", strconv.Itoa(inst.port),
+		"runid", inst.runID,
+		"flags", _sentinelFlags(master, inst),
+		"last-ok-ping-reply", ms(inst.lastAvail),
+		"last-ping-reply", ms(inst.lastPingReply),
+		"down-after-milliseconds", strconv.FormatInt(master.downAfter.Milliseconds(), 10),
+	}
+	if inst.sdown {
+		fields = append(fields, "s-down-time", ms(inst.sdownSince))
+	}
+
+	switch inst.kind {
+	case "master":
+		if master.odown {
+			fields = append(fields, "o-down-time", ms(master.odownSince))
+		}
+		fields = append(fields,
+			"info-refresh", ms(inst.infoRefresh),
+			"role-reported", inst.roleReported,
+			"role-reported-time", ms(inst.roleReportedTime),
+			"config-epoch", strconv.Itoa(master.configEpoch),
+			"num-slaves", strconv.Itoa(len(master.replicas)),
+			"num-other-sentinels", strconv.Itoa(len(master.sentinels)),
+			"quorum", strconv.Itoa(master.quorum),
+			"failover-timeout", strconv.FormatInt(master.failoverTimeout.Milliseconds(), 10),
+			"parallel-syncs", strconv.Itoa(master.parallelSyncs))
+		if master.failoverState != sentinelFailoverNone {
+			fields = append(fields, "failover-state", sentinelFailoverStateNames[master.failoverState])
+		}
+	case "slave":
+		linkStatus := "err"
+		if inst.masterLinkUp {
+			linkStatus = "ok"
+		}
+		fields = append(fields,
+			"info-refresh", ms(inst.infoRefresh),
+			"role-reported", inst.roleReported,
+			"role-reported-time", ms(inst.roleReportedTime),
+			"master-link-down-time", strconv.FormatInt(inst.masterLinkDown.Milliseconds(), 10),
+			"master-link-status", linkStatus,
+			"master-host", inst.masterHost,
+			"master-port", strconv.Itoa(inst.masterPort),
+			"slave-priority", strconv.Itoa(inst.priority),
+			"slave-repl-offset", strconv.Itoa(inst.replOffset))
+	case "sentinel":
+		leader := inst.leader
+		if leader == "" {
+			leader = "?"
+		}
+		fields = append(fields,
+			"last-hello-message", ms(inst.lastHello),
+			"voted-leader", leader,
+			"voted-leader-epoch", strconv.Itoa(inst.leaderEpoch))
+	}
+
+	encoded := make([]string, len(fields))
+	for i, field := range fields {
+		encoded[i] = respEncodeBulkString(field)
+	}
+	return encoded
+}
+
+func _sentinelFlags(master *SentinelMaster, inst *SentinelInstance) string {
+	flags := []string{inst.kind}
+	if inst.sdown {
+		flags = append(flags, "s_down")
+	}
+	if inst == master.SentinelInstance && master.odown {
+		flags = append(flags, "o_down")
+	}
+	if !inst.connected {
+		flags = append(flags, "disconnected")
+	}
+	if inst.kind == "sentinel" && inst.masterDown {
+		flags = append(flags, "master_down")
+	}
+	if inst == master.SentinelInstance && master.failoverState != sentinelFailoverNone {
+		flags = append(flags, "failover_in_progress")
+	}
+	if inst == master.promoted {
+		flags = append(flags, "promoted")
+	}
+	switch inst.reconf {
+	case sentinelReconfSent:
+		flags = append(flags, "reconf_sent")
+	case sentinelReconfInProgress:
+		flags = append(flags, "reconf_inprog")
+	case sentinelReconfDone:
+		flags = append(flags, "reconf_done")
+	}
+	return strings.Join(flags, ",")
+}
+
+// PUBLISH in sentinel mode: the other sentinels can send their hello messages straight to us.
+func onSentinelPUBLISH(commands []string) ([]string, error) {
+	if commands[1] != sentinelHelloChannel {
+		return []string{respEncodeError("ERR Only HELLO messages are accepted by Sentinel instances.")}, nil
+	}
+	sentinelProcessHello(commands[2])
+	return []string{respEncodeInteger(1)}, nil
+}
+
+// The INFO sentinel section: one line per master, with its status.
+func infoSentinel() string {
+	info := fmt.Sprintf("# Sentinel\r\nsentinel_masters:%d\r\nsentinel_tilt:0\r\nsentinel_running_scripts:0\r\nsentinel_scripts_queue_length:0", len(SENTINEL.masters))
+	for i, master := range _sentinelMastersByName() {
+		status := "ok"
+		if master.odown {
+			status = "odown"
+		} else if master.sdown {
+			status = "sdown"
+		}
+		host, port := sentinelCurrentMasterAddress(master)
+		info += fmt.Sprintf("\r\nmaster%d:name=%s,status=%s,address=%s,slaves=%d,sentinels=%d",
+			i, master.name, status, net.JoinHostPort(host, strconv.Itoa(port)), len(master.replicas), len(master.sentinels)+1)
+	}
+	return info
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// States of a sentinel failover: wait-start (elected as the leader, by a majority of the
+// sentinels) -> select-slave -> send-slaveof-noone -> wait-promotion (the replica reports being a
+// master in its INFO) -> reconf-slaves (the other replicas get pointed at it, parallel-syncs at
+// a time) -> update-config (the new master replaces the old one) -> none.
+const (
+	sentinelFailoverNone = iota
+	sentinelFailoverWaitStart
+	sentinelFailoverSelectSlave
+	sentinelFailoverSendSlaveofNoOne
+	sentinelFailoverWaitPromotion
+	sentinelFailoverReconfSlaves
+	sentinelFailoverUpdateConfig
+)
+
+// Names SENTINEL MASTER reports the failover states with (failover-state).
+var sentinelFailoverStateNames = map[int]string{
+	sentinelFailoverNone:             "none",
+	sentinelFailoverWaitStart:        "wait_start",
+	sentinelFailoverSelectSlave:      "select_slave",
+	sentinelFailoverSendSlaveofNoOne: "send_slaveof_noone",
+	sentinelFailoverWaitPromotion:    "wait_promotion",
+	sentinelFailoverReconfSlaves:     "reconf_slaves",
+	sentinelFailoverUpdateConfig:     "update_config",
+}
+
+// Where a replica is at, while a failover points it at the new master.
+const (
+	sentinelReconfNone       = iota
+	sentinelReconfSent       // REPLICAOF sent
+	sentinelReconfInProgress // it follows the new master, but isn't synced yet
+	sentinelReconfDone       // synced with the new master
+)
+
+const (
+	sentinelElectionTimeout     = 10 * time.Second // at most, failover-timeout if lower
+	sentinelMasterDownReplyTTL  = 5 * time.Second  // how long the answer of another sentinel counts
+	sentinelPublishConfigPeriod = 8 * time.Second  // how long a replica has to report the wrong role before it's fixed
+	sentinelSlaveReconfTimeout  = 10 * time.Second
+)
+
+// Checks the instances every sentinelTimerPeriod: which ones are down, whether enough
+// sentinels agree a master is, and the failovers.
+func sentinelTimer() {
+	for range time.Tick(sentinelTimerPeriod) {
+		executionLock.Lock()
+		for _, master := range SENTINEL.masters {
+			sentinelCheckSubjectivelyDown(master, master.SentinelInstance)
+			for _, replica := range master.replicas {
+				sentinelCheckSubjectivelyDown(master, replica)
+			}
+			for _, sentinel := range master.sentinels {
+				sentinelCheckSubjectivelyDown(master, sentinel)
+			}
+			sentinelCheckObjectivelyDown(master)
+			if master.failoverState == sentinelFailoverNone && sentinelShouldStartFailover(master) {
+				sentinelStartFailover(master)
+			}
+			sentinelFailoverStateMachine(master)
+		}
+		executionLock.Unlock()
+	}
+}
+
+// No valid reply to PING for down-after-milliseconds, or a master reporting being a replica
+// for a while: subjectively down, as far as this sentinel can tell.
+func sentinelCheckSubjectivelyDown(master *SentinelMaster, inst *SentinelInstance) {
+	now := time.Now()
+	down := now.Sub(inst.lastAvail) > master.downAfter
+	if inst.kind == "master" && inst.roleReported == "slave" &&
+		now.Sub(inst.roleReportedTime) > master.downAfter+2*sentinelInfoPeriod {
+		down = true
+	}
+
+	if down && !inst.sdown {
+		inst.sdown, inst.sdownSince = true, now
+		sentinelEvent("+sdown", master, inst, "")
+	} else if !down && inst.sdown {
+		inst.sdown = false
+		sentinelEvent("-sdown", master, inst, "")
+	}
+}
+
+// Enough sentinels (the quorum, counting this one) think the master is down: objectively down.
+func sentinelCheckObjectivelyDown(master *SentinelMaster) {
+	votes := 0
+	if master.sdown {
+		votes++
+		for _, sentinel := range master.sentinels {
+			if time.Since(sentinel.masterDownReply) > sentinelMasterDownReplyTTL {
+				sentinel.masterDown = false // too old to go by
+			}
+			if sentinel.masterDown {
+				votes++
+			}
+		}
+	}
+
+	down := votes >= master.quorum
+	if down && !master.odown {
+		master.odown, master.odownSince = true, time.Now()
+		sentinelEvent("+odown", master, master.SentinelInstance, fmt.Sprintf("#quorum %d/%d", votes, master.quorum))
+	} else if !down && master.odown {
+		master.odown = false
+		sentinelEvent("-odown", master, master.SentinelInstance, "")
+	}
+}
+
+// A failover starts once the master is objectively down, unless one was tried recently (by
+// this sentinel, or another one it voted for).
+func sentinelShouldStartFailover(master *SentinelMaster) bool {
+	if !master.odown {
+		return false
+	}
+	if time.Since(master.failoverStartTime) < 2*master.failoverTimeout {
+		return false
+	}
+	return true
+}
+
+// Starts trying to fail the master over, in a new epoch. The other sentinels get asked for their
+// vote from now on (see _sentinelAskMasterState), after a random delay so that sentinels
+// starting together don't split the votes every time.
+func sentinelStartFailover(master *SentinelMaster) {
+	SENTINEL.currentEpoch++
+	master.failoverEpoch = SENTINEL.currentEpoch
+	sentinelEvent("+new-epoch", nil, nil, strconv.Itoa(SENTINEL.currentEpoch))
+	sentinelEvent("+try-failover", master, master.SentinelInstance, "")
+	sentinelSetFailoverState(master, sentinelFailoverWaitStart)
+	master.failoverStartTime = time.Now().Add(time.Duration(rand.Int63n(int64(time.Second))))
+}
+
+func sentinelSetFailoverState(master *SentinelMaster, state int) {
+	master.failoverState = state
+	master.failoverStateTime = time.Now()
+}
+
+// A sentinel (or this one) asks for our vote to fail the master over in epoch. The first to
+// ask in an epoch gets it. Returns who we voted for, and in which epoch.
+func sentinelVoteLeader(master *SentinelMaster, epoch int, runID string) (string, int) {
+	if epoch > SENTINEL.currentEpoch {
+		SENTINEL.currentEpoch = epoch
+		sentinelEvent("+new-epoch", nil, nil, strconv.Itoa(epoch))
+	}
+	if master.leaderEpoch < epoch && SENTINEL.currentEpoch <= epoch {
+		master.leader, master.leaderEpoch = runID, SENTINEL.currentEpoch
+		sentinelEvent("+vote-for-leader", master, master.SentinelInstance, fmt.Sprintf("%s %d", runID, master.leaderEpoch))
+		if runID != SENTINEL.myID {
+			// Giving the other one a chance before trying ourselves.
+			master.failoverStartTime = time.Now().Add(time.Duration(rand.Int63n(int64(time.Second))))
+		}
+	}
+	return master.leader, master.leaderEpoch
+}
+
+// The sentinel elected to fail the master over in epoch: the one with the most votes, if it
+// has both a majority of the sentinels and the quorum. Empty if there is none (yet).
+func sentinelGetLeader(master *SentinelMaster, epoch int) string {
+	votes := make(map[string]int)
+	for _, sentinel := range master.sentinels {
+		if sentinel.leader != "" && sentinel.leaderEpoch == epoch {
+			votes[sentinel.leader]++
+		}
+	}
+
+	// Our own vote goes to whoever is winning, or to ourselves.
+	winner, mostVotes := "", 0
+	for runID, n := range votes {
+		if n > mostVotes || (n == mostVotes && runID < winner) {
+			winner, mostVotes = runID, n
+		}
+	}
+	if winner == "" {
+		winner = SENTINEL.myID
+	}
+	leader, _ := sentinelVoteLeader(master, epoch, winner)
+	if master.leaderEpoch == epoch {
+		votes[leader]++
+	}
+
+	winner, mostVotes = "", 0
+	for runID, n := range votes {
+		if n > mostVotes {
+			winner, mostVotes = runID, n
+		}
+	}
+	voters := len(master.sentinels) + 1
+	if mostVotes < voters/2+1 || mostVotes < master.quorum {
+		return ""
+	}
+	return winner
+}
+
+// The replica to promote: one that is reachable, got its INFO refreshed lately, isn't
+// excluded by replica-priority 0 and wasn't cut off from the master for too long. The lowest
+// priority wins, then the most data (replication offset), then the lowest run id.
+func sentinelSelectReplica(master *SentinelMaster) *SentinelInstance {
+	maxMasterLinkDown := master.downAfter * 10
+	if master.sdown {
+		maxMasterLinkDown += time.Since(master.sdownSince)
+	}
+	infoValidity := 5 * sentinelPingPeriod
+	if master.sdown {
+		infoValidity = 3 * sentinelInfoPeriod
+	}
+
+	candidates := []*SentinelInstance{}
+	for _, replica := range master.replicas {
+		switch {
+		case replica.sdown, !replica.connected, replica.priority == 0,
+			time.Since(replica.lastAvail) > 5*sentinelPingPeriod,
+			time.Since(replica.infoRefresh) > infoValidity,
+			replica.masterLinkDown > maxMasterLinkDown:
+			continue
+		}
+		candidates = append(candidates, replica)
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.priority != b.priority {
+			return a.priority < b.priority
+		}
+		if a.replOffset != b.replOffset {
+			return a.replOffset > b.replOffset
+		}
+		return a.runID < b.runID
+	})
+	return candidates[0]
+}
+
+func sentinelFailoverStateMachine(master *SentinelMaster) {
+	switch master.failoverState {
+	case sentinelFailoverWaitStart:
+		_sentinelFailoverWaitStart(master)
+	case sentinelFailoverSelectSlave:
+		_sentinelFailoverSelectSlave(master)
+	case sentinelFailoverSendSlaveofNoOne:
+		_sentinelFailoverSendSlaveofNoOne(master)
+	case sentinelFailoverWaitPromotion:
+		if time.Since(master.failoverStateTime) > master.failoverTimeout {
+			sentinelEvent("-failover-abort-slave-timeout", master, master.SentinelInstance, "")
+			sentinelAbortFailover(master)
+		}
+	case sentinelFailoverReconfSlaves:
+		_sentinelFailoverReconfSlaves(master)
+	case sentinelFailoverUpdateConfig:
+		sentinelSwitchMaster(master, master.promoted.host, master.promoted.port)
+	}
+}
+
+// Waits to be elected by the other sentinels (a forced failover doesn't need to be).
+func _sentinelFailoverWaitStart(master *SentinelMaster) {
+	if time.Now().Before(master.failoverStartTime) {
+		return // the random delay of sentinelStartFailover
+	}
+	leader := ""
+	if !master.forceFailover {
+		leader = sentinelGetLeader(master, master.failoverEpoch)
+	}
+	if leader != SENTINEL.myID && !master.forceFailover {
+		electionTimeout := min(sentinelElectionTimeout, master.failoverTimeout)
+		if time.Since(master.failoverStartTime) > electionTimeout {
+			sentinelEvent("-failover-abort-not-elected", master, master.SentinelInstance, "")
+			sentinelAbortFailover(master)
+		}
+		return
+	}
+	sentinelEvent("+elected-leader", master, master.SentinelInstance, "")
+	sentinelEvent("+failover-state-select-slave", master, master.SentinelInstance, "")
+	sentinelSetFailoverState(master, sentinelFailoverSelectSlave)
+}
+
+func _sentinelFailoverSelectSlave(master *SentinelMaster) {
+	replica := sentinelSelectReplica(master)
+	if replica == nil {
+		sentinelEvent("-failover-abort-no-good-slave", master, master.SentinelInstance, "")
+		sentinelAbortFailover(master)
+		return
+	}
+	sentinelEvent("+selected-slave", master, replica, "")
+	master.promoted = replica
+	sentinelEvent("+failover-state-send-slaveof-noone", master, replica, "")
+	sentinelSetFailoverState(master, sentinelFailoverSendSlaveofNoOne)
+}
+
+func _sentinelFailoverSendSlaveofNoOne(master *SentinelMaster) {
+	if !master.promoted.connected {
+		if time.Since(master.failoverStateTime) > master.failoverTimeout {
+			sentinelEvent("-failover-abort-slave-timeout", master, master.SentinelInstance, "")
+			sentinelAbortFailover(master)
+		}
+		return
+	}
+	sentinelSendReplicaOf(master, master.promoted, "NO", "ONE")
+	sentinelEvent("+failover-state-wait-promotion", master, master.promoted, "")
+	sentinelSetFailoverState(master, sentinelFailoverWaitPromotion)
+}
+
+// Points the replicas at the new master, parallel-syncs at a time, until they are all synced
+// with it (or the failover timed out, the next ones will be fixed by then anyway).
+func _sentinelFailoverReconfSlaves(master *SentinelMaster) {
+	timedOut := time.Since(master.failoverStateTime) > master.failoverTimeout
+	inProgress, done := 0, true
+	for _, replica := range master.replicas {
+		if replica == master.promoted {
+			continue
+		}
+		if replica.reconf == sentinelReconfSent && time.Since(replica.reconfSentTime) > sentinelSlaveReconfTimeout {
+			sentinelEvent("-slave-reconf-sent-timeout", master, replica, "")
+			replica.reconf = sentinelReconfNone
+		}
+		switch replica.reconf {
+		case sentinelReconfSent, sentinelReconfInProgress:
+			inProgress++
+			done = false
+		case sentinelReconfNone:
+			if !replica.sdown {
+				done = false
+			}
+		}
+	}
+
+	if done || timedOut {
+		if timedOut {
+			sentinelEvent("+failover-end-for-timeout", master, master.SentinelInstance, "")
+		}
+		sentinelEvent("+failover-end", master, master.SentinelInstance, "")
+		sentinelSetFailoverState(master, sentinelFailoverUpdateConfig)
+		return
+	}
+
+	port := strconv.Itoa(master.promoted.port)
+	for _, replica := range master.replicas {
+		if inProgress >= master.parallelSyncs {
+			break
+		}
+		if replica == master.promoted || replica.reconf != sentinelReconfNone || replica.sdown || !replica.connected {
+			continue
+		}
+		sentinelSendReplicaOf(master, replica, master.promoted.host, port)
+		replica.reconf, replica.reconfSentTime = sentinelReconfSent, time.Now()
+		sentinelEvent("+slave-reconf-sent", master, replica, "")
+		inProgress++
+	}
+}
+
+func sentinelAbortFailover(master *SentinelMaster) {
+	sentinelSetFailoverState(master, sentinelFailoverNone)
+	master.forceFailover = false
+	master.promoted = nil
+	for _, replica := range master.replicas {
+		replica.reconf = sentinelReconfNone
+	}
+}
+
+// What the INFO of a replica means for the failovers: the promoted replica reporting being a
+// master, the others following it. Outside of failovers, replicas following another master (or
+// none) get pointed back at ours, once their role looks settled.
+func sentinelCheckReplicaRole(master *SentinelMaster, replica *SentinelInstance) {
+	if replica.roleReported == "master" {
+		if replica == master.promoted && master.failoverState == sentinelFailoverWaitPromotion {
+			master.configEpoch = master.failoverEpoch
+			sentinelEvent("+promoted-slave", master, replica, "")
+			sentinelEvent("+failover-state-reconf-slaves", master, master.SentinelInstance, "")
+			sentinelSetFailoverState(master, sentinelFailoverReconfSlaves)
+			return
+		}
+		if master.failoverState == sentinelFailoverNone && !master.sdown &&
+			time.Since(replica.roleReportedTime) > sentinelPublishConfigPeriod {
+			sentinelEvent("+convert-to-slave", master, replica, "")
+			sentinelSendReplicaOf(master, replica, master.host, strconv.Itoa(master.port))
+			replica.roleReportedTime = time.Now()
+		}
+		return
+	}
+	if replica.roleReported != "slave" {
+		return
+	}
+
+	followsMaster := replica.masterHost == master.host && replica.masterPort == master.port
+	if master.failoverState == sentinelFailoverNone && !master.sdown && !followsMaster &&
+		time.Since(replica.roleReportedTime) > sentinelPublishConfigPeriod {
+		sentinelEvent("+fix-slave-config", master, replica, "")
+		sentinelSendReplicaOf(master, replica, master.host, strconv.Itoa(master.port))
+		replica.roleReportedTime = time.Now() // giving it time to switch before trying again
+		return
+	}
+
+	if master.failoverState != sentinelFailoverReconfSlaves || master.promoted == nil {
+		return
+	}
+	followsPromoted := replica.masterHost == master.promoted.host && replica.masterPort == master.promoted.port
+	if replica.reconf == sentinelReconfSent && followsPromoted {
+		replica.reconf = sentinelReconfInProgress
+		sentinelEvent("+slave-reconf-inprog", master, replica, "")
+	}
+	if replica.reconf == sentinelReconfInProgress && replica.masterLinkUp {
+		replica.reconf = sentinelReconfDone
+		sentinelEvent("+slave-reconf-done", master, replica, "")
+	}
+}
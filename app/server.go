@@ -5,15 +5,35 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 // Some global variables. Stores the in-memory stores and server configuration values.
 var RDB = RedisRDB{}
 var CONFIG = RedisConfig{
-	transactions: make(map[net.Conn]RedisTransaction),
-	replicas:     make([]Replica, 0),
+	clients:     make(map[net.Conn]*RedisClient),
+	replicas:    make([]*Replica, 0),
+	watchedKeys: make(map[WatchedKey]map[net.Conn]struct{}),
+
+	pubsubChannels:   make(map[string]map[*RedisClient]struct{}),
+	pubsubPatterns:   make(map[string]map[*RedisClient]struct{}),
+	trackingTable:    make(map[string]map[int]struct{}),
+	trackingPrefixes: make(map[string]map[int]struct{}),
+}
+
+// Every command runs while holding this lock, so each command (and a whole MULTI/EXEC
+// block) is atomic with respect to the other clients. Blocking commands let go of it
+// while they wait, see blockWithoutExecutionLock.
+var executionLock sync.Mutex
+
+// Version reported to the clients (HELLO, INFO).
+const redisVersion = "7.2.4"
+
+var streamWaiters = StreamWaiters{
+	waiters: make(map[string]map[chan struct{}]struct{}),
 }
 
 func main() {
@@ -25,22 +45,134 @@ func main() {
 	dirFlag := flag.String("dir", "dump", "rdb store directory")
 	dbFileNameFlag := flag.String("dbfilename", "dump.rdb", "rdb store filename")
 	portFlag := flag.Int("port", 6379, "the port that this redis server will use to run")
+	databasesFlag := flag.Int("databases", 16, "number of logical databases (SELECT)")
 	replicaOfFlag := flag.String("replicaof", "master", "if slave, address and port of master")
+	requirePassFlag := flag.String("requirepass", "", "password clients need to AUTH with (password of the default user)")
+	aclFileFlag := flag.String("aclfile", "", "file to load the acl users from (ACL LOAD/SAVE)")
+	notifyFlag := flag.String("notify-keyspace-events", "", "classes of keyspace events to publish over pub/sub (K, E, g, $, x...)")
+	replBacklogSizeFlag := flag.String("repl-backlog-size", strconv.Itoa(defaultReplBacklogSize), "size of the replication backlog partial resyncs are served from (1mb, 512kb...)")
+	replicaReadOnlyFlag := flag.String("replica-read-only", "yes", "reject writes from clients other than the master while a replica (yes/no)")
+	replicaServeStaleDataFlag := flag.String("replica-serve-stale-data", "yes", "keep serving clients while the link to the master is down (yes/no)")
+	minReplicasToWriteFlag := flag.Int("min-replicas-to-write", 0, "refuse writes unless at least this many replicas acked recently (0 to disable)")
+	minReplicasMaxLagFlag := flag.Int("min-replicas-max-lag", 10, "seconds since its last ack for a replica to count for min-replicas-to-write")
+	replDisklessSyncFlag := flag.String("repl-diskless-sync", "no", "stream the rdb of full resyncs straight to the replicas, instead of producing all of it first (yes/no)")
+	replDisklessSyncDelayFlag := flag.Int("repl-diskless-sync-delay", 5, "seconds to wait for more replicas before a diskless transfer starts")
+	replDisklessLoadFlag := flag.String("repl-diskless-load", "swapdb", "how a replica loads the rdb from its master: disabled (saved to disk first), on-empty-db, swapdb")
+	rdbKeySaveDelayFlag := flag.Int("rdb-key-save-delay", 0, "microseconds to sleep for every key of an rdb sent to replicas (for testing slow syncs)")
+	maxmemoryPolicyFlag := flag.String("maxmemory-policy", "noeviction", "eviction policy (decides between LRU and LFU access data for OBJECT)")
+	replicaPriorityFlag := flag.Int("replica-priority", 100, "sentinels promote the replicas with the lowest priority first, never the ones with 0")
+	sentinelFlag := flag.Bool("sentinel", false, "run as a sentinel, monitoring the masters of the config file given as argument (--sentinel sentinel.conf)")
 
 	flag.Parse()
 
+	// The sentinel config file can come before the other flags (--sentinel sentinel.conf --port 26380).
+	sentinelConfig := ""
+	if *sentinelFlag && flag.NArg() > 0 {
+		sentinelConfig = flag.Arg(0)
+		flag.CommandLine.Parse(flag.Args()[1:])
+	}
+
 	dir := *dirFlag
 	port := *portFlag
 	replicaOf := *replicaOfFlag
 	dbFileName := *dbFileNameFlag
 
 	CONFIG.port = port
+	CONFIG.databases = *databasesFlag
+	if CONFIG.databases < 1 {
+		logAndExit("error during startup", fmt.Errorf("databases has to be at least 1"))
+	}
 	CONFIG.rdbDir = dir
 	CONFIG.rdbDbFileName = dbFileName
+	CONFIG.requirePass = *requirePassFlag
+
+	notifyClasses, err := parseKeyspaceEvents(*notifyFlag)
+	if err != nil {
+		logAndExit("invalid notify-keyspace-events", err)
+	}
+	CONFIG.notifyKeyspaceEvents = notifyClasses
+
+	if !validMaxmemoryPolicy(*maxmemoryPolicyFlag) {
+		logAndExit("invalid maxmemory-policy", fmt.Errorf("unknown policy '%s'", *maxmemoryPolicyFlag))
+	}
+	CONFIG.maxmemoryPolicy = strings.ToLower(*maxmemoryPolicyFlag)
+
+	if CONFIG.replicaReadOnly, err = parseYesNo(*replicaReadOnlyFlag); err != nil {
+		logAndExit("invalid replica-read-only", err)
+	}
+	if CONFIG.replicaServeStaleData, err = parseYesNo(*replicaServeStaleDataFlag); err != nil {
+		logAndExit("invalid replica-serve-stale-data", err)
+	}
+
+	if *minReplicasToWriteFlag < 0 || *minReplicasMaxLagFlag < 0 {
+		logAndExit("invalid min-replicas options", fmt.Errorf("have to be non negative"))
+	}
+	CONFIG.minReplicasToWrite = *minReplicasToWriteFlag
+	CONFIG.minReplicasMaxLag = *minReplicasMaxLagFlag
+
+	if CONFIG.replDisklessSync, err = parseYesNo(*replDisklessSyncFlag); err != nil {
+		logAndExit("invalid repl-diskless-sync", err)
+	}
+	if !validDisklessLoad(*replDisklessLoadFlag) {
+		logAndExit("invalid repl-diskless-load", fmt.Errorf("unknown value '%s'", *replDisklessLoadFlag))
+	}
+	CONFIG.replDisklessLoad = strings.ToLower(*replDisklessLoadFlag)
+	if *replDisklessSyncDelayFlag < 0 || *rdbKeySaveDelayFlag < 0 {
+		logAndExit("invalid repl-diskless-sync-delay/rdb-key-save-delay", fmt.Errorf("have to be non negative"))
+	}
+	CONFIG.replDisklessSyncDelay = *replDisklessSyncDelayFlag
+	CONFIG.rdbKeySaveDelay = *rdbKeySaveDelayFlag
+
+	backlogSize, err := parseMemory(*replBacklogSizeFlag)
+	if err != nil || backlogSize < minReplBacklogSize {
+		logAndExit("invalid repl-backlog-size", fmt.Errorf("has to be at least %d bytes", minReplBacklogSize))
+	}
+	CONFIG.replBacklogSize = backlogSize
+
+	if *replicaPriorityFlag < 0 {
+		logAndExit("invalid replica-priority", fmt.Errorf("has to be non negative"))
+	}
+	CONFIG.replicaPriority = *replicaPriorityFlag
+	CONFIG.runID = generateReplicationID()
+
+	if *sentinelFlag {
+		if sentinelConfig == "" || flag.NArg() > 0 {
+			logAndExit("error during startup", fmt.Errorf("sentinel mode needs the path of its config file"))
+		}
+		configPort, err := loadSentinelConfig(sentinelConfig)
+		if err != nil {
+			logAndExit("error reading sentinel config", err)
+		}
+
+		// --port goes first, then the port of the config file.
+		portGiven := false
+		flag.Visit(func(f *flag.Flag) { portGiven = portGiven || f.Name == "port" })
+		switch {
+		case portGiven:
+		case configPort != 0:
+			CONFIG.port = configPort
+		default:
+			CONFIG.port = sentinelDefaultPort
+		}
+
+		CONFIG.sentinelMode = true
+		RDB = setupRDB(CONFIG.rdbDir, "") // no dataset, just something for the clients to select
+		setupACL(*aclFileFlag, CONFIG.requirePass)
+		startSentinel()
+		startServer()
+		return
+	}
+
+	// Every server starts a replication history of its own. Replicas adopt their master's once they sync.
+	CONFIG.masterReplID = generateReplicationID()
+	clearReplicationID2()
 
 	// Read stored RDB.
 	RDB = setupRDB(CONFIG.rdbDir, CONFIG.rdbDbFileName)
 
+	// Setup the acl users.
+	setupACL(*aclFileFlag, CONFIG.requirePass)
+
 	if replicaOf != "master" { // has to be a replica, with the master's ip and port provided in 'replicaof'
 		CONFIG.isSlave = true
 		r := strings.Split(replicaOf, " ")
@@ -50,20 +182,12 @@ func main() {
 		}
 		CONFIG.masterHost = r[0]
 		CONFIG.masterPort = r[1]
-
-		masterConn := connectToMaster()
-
-		time.Sleep(100 * time.Millisecond)
-
-		go handleConnection(masterConn, true) // start listening to propagation requests from master
-	} else {
-		CONFIG.masterReplOffset = 0
-		CONFIG.masterReplID = "8371b4fb1155b71f4a04d3e1bc3e18c4a990aeeb"
+		CONFIG.replState = replStateConnect
 	}
+	go replicationLoop() // connects to the master (if any, now or after REPLICAOF), and keeps listening to its propagation requests
 
-	// Giving the master a chance to sync up with this replica. 2 seconds might seem
-	//  excessive, it is, but I can't seem to avoid race conditions otherwise.
-	time.Sleep(2000 * time.Millisecond)
+	// Collect the expired keys in the background.
+	startActiveExpireCycle()
 
 	// Start the server and begin listening to tcp connections for clients.
 	startServer()
@@ -94,19 +218,50 @@ func startServer() {
 // Go-routine to accept and respond to new connections. Keeps running to listen to
 // and keep the connection alive.
 func handleConnection(conn net.Conn, isMasterConn bool) {
-	defer conn.Close()
+	client := registerClient(conn, isMasterConn)
+	defer freeClient(client)
 
-	for { // infinite loop. keep trying to listen to incoming requests from that connection.
-		readBuffer, err := readFromConnection(conn)
-		if err != nil {
-			continue // discard and continue
+	// Reading happens on its own goroutine, so a client going away is noticed (and its
+	// disconnected chan closed) even while it is blocked in a command.
+	chunks := make(chan []byte, 16)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(chunks)
+		defer close(client.disconnected)
+		for {
+			chunk, err := readFromConnection(conn)
+			if err != nil {
+				return // connection closed (or broken), nothing more to read
+			}
+			select {
+			case chunks <- chunk:
+			case <-done:
+				return
+			}
 		}
+	}()
+
+	// Requests can arrive split across reads, or several at once. The query buffer holds on to
+	// the incomplete tail until the rest of it arrives.
+	queryBuffer := make([]byte, 0, 1024)
+	for chunk := range chunks {
+		queryBuffer = append(queryBuffer, chunk...)
 
-		respRequests, err := parseRESP(readBuffer)
+		respRequests, consumed, err := parseRESP(queryBuffer)
 		if err != nil {
-			logAndExit("Error parsing request", err)
+			sendResponse([]string{respEncodeError("ERR Protocol error: " + err.Error())}, client.output)
+			return
+		}
+		if consumed == 0 { // waiting for the rest of the request
+			continue
+		}
+
+		closeConnection := processRequests(respRequests, conn, isMasterConn)
+		queryBuffer = append(queryBuffer[:0], queryBuffer[consumed:]...)
+		if closeConnection {
+			return
 		}
-		processRequests(respRequests, readBuffer, conn, isMasterConn)
 	}
 }
 
@@ -120,57 +275,110 @@ func readFromConnection(conn net.Conn) ([]byte, error) {
 	return buffer[:n], nil
 }
 
-// Handles the read request and responds to the request.
-func processRequests(respRequests []RESP, readBuffer []byte, conn net.Conn, isMasterConn bool) {
-	if isMasterConn { // update the offset
-		CONFIG.masterReplOffset += len(readBuffer)
+// Handles the read requests and responds to them. Returns true if the connection should be
+// closed (CLIENT KILL on itself).
+func processRequests(respRequests []RESP, conn net.Conn, isMasterConn bool) bool {
+	executionLock.Lock()
+	output := CONFIG.clients[conn].output
+	if isMasterConn {
+		CONFIG.masterLastIO = time.Now()
 	}
+	executionLock.Unlock()
 
 	// address each request
 	for _, respRequest := range respRequests {
 		commands, _ := extractCommandFromRESP(respRequest)
-		if len(commands) < 1 {
-			continue
+		responses := []string{}
+		if len(commands) > 0 {
+			responses = processCommand(commands, respRequest.RawBytes, conn)
+		} else if isMasterConn {
+			executionLock.Lock()
+			feedReplicationStreamFromMaster(respRequest.RawBytes)
+			executionLock.Unlock()
 		}
 
-		responses, _ := executeResp(commands, conn)
 		if isMasterConn {
-			if commands[0] == "ping" || commands[0] == "set" { // should send no response
+			if len(commands) == 0 || commands[0] != "replconf" { // the master only ever expects replies to REPLCONF GETACK
 				continue
 			}
-		} else {
-			if commands[0] == "set" { // only one that propagates so far is set
-				CONFIG.masterReplOffset += len(readBuffer)
-				propagateCommands(readBuffer)
-			}
 		}
-		if len(responses) < 1 { // nothing to respond to
-			return
+		if len(commands) == 0 {
+			continue
 		}
-		if err := sendResponse(responses, conn); err != nil {
-			// TODO: Handle error
+		if len(responses) > 0 {
+			if err := sendResponse(responses, output); err != nil {
+				// TODO: Handle error
+			}
 		}
 
+		executionLock.Lock()
+		closeConnection := CONFIG.clients[conn].closeAfterReply
+		executionLock.Unlock()
+		if closeConnection {
+			return true
+		}
 	}
+	return false
 }
 
-// Send requests to the replica servers.
-func propagateCommands(request []byte) error {
-	var e error = nil
-	for _, replica := range CONFIG.replicas {
-		bytesWritten, err := replica.conn.Write(request)
-		replica.offset += bytesWritten
-		if err != nil {
-			e = err
+// Executes a single command (and propagates it) while holding the execution lock.
+// Responses are sent after the lock is released, a slow client shouldn't hold up the rest.
+// rawRequest is the command as it was read, what gets passed on if it came from our master.
+func processCommand(commands []string, rawRequest []byte, conn net.Conn) []string {
+	executionLock.Lock()
+	defer executionLock.Unlock()
+
+	client := CONFIG.clients[conn]
+	CONFIG.currentClient = client
+	defer func() { CONFIG.currentClient = nil }()
+	client.lastInteraction = time.Now()
+	client.lastCommand = commands[0]
+	if command, _, ok := lookupCommand(commands); ok {
+		client.lastCommand = command.name
+		if !waitWhilePaused(client, command) {
+			return nil // went away while paused
 		}
 	}
-	return e
+
+	responses, err := executeResp(commands, conn)
+	if err != nil {
+		responses = []string{respEncodeCommandError(err)}
+	}
+	propagatePendingCommands()
+	if client.isMaster {
+		// Our offset moves past each request of the master once it's applied, so REPLCONF
+		// GETACK reports the offset up to (not including) itself.
+		feedReplicationStreamFromMaster(rawRequest)
+	}
+	client.woff = CONFIG.masterReplOffset
+	return responses
 }
 
-// Write the responses to the client/server.
-func sendResponse(responses []string, conn net.Conn) error {
-	for _, response := range responses {
-		conn.Write([]byte(response))
+// Lets go of the execution lock while the calling command waits (XREAD BLOCK, WAIT), so
+// the other clients keep getting served in the meantime. The lock is held again once
+// wait returns, the caller has to re-check whatever it was waiting for. wait gets a chan
+// that is closed if the client disconnects meanwhile (nil if conn has no client).
+// Never called inside EXEC: a transaction keeps the lock until it's done.
+func blockWithoutExecutionLock(conn net.Conn, wait func(disconnected <-chan struct{})) {
+	client, exists := CONFIG.clients[conn]
+	if exists {
+		client.blocked = true
 	}
-	return nil
+	disconnected := clientDisconnected(conn)
+	currentClient := CONFIG.currentClient
+
+	executionLock.Unlock()
+	defer func() {
+		executionLock.Lock()
+		CONFIG.currentClient = currentClient
+		if exists {
+			client.blocked = false
+		}
+	}()
+	wait(disconnected)
+}
+
+// Write the responses to the client/server, after the messages queued for it (see output.go).
+func sendResponse(responses []string, output *OutputBuffer) error {
+	return output.write([]byte(strings.Join(responses, "")))
 }
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// An element being sorted, along with what it's sorted by.
+type sortItem struct {
+	value   string
+	score   float64 // numeric sort
+	byValue string  // alpha sort with BY
+	byFound bool    // false if the BY key (or hash field) doesn't exist
+}
+
+// SORT key [BY pattern] [LIMIT offset count] [GET pattern [GET pattern ...]] [ASC|DESC] [ALPHA]
+// [STORE destination] over lists, sets and sorted sets, and SORT_RO (the same, minus STORE).
+// BY and GET patterns get their first '*' replaced with the element, and read a string key, or
+// a hash field if they end with "->field". GET # is the element itself.
+func onSORT(commands []string, conn net.Conn) ([]string, error) {
+	db := currentDB()
+	key := commands[1]
+	readOnly := commands[0] == "sort_ro"
+
+	desc, alpha, dontsort := false, false, false
+	byPattern, storeKey := "", ""
+	getPatterns := []string{}
+	offset, count := 0, -1
+
+	syntaxError := []string{respEncodeError("ERR syntax error")}
+	args := commands[2:]
+	for i := 0; i < len(args); i++ {
+		left := len(args) - i - 1
+		switch strings.ToLower(args[i]) {
+		case "asc":
+			desc = false
+		case "desc":
+			desc = true
+		case "alpha":
+			alpha = true
+		case "limit":
+			if left < 2 {
+				return syntaxError, nil
+			}
+			var errOffset, errCount error
+			offset, errOffset = strconv.Atoi(args[i+1])
+			count, errCount = strconv.Atoi(args[i+2])
+			if errOffset != nil || errCount != nil {
+				return []string{respEncodeError("ERR value is not an integer or out of range")}, nil
+			}
+			i += 2
+		case "store":
+			if left < 1 || readOnly {
+				return syntaxError, nil
+			}
+			storeKey = args[i+1]
+			i++
+		case "by":
+			if left < 1 {
+				return syntaxError, nil
+			}
+			byPattern = args[i+1]
+			i++
+			// A pattern without '*' is the same BY for every element: no point sorting.
+			if !strings.Contains(byPattern, "*") {
+				dontsort = true
+			} else if !canReadAllKeys(conn) {
+				return []string{respEncodeError("ERR BY option of SORT denied due to insufficient ACL permissions.")}, nil
+			}
+		case "get":
+			if left < 1 {
+				return syntaxError, nil
+			}
+			if !canReadAllKeys(conn) {
+				return []string{respEncodeError("ERR GET option of SORT denied due to insufficient ACL permissions.")}, nil
+			}
+			getPatterns = append(getPatterns, args[i+1])
+			i++
+		default:
+			return syntaxError, nil
+		}
+	}
+
+	// Load the elements. A missing key sorts like an empty list.
+	var elements []string
+	if obj := db.lookupKeyRead(key); obj != nil {
+		switch value := obj.value.(type) {
+		case *RedisList:
+			elements = append(elements, value.elements...)
+		case RedisSet:
+			for member := range value {
+				elements = append(elements, member)
+			}
+			// Sets have no order of their own. Sorting them anyway keeps the output (and
+			// what STORE writes on the master and the replicas) the same every time.
+			if dontsort {
+				sort.Strings(elements)
+			}
+		case *RedisSortedSet:
+			elements = value.sortedMembers()
+			if dontsort && desc {
+				for i, j := 0, len(elements)-1; i < j; i, j = i+1, j-1 {
+					elements[i], elements[j] = elements[j], elements[i]
+				}
+			}
+		default:
+			return []string{respEncodeError(wrongTypeError)}, nil
+		}
+	}
+
+	items := make([]sortItem, len(elements))
+	for i, element := range elements {
+		items[i].value = element
+	}
+
+	if !dontsort {
+		for i := range items {
+			byValue, found := items[i].value, true
+			if byPattern != "" {
+				byValue, found = _sortLookupPattern(db, byPattern, items[i].value)
+			}
+			if alpha {
+				items[i].byValue, items[i].byFound = byValue, found
+			} else if found {
+				score, err := strconv.ParseFloat(strings.TrimSpace(byValue), 64)
+				if err != nil || math.IsNaN(score) {
+					return []string{respEncodeError("ERR One or more scores can't be converted into double")}, nil
+				}
+				items[i].score = score
+			}
+		}
+
+		sort.Slice(items, func(i, j int) bool {
+			cmp := _sortCompare(items[i], items[j], alpha, byPattern != "")
+			if desc {
+				return cmp > 0
+			}
+			return cmp < 0
+		})
+	}
+
+	// LIMIT
+	start := offset
+	if start < 0 {
+		start = 0
+	}
+	end := len(items)
+	if count >= 0 && count < end-start { // not start+count, that can overflow
+		end = start + count
+	}
+	if start > end {
+		start = end
+	}
+	items = items[start:end]
+
+	// Build the output: the elements themselves, or whatever the GET patterns point at.
+	output := make([]string, 0, len(items)*max(len(getPatterns), 1))
+	found := make([]bool, 0, cap(output))
+	for _, item := range items {
+		if len(getPatterns) == 0 {
+			output = append(output, item.value)
+			found = append(found, true)
+			continue
+		}
+		for _, pattern := range getPatterns {
+			value, exists := _sortLookupPattern(db, pattern, item.value)
+			output = append(output, value)
+			found = append(found, exists)
+		}
+	}
+
+	if storeKey != "" {
+		// Missing values are stored as empty strings. An empty result just deletes the destination.
+		if len(output) > 0 {
+			db.setKey(storeKey, newObject(objList, &RedisList{elements: output}))
+			notifyKeyspaceEvent(notifyList, "sortstore", storeKey, db.id)
+		} else if db.deleteKey(storeKey) {
+			notifyKeyspaceEvent(notifyGeneric, "del", storeKey, db.id)
+		}
+		signalModifiedKey(db, storeKey)
+		return []string{respEncodeInteger(len(output))}, nil
+	}
+
+	encoded := make([]string, len(output))
+	for i, value := range output {
+		encoded[i] = "$-1\r\n"
+		if found[i] {
+			encoded[i] = respEncodeBulkString(value)
+		}
+	}
+	return []string{respEncodeArray(encoded)}, nil
+}
+
+// Compares two elements being sorted, like strings.Compare. Ties are broken by comparing the
+// elements themselves, so the order doesn't depend on where they started.
+func _sortCompare(a, b sortItem, alpha bool, by bool) int {
+	cmp := 0
+	switch {
+	case !alpha:
+		if a.score < b.score {
+			cmp = -1
+		} else if a.score > b.score {
+			cmp = 1
+		}
+	case by: // elements without a BY value go first
+		if a.byFound && b.byFound {
+			cmp = strings.Compare(a.byValue, b.byValue)
+		} else if a.byFound {
+			cmp = 1
+		} else if b.byFound {
+			cmp = -1
+		}
+	default:
+		cmp = strings.Compare(a.value, b.value)
+	}
+
+	if cmp == 0 {
+		cmp = strings.Compare(a.value, b.value)
+	}
+	return cmp
+}
+
+// Resolves a BY/GET pattern for the element: the first '*' is replaced with it, and the
+// resulting key is read as a string, or as a hash if the pattern ends with "->field".
+// Returns false if there is no such key (or field), or it holds something else.
+func _sortLookupPattern(db *RedisDatabase, pattern string, element string) (string, bool) {
+	if pattern == "#" {
+		return element, true
+	}
+
+	star := strings.IndexByte(pattern, '*')
+	if star < 0 {
+		return "", false
+	}
+
+	keyPattern, field := pattern, ""
+	if arrow := strings.Index(pattern[star+1:], "->"); arrow >= 0 && star+1+arrow+2 < len(pattern) {
+		keyPattern, field = pattern[:star+1+arrow], pattern[star+1+arrow+2:]
+	}
+	key := keyPattern[:star] + element + keyPattern[star+1:]
+
+	obj := db.lookupKeyRead(key)
+	if obj == nil {
+		return "", false
+	}
+	if field != "" {
+		hash, isHash := obj.value.(RedisHash)
+		if !isHash {
+			return "", false
+		}
+		value, exists := hash[field]
+		return value, exists
+	}
+	value, isString := obj.value.(string)
+	return value, isString
+}
+
+// Keys for SORT: the one being sorted, and the STORE destination if there is one.
+func sortKeys(commands []string) []string {
+	keys := []string{commands[1]}
+	for i := 2; i < len(commands); i++ {
+		switch strings.ToLower(commands[i]) {
+		case "limit":
+			i += 2
+		case "by", "get":
+			i++
+		case "store":
+			if i+1 < len(commands) {
+				keys = append(keys, commands[i+1])
+			}
+			i++
+		}
+	}
+	return keys
+}
+
+// SORT only reads the sorted key, the STORE destination is only written.
+func sortKeyAccess(commands []string) []string {
+	access := []string{"R"}
+	for range sortKeys(commands)[1:] {
+		access = append(access, "W")
+	}
+	return access
+}
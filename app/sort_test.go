@@ -0,0 +1,30 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+// LIMIT takes any offset and count, extreme ones included.
+func TestSortLimit(t *testing.T) {
+	RDB = RedisRDB{databases: []*RedisDatabase{newDatabase(0)}}
+	RDB.databases[0].setKey("k", newObject(objSet, RedisSet{"3": {}, "1": {}, "2": {}}))
+
+	tests := []struct {
+		offset, count string
+		want          int
+	}{
+		{"0", "-1", 3},
+		{"1", "1", 1},
+		{"1", "9223372036854775807", 2},
+		{"9223372036854775807", "9223372036854775807", 0},
+		{"-9223372036854775808", "2", 2},
+		{"5", "1", 0},
+	}
+	for _, test := range tests {
+		reply, _ := onSORT([]string{"sort", "k", "LIMIT", test.offset, test.count}, nil)
+		if want := "*" + strconv.Itoa(test.want) + "\r\n"; reply[0][:len(want)] != want {
+			t.Errorf("SORT k LIMIT %s %s = %q, want %d elements", test.offset, test.count, reply[0], test.want)
+		}
+	}
+}
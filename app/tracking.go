@@ -0,0 +1,342 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Pub/sub channel the invalidations are published on for RESP2 clients, through REDIRECT.
+const trackingChannel = "__redis__:invalidate"
+
+// Turns tracking on for the client, with the options already validated.
+func enableTracking(client *RedisClient, tracking ClientTracking) {
+	disableTracking(client)
+	client.tracking = tracking
+	client.tracking.enabled = true
+
+	if tracking.bcast {
+		if len(client.tracking.prefixes) == 0 {
+			client.tracking.prefixes = []string{""} // every key
+		}
+		for _, prefix := range client.tracking.prefixes {
+			clients, exists := CONFIG.trackingPrefixes[prefix]
+			if !exists {
+				clients = make(map[int]struct{})
+				CONFIG.trackingPrefixes[prefix] = clients
+			}
+			clients[client.id] = struct{}{}
+		}
+	}
+}
+
+// Turns tracking off for the client. The keys it read stay in the tracking table until
+// they are modified, the client just won't get the invalidations anymore.
+func disableTracking(client *RedisClient) {
+	for _, prefix := range client.tracking.prefixes {
+		clients := CONFIG.trackingPrefixes[prefix]
+		delete(clients, client.id)
+		if len(clients) == 0 {
+			delete(CONFIG.trackingPrefixes, prefix)
+		}
+	}
+	client.tracking = ClientTracking{}
+}
+
+// Called after every command that ran successfully. Remembers the keys a read-only
+// command fetched, so the client gets an invalidation once they change.
+func trackCommandKeys(command RedisCommand, commands []string, conn net.Conn) {
+	client, exists := CONFIG.clients[conn]
+	if !exists || !client.tracking.enabled {
+		return
+	}
+
+	// CLIENT CACHING applies to the command right after it (every command of a transaction).
+	caching := client.tracking.caching
+	if command.name != "client|caching" && !client.transaction.active && !CONFIG.inExec {
+		client.tracking.caching = false
+	}
+
+	if client.tracking.bcast || !commandInCategory(command, "read") || commandInCategory(command, "write") {
+		return
+	}
+	if (client.tracking.optin && !caching) || (client.tracking.optout && caching) {
+		return
+	}
+
+	for _, key := range commandKeys(command, commands) {
+		clients, exists := CONFIG.trackingTable[key]
+		if !exists {
+			clients = make(map[int]struct{})
+			CONFIG.trackingTable[key] = clients
+		}
+		clients[client.id] = struct{}{}
+	}
+}
+
+// Sends invalidations for the key to every client that might have it cached: the ones that
+// read it (it's forgotten after that, until they read it again), and the BCAST clients
+// with a matching prefix. Called for every modified key, see signalModifiedKey.
+func invalidateTrackedKey(key string) {
+	for id := range CONFIG.trackingTable[key] {
+		if client := clientByID(id); client != nil && client.tracking.enabled && !client.tracking.bcast {
+			sendInvalidation(client, []string{key})
+		}
+	}
+	delete(CONFIG.trackingTable, key)
+
+	for prefix, clients := range CONFIG.trackingPrefixes {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		for id := range clients {
+			if client := clientByID(id); client != nil {
+				sendInvalidation(client, []string{key})
+			}
+		}
+	}
+}
+
+// Sends an invalidation message for the keys to the client, or to the client it redirects to.
+// A nil keys list means "everything" (the keyspace was flushed).
+func sendInvalidation(client *RedisClient, keys []string) {
+	if client.tracking.noloop && client == CONFIG.currentClient {
+		return
+	}
+
+	target := client
+	if client.tracking.redirect != 0 {
+		target = clientByID(client.tracking.redirect)
+		if target == nil { // the redirect client is gone, let the tracking client know
+			if client.resp >= 3 {
+				writeToClient(client, respEncodePush([]string{
+					respEncodeBulkString("tracking-redir-broken"),
+					respEncodeInteger(client.tracking.redirect),
+				}, client.resp))
+			}
+			return
+		}
+	}
+
+	encodedKeys := "*-1\r\n"
+	if keys != nil {
+		encodedKeys = respEncodeStringArray(keys)
+	}
+
+	if target.resp >= 3 {
+		writeToClient(target, respEncodePush([]string{
+			respEncodeBulkString("invalidate"),
+			encodedKeys,
+		}, target.resp))
+		return
+	}
+
+	// RESP2 clients can only get them as pub/sub messages, if they are listening.
+	if _, subscribed := target.subscriptions[trackingChannel]; subscribed {
+		writeToClient(target, respEncodeArray([]string{
+			respEncodeBulkString("message"),
+			respEncodeBulkString(trackingChannel),
+			encodedKeys,
+		}))
+	}
+}
+
+// Sends an invalidation for everything to every tracking client. For when the whole
+// keyspace goes away.
+func invalidateAllTrackedKeys() {
+	for _, client := range CONFIG.clients {
+		if client.tracking.enabled {
+			sendInvalidation(client, nil)
+		}
+	}
+	CONFIG.trackingTable = make(map[string]map[int]struct{})
+}
+
+// Returns the client with the given id, nil if there is none.
+func clientByID(id int) *RedisClient {
+	for _, client := range CONFIG.clients {
+		if client.id == id {
+			return client
+		}
+	}
+	return nil
+}
+
+// CLIENT TRACKING ON|OFF [REDIRECT client-id] [PREFIX prefix [PREFIX prefix ...]] [BCAST]
+// [OPTIN] [OPTOUT] [NOLOOP]
+func _clientTracking(args []string, client *RedisClient) ([]string, error) {
+	tracking := ClientTracking{}
+	for i := 1; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "redirect":
+			if i+1 >= len(args) {
+				return []string{respEncodeError("ERR syntax error")}, nil
+			}
+			i++
+			id, err := strconv.Atoi(args[i])
+			if err != nil {
+				return []string{respEncodeError("ERR value is not an integer or out of range")}, nil
+			}
+			if id != client.id && clientByID(id) == nil {
+				return []string{respEncodeError("ERR The client ID you want redirect to does not exist")}, nil
+			}
+			tracking.redirect = id
+			if id == client.id {
+				tracking.redirect = 0
+			}
+		case "prefix":
+			if i+1 >= len(args) {
+				return []string{respEncodeError("ERR syntax error")}, nil
+			}
+			i++
+			tracking.prefixes = append(tracking.prefixes, args[i])
+		case "bcast":
+			tracking.bcast = true
+		case "optin":
+			tracking.optin = true
+		case "optout":
+			tracking.optout = true
+		case "noloop":
+			tracking.noloop = true
+		default:
+			return []string{respEncodeError("ERR syntax error")}, nil
+		}
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "on":
+	case "off":
+		disableTracking(client)
+		return []string{respEncodeString("OK")}, nil
+	default:
+		return []string{respEncodeError("ERR syntax error")}, nil
+	}
+
+	if len(tracking.prefixes) > 0 && !tracking.bcast {
+		return []string{respEncodeError("ERR PREFIX option requires BCAST mode to be enabled")}, nil
+	}
+	if tracking.optin && tracking.optout {
+		return []string{respEncodeError("ERR You can't use both OPTIN and OPTOUT")}, nil
+	}
+	if tracking.bcast && (tracking.optin || tracking.optout) {
+		return []string{respEncodeError("ERR OPTIN and OPTOUT are not compatible with BCAST")}, nil
+	}
+	if current := client.tracking; current.enabled {
+		if current.bcast != tracking.bcast {
+			return []string{respEncodeError("ERR You can't switch BCAST mode on/off before disabling tracking for this client, and then re-enabling it with a different mode.")}, nil
+		}
+		if current.optin != tracking.optin || current.optout != tracking.optout {
+			return []string{respEncodeError("ERR You can't switch OPTIN/OPTOUT mode before disabling tracking for this client, and then re-enabling it with a different mode.")}, nil
+		}
+		if current.bcast { // enabling again adds to the current prefixes
+			tracking.prefixes = append(append([]string{}, current.prefixes...), tracking.prefixes...)
+		}
+	}
+
+	// The prefixes of a client can't overlap, a key would get invalidated twice.
+	for i, prefix := range tracking.prefixes {
+		for _, other := range tracking.prefixes[:i] {
+			if prefix == other {
+				continue
+			}
+			if strings.HasPrefix(prefix, other) || strings.HasPrefix(other, prefix) {
+				return []string{respEncodeError(fmt.Sprintf("ERR Prefix '%s' overlaps with an existing prefix '%s'. Prefixes for a single client must not overlap.", prefix, other))}, nil
+			}
+		}
+	}
+	tracking.prefixes = uniqueStrings(tracking.prefixes)
+
+	enableTracking(client, tracking)
+	return []string{respEncodeString("OK")}, nil
+}
+
+// CLIENT CACHING YES|NO
+func _clientCaching(args []string, client *RedisClient) ([]string, error) {
+	if !client.tracking.enabled || (!client.tracking.optin && !client.tracking.optout) {
+		return []string{respEncodeError("ERR CLIENT CACHING can be called only when the client is in tracking mode with OPTIN or OPTOUT mode enabled")}, nil
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "yes":
+		if !client.tracking.optin {
+			return []string{respEncodeError("ERR CLIENT CACHING YES is only valid when tracking is enabled in OPTIN mode.")}, nil
+		}
+	case "no":
+		if !client.tracking.optout {
+			return []string{respEncodeError("ERR CLIENT CACHING NO is only valid when tracking is enabled in OPTOUT mode.")}, nil
+		}
+	default:
+		return []string{respEncodeError("ERR syntax error")}, nil
+	}
+	client.tracking.caching = true
+	return []string{respEncodeString("OK")}, nil
+}
+
+// CLIENT GETREDIR: -1 when not tracking, 0 when not redirecting.
+func _clientGetRedir(client *RedisClient) ([]string, error) {
+	if !client.tracking.enabled {
+		return []string{respEncodeInteger(-1)}, nil
+	}
+	return []string{respEncodeInteger(client.tracking.redirect)}, nil
+}
+
+// CLIENT TRACKINGINFO
+func _clientTrackingInfo(client *RedisClient) ([]string, error) {
+	tracking := client.tracking
+
+	flags := []string{}
+	redirect := -1
+	if !tracking.enabled {
+		flags = append(flags, "off")
+	} else {
+		redirect = tracking.redirect
+		flags = append(flags, "on")
+		if tracking.bcast {
+			flags = append(flags, "bcast")
+		}
+		if tracking.optin {
+			flags = append(flags, "optin")
+			if tracking.caching {
+				flags = append(flags, "caching-yes")
+			}
+		}
+		if tracking.optout {
+			flags = append(flags, "optout")
+			if tracking.caching {
+				flags = append(flags, "caching-no")
+			}
+		}
+		if tracking.noloop {
+			flags = append(flags, "noloop")
+		}
+		if tracking.redirect != 0 && clientByID(tracking.redirect) == nil {
+			flags = append(flags, "broken_redirect")
+		}
+	}
+
+	prefixes := []string{}
+	if tracking.bcast {
+		prefixes = tracking.prefixes
+	}
+
+	return []string{respEncodeMap([]string{
+		respEncodeBulkString("flags"), respEncodeStringArray(flags),
+		respEncodeBulkString("redirect"), respEncodeInteger(redirect),
+		respEncodeBulkString("prefixes"), respEncodeStringArray(prefixes),
+	}, client.resp)}, nil
+}
+
+// Returns the strings without duplicates, keeping the first occurrence of each.
+func uniqueStrings(strs []string) []string {
+	seen := make(map[string]struct{}, len(strs))
+	unique := make([]string, 0, len(strs))
+	for _, str := range strs {
+		if _, exists := seen[str]; exists {
+			continue
+		}
+		seen[str] = struct{}{}
+		unique = append(unique, str)
+	}
+	return unique
+}
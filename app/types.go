@@ -2,6 +2,7 @@ package main
 
 import (
 	"net"
+	"sync"
 	"time"
 )
 
@@ -39,11 +40,34 @@ type RESP struct {
 	respData RESPData // The meat of the resp request (String/Int/Bulk/Array/Error)
 }
 
-// Value stored in the in-memory key-value store.
-type RedisRecord struct {
-	value     string    // string value the key will correspond to
-	expires   bool      // will expire or not
-	expiresAt time.Time // time at which the value will be inaccessible. (Using a passive delete)
+// Value stored under a key in the keyspace, whatever its type. Expiry and the access
+// metadata (OBJECT IDLETIME/FREQ) live here, so they work the same for every type.
+type RedisObject struct {
+	objType     string      // what TYPE replies with (objString, objList...)
+	encoding    string      // what OBJECT ENCODING replies with. Only follows the value's size, see updateEncoding
+	value       interface{} // string, *RedisList, RedisSet, *RedisSortedSet, RedisHash or *RedisStream, depending on objType
+	expires     bool        // will expire or not
+	expiresAt   time.Time   // time at which the value will be inaccessible. (passive delete + active expire cycle)
+	lru         time.Time   // last time the key was accessed
+	lfuCounter  uint8       // logarithmic access frequency counter
+	lfuDecrTime time.Time   // last time lfuCounter was decayed
+	members     *ScanIndex  // members (hash fields) of a hashtable/skiplist encoded value, for HSCAN/SSCAN/ZSCAN
+}
+
+// List value. Elements in order, head first.
+type RedisList struct {
+	elements []string
+}
+
+// Set value.
+type RedisSet map[string]struct{}
+
+// Hash value, field -> value.
+type RedisHash map[string]string
+
+// Sorted set value, member -> score. Ordered by score (then member) when it's read, see sortedMembers.
+type RedisSortedSet struct {
+	scores map[string]float64
 }
 
 // Config values for the RDB used.
@@ -63,24 +87,36 @@ type StreamEntry struct {
 type RedisStream struct {
 	entries    map[string]*StreamEntry // Map of entries by ID
 	entryOrder []string                // Maintain the order of entry.
-	blockCh    chan string
 }
 
-type RedisStreamStore struct {
-	streams           map[string]RedisStream
-	lastStreamEntryID string // ID of the last inerted entry. This will let us check quickly for ops that require the last entry.
+// Registry of the clients blocked on XREAD, keyed by the stream key they are waiting on.
+// A stream doesn't need to exist to be waited on. Each waiter is signalled at most once
+// per wakeup (buffered chan), and re-checks the streams itself after waking up.
+type StreamWaiters struct {
+	mu      sync.Mutex
+	waiters map[string]map[chan struct{}]struct{}
+}
+
+// A single logical database (SELECT). Each one has a keyspace of its own.
+type RedisDatabase struct {
+	id        int                     // index of the database. changes on SWAPDB
+	keys      map[string]*RedisObject // the keyspace, values of every type
+	scanIndex *ScanIndex              // the same keys, bucketed for SCAN. Kept in sync by setKey/deleteKey
+	expires   *ScanIndex              // the keys with an expiry, sampled by the active expire cycle. Kept in sync by setKey/deleteKey/setExpire/removeExpire
 }
 
-type RedisKeyValueStore struct {
-	db map[string]RedisRecord
+// Hash table of strings, bucketed by hash. Only there for the SCAN family: a Go map can't
+// tell where an iteration left off, this can (the cursor is a bucket index).
+type ScanIndex struct {
+	buckets [][]string // always a power of two of them
+	size    int        // number of strings in the table
 }
 
 // RDB in-mem representation.
 type RedisRDB struct {
-	config        RDBConfig
-	keyValueStore RedisKeyValueStore // stores the key-value pairs (get/set)
-	streamStore   RedisStreamStore   // stores redis-streams, key is the stream name(key) (xadd/xread)
-	// auxFields map[string]string // Auxiliary fields (string just because)
+	config    RDBConfig
+	databases []*RedisDatabase  // every logical database, by index
+	auxFields map[string]string // Auxiliary fields (string just because)
 }
 
 // Stores configuration options for the current Redis Server.
@@ -90,24 +126,329 @@ type RedisConfig struct {
 	masterPort       string // port the master is running on (empty string if master server)
 	masterReplID     string // replication id of the master (empty string if slave)
 	masterReplOffset int    // replciation offset of the master
+	masterReplID2    string // previous replication id, still accepted by PSYNC up to secondReplOffset
+	secondReplOffset int    // first offset the previous replication id doesn't cover (-1 if there is none)
+	cachedMaster     bool   // the replication id/offset come from a sync with our master: PSYNC can try to continue from them
+
+	replState           int       // state of the link to our master (replStateNone if master)
+	masterLastIO        time.Time // last time something was received from the master
+	masterLinkDownSince time.Time // when the link to the master was lost (zero if it never was up)
+	masterDB            int       // database the master's stream SELECTed last, kept across reconnections
 
-	replicas []Replica // Stores the replicas connected to this server (if master)
+	replicaReadOnly       bool // replica-read-only: only the master can write to a replica
+	replicaServeStaleData bool // replica-serve-stale-data: replicas keep serving clients while the link to the master is down
+	minReplicasToWrite    int  // min-replicas-to-write: writes are refused with fewer good replicas than this (0 disables it)
+	minReplicasMaxLag     int  // min-replicas-max-lag: seconds since its last ACK for a replica to still count as good
+	replicaPriority       int  // replica-priority: sentinels promote replicas with a lower one first (0 never)
+
+	replBacklog     *ReplicationBacklog // latest bytes of the replication stream (nil until a replica shows up)
+	replBacklogSize int                 // size the backlog gets created with (repl-backlog-size)
+
+	replDisklessSync      bool   // repl-diskless-sync: full resyncs send the rdb framed by an EOF mark ($EOF:<mark>) instead of its length
+	replDisklessSyncDelay int    // repl-diskless-sync-delay: seconds to wait for more replicas before a diskless transfer
+	replDisklessLoad      string // repl-diskless-load: disabled, on-empty-db or swapdb. Whether replicas load the rdb without saving it first
+	rdbKeySaveDelay       int    // rdb-key-save-delay: microseconds to sleep per key sent to replicas, once the snapshot is taken (for tests)
+	fullSyncScheduled     bool   // a snapshot for the replicas waiting a full resync is about to be taken
+	fullSyncInProgress    bool   // a snapshot is being sent to replicas
+
+	replicas      []*Replica // Stores the replicas connected to this server (if master)
+	replicationDB int        // database the replication stream SELECTed last (-1 forces a SELECT before the next write)
+
+	dirty              int                 // changes made to the dataset so far. Writes that didn't change it aren't propagated
+	pendingPropagation []PropagatedCommand // writes waiting to be propagated once the running command is done
+	propagateAs        []string            // what the running command gets propagated as, if not itself (see rewriteCommandPropagation)
 
 	rdbDir        string // rdb config options
 	rdbDbFileName string // filename for the rdb to load
 	port          int    // port to bind the server to
+	databases     int    // number of logical databases (SELECT)
+
+	clients      map[net.Conn]*RedisClient // every connected client (including the master link and replicas)
+	nextClientID int                       // id for the next client to connect
+	pause        ClientPause               // CLIENT PAUSE state
+	failover     Failover                  // FAILOVER state
+	runID        string                    // random id of this run of the server (INFO server)
+	sentinelMode bool                      // --sentinel: monitors masters instead of serving data
+
+	watchedKeys map[WatchedKey]map[net.Conn]struct{} // connections WATCHing each key, so writes can flag their transactions as dirty.
+	inExec      bool                                 // currently running the queued commands of an EXEC. Blocking commands don't block.
+
+	currentClient *RedisClient // client whose command is running (nil while nothing runs)
+
+	pubsubChannels map[string]map[*RedisClient]struct{} // subscribers of each channel
+	pubsubPatterns map[string]map[*RedisClient]struct{} // subscribers of each pattern
+
+	trackingTable    map[string]map[int]struct{} // key -> ids of the clients that might have it cached (default tracking mode)
+	trackingPrefixes map[string]map[int]struct{} // BCAST prefix -> ids of the clients interested in it
+
+	notifyKeyspaceEvents int    // event classes published as keyspace notifications (notify-keyspace-events)
+	maxmemoryPolicy      string // only decides whether OBJECT reports LRU or LFU data, nothing is evicted
+
+	requirePass string   // password for the default user (empty means no password)
+	acl         RedisACL // acl users and the log of denied requests
+	masterConn  net.Conn // connection to the master (if slave). Commands from it skip auth and acl checks.
+
+	masterHandshakeConn net.Conn // connection to the master the handshake is being made on. REPLICAOF closes it
+}
+
+// State of a single connected client.
+type RedisClient struct {
+	id            int
+	conn          net.Conn
+	addr          string // address of the client
+	laddr         string // local address the client connected to
+	name          string // CLIENT SETNAME
+	libName       string // CLIENT SETINFO LIB-NAME
+	libVer        string // CLIENT SETINFO LIB-VER
+	user          string // acl user the client is authenticated as. empty if not authenticated (yet)
+	db            int    // selected database
+	isMaster      bool   // this is the link to our master
+	listeningPort int    // REPLCONF listening-port: the port a replica serves its own clients on
+	replCapaEOF   bool   // REPLCONF capa eof: the replica can load a diskless ($EOF:) rdb transfer
+	woff          int    // replication offset right after the client's last command. What its WAIT waits for
+	noEvict       bool   // CLIENT NO-EVICT
+	blocked       bool   // waiting in a blocking command (XREAD BLOCK, WAIT)
+	lastCommand   string // name of the last command run (cmd field of CLIENT LIST)
+
+	closeAfterReply bool // CLIENT KILL on itself: the connection is closed once the reply is sent
+
+	resp                 int                 // protocol version (HELLO). 2 by default, 3 gets push messages
+	subscriptions        map[string]struct{} // SUBSCRIBEd channels
+	patternSubscriptions map[string]struct{} // PSUBSCRIBEd patterns
+	tracking             ClientTracking      // CLIENT TRACKING state
+
+	createdAt       time.Time
+	lastInteraction time.Time
+
+	transaction  RedisTransaction // MULTI/EXEC and WATCH state
+	disconnected chan struct{}    // closed once the connection is gone, so blocked commands can give up
+	output       *OutputBuffer    // everything written to the client goes through it
+}
+
+// Data waiting to be written to a connection by its writer goroutine (see output.go).
+type OutputBuffer struct {
+	conn       net.Conn
+	mu         sync.Mutex // guards everything below, never held while writing
+	pending    []byte
+	limit      int // bytes pending past which the client is disconnected
+	timeout    time.Duration
+	overflowed bool          // went past the limit, the connection is closed
+	wake       chan struct{} // there is something to write
+	done       chan struct{} // closed once the client is freed
+
+	writeLock sync.Mutex // held while writing, keeps the queued data and direct writes in order
+}
+
+// CLIENT TRACKING state of a client (client side caching).
+type ClientTracking struct {
+	enabled  bool
+	bcast    bool     // broadcasting mode: invalidations for every key matching one of the prefixes, read or not
+	prefixes []string // BCAST prefixes ("" matches every key)
+	optin    bool     // only keys read right after CLIENT CACHING YES are tracked
+	optout   bool     // every key read is tracked, except right after CLIENT CACHING NO
+	noloop   bool     // no invalidations for the keys the client modified itself
+	redirect int      // id of the client the invalidations are sent to (0 sends them to this client)
+
+	caching bool // CLIENT CACHING was called, applies to the next command (or the next EXEC)
+}
+
+// CLIENT PAUSE state. Paused clients wait before running commands until the pause ends.
+type ClientPause struct {
+	active   bool
+	all      bool          // ALL pauses every command, WRITE only the ones that may write
+	until    time.Time     // the pause ends by itself at this time
+	unpaused chan struct{} // closed when the pause ends early (CLIENT UNPAUSE, or replaced by a new pause)
+}
 
-	transactions map[net.Conn]RedisTransaction
-	// transactions TransactionStore
+// State of a sentinel (--sentinel mode): the masters it monitors. Only touched under the
+// execution lock.
+type Sentinel struct {
+	myID         string                     // what the other sentinels know us by (hello messages, votes)
+	currentEpoch int                        // latest epoch seen. Every failover attempt starts a new one
+	announceIP   string                     // address advertised in hello messages (by default the one of the link)
+	announcePort int                        // 0 for the port we listen on
+	masters      map[string]*SentinelMaster // by name
+}
+
+// A master monitored by the sentinel, with its replicas and the other sentinels monitoring it.
+type SentinelMaster struct {
+	*SentinelInstance
+	name            string
+	quorum          int           // sentinels that have to agree the master is down to fail over
+	downAfter       time.Duration // an instance without a valid reply for this long is subjectively down
+	failoverTimeout time.Duration
+	parallelSyncs   int    // replicas pointed at the new master at the same time after a failover
+	authPass        string // password of the master and its replicas
+	configEpoch     int    // epoch of the failover that made the current master one
+
+	replicas  map[string]*SentinelInstance // by ip:port
+	sentinels map[string]*SentinelInstance // other sentinels, by run id
+
+	odown       bool
+	odownSince  time.Time
+	leader      string // who we voted for to fail over the master, in leaderEpoch
+	leaderEpoch int
+
+	failoverState     int // sentinelFailover*
+	failoverEpoch     int
+	failoverStartTime time.Time
+	failoverStateTime time.Time         // when failoverState last changed
+	forceFailover     bool              // SENTINEL FAILOVER: no agreement needed
+	promoted          *SentinelInstance // replica being turned into the new master
+}
+
+// Master, replica or other sentinel the sentinel keeps talking to.
+type SentinelInstance struct {
+	kind  string // "master", "slave" or "sentinel"
+	host  string
+	port  int
+	runID string
+	stop  chan struct{} // closed once the instance isn't monitored anymore
+
+	connected     bool      // the command link is up
+	lastAvail     time.Time // last valid reply to PING (or since when it's monitored)
+	lastPingReply time.Time // last reply to PING, valid or not
+	sdown         bool      // subjectively down: no valid reply for down-after-milliseconds
+	sdownSince    time.Time
+
+	// From its INFO, for masters and replicas.
+	infoRefresh      time.Time
+	roleReported     string
+	roleReportedTime time.Time
+	masterHost       string // master of a replica, as it sees it
+	masterPort       int
+	masterLinkUp     bool
+	masterLinkDown   time.Duration // for how long its link to the master has been down
+	priority         int           // replica-priority: lower goes first for promotion, 0 never
+	replOffset       int
+	reconf           int // sentinelReconf*, while a failover points the replicas at the new master
+	reconfSentTime   time.Time
+
+	// Other sentinels.
+	lastHello       time.Time
+	masterDown      bool      // it replied the master is down (SENTINEL IS-MASTER-DOWN-BY-ADDR)
+	masterDownReply time.Time // when it did
+	leader          string    // who it voted for, in leaderEpoch
+	leaderEpoch     int
+}
+
+// FAILOVER in progress, if any. Writes are paused until it's over.
+type Failover struct {
+	state    int    // failoverNone, failoverWaitForSync or failoverInProgress
+	host     string // the target replica (empty for the first one to catch up)
+	port     string
+	force    bool          // at the deadline, fail over to the target anyway
+	deadline time.Time     // zero if there's no timeout
+	offset   int           // replication offset the writes got paused at, the target has to catch up to it
+	unpaused chan struct{} // closed when the failover is over (done or aborted)
+}
+
+// ACL state of the server: every user, and the log of denied requests (ACL LOG).
+type RedisACL struct {
+	users     map[string]*ACLUser // users by name. there is always a "default" user
+	log       []*ACLLogEntry      // denied requests, newest first
+	nextLogID int                 // entry-id for the next log entry
+	file      string              // path to the aclfile (ACL LOAD/SAVE). empty if not configured
+}
+
+// A single acl user. Connections authenticate as one of these (AUTH), and every command
+// they run gets checked against the user's permissions.
+type ACLUser struct {
+	name      string
+	enabled   bool                // on/off. disabled users can't authenticate
+	nopass    bool                // any password is accepted
+	passwords map[string]struct{} // hex encoded sha-256 hashes of the valid passwords
+	root      *ACLSelector        // the user's own permissions
+	selectors []*ACLSelector      // extra permission sets. a command runs if the root or any selector allows it
+}
+
+// A set of acl permissions: the commands that can run, and the keys and channels they can touch.
+type ACLSelector struct {
+	commandRules    []string        // +cmd, -cmd, +@category, -@category rules, applied in order
+	keyPatterns     []ACLKeyPattern // glob patterns of the accessible keys
+	channelPatterns []string        // glob patterns of the accessible pub/sub channels
+}
+
+// Key pattern of an acl selector (~pattern, %R~pattern, %W~pattern).
+type ACLKeyPattern struct {
+	pattern string
+	read    bool
+	write   bool
+}
+
+// Entry in the ACL LOG. Similar denials close together in time are grouped in a single entry.
+type ACLLogEntry struct {
+	count      int    // number of times this denial happened
+	reason     string // auth, command, key or channel
+	context    string // toplevel or multi
+	object     string // the command, key or channel that was denied
+	username   string
+	clientInfo string
+	entryID    int
+	createdAt  time.Time
+	updatedAt  time.Time
 }
 
 type RedisTransaction struct {
 	active       bool       // if multi has been called on this connection. (server will queue all incoming commands until exec)
 	commandQueue [][]string // queues incoming commands from a connection into this server.
+	errored      bool       // a command was rejected while queueing (unknown/bad arity). EXEC will return EXECABORT.
+
+	watchedKeys map[WatchedKey]bool // keys WATCHed by this connection -> whether the key held a live value at WATCH time.
+	dirty       bool                // a watched key was modified since WATCH. EXEC will abort.
+}
+
+// A key in a specific database, as WATCHed by a transaction.
+type WatchedKey struct {
+	db  int
+	key string
+}
+
+// Entry in the command table. Describes a command the server can execute.
+type RedisCommand struct {
+	name       string   // lowercase command name
+	arity      int      // number of args including the name. negative for variadic commands (minimum number of args)
+	categories []string // acl categories the command belongs to (without the '@')
+
+	firstKey  int                              // index of the first key in the command (0 if it takes no keys)
+	lastKey   int                              // index of the last key. negative counts from the end (-1 is the last arg)
+	keyStep   int                              // step between keys (2 for key-value pairs)
+	keyAccess string                           // "R", "W" or "RW": what the command does with its keys (acl %R~/%W~ patterns)
+	getKeys   func(commands []string) []string // custom key extraction, for commands where the positions aren't enough
+
+	getKeyAccess func(commands []string) []string // access to each key, in getKeys order, for commands where it isn't the same for all of them
+
+	subcommands map[string]RedisCommand // container commands (ACL, CONFIG): the actual commands, by lowercase name
+}
+
+// A write waiting to be sent to the replicas, along with the database it applies to.
+type PropagatedCommand struct {
+	db   int
+	args []string
+}
+
+// Circular buffer holding the latest bytes of the replication stream. Replicas that lose the
+// link can catch up from it (partial resync) instead of transferring the whole dataset again.
+type ReplicationBacklog struct {
+	buffer  []byte // circular, len(buffer) is the backlog size
+	index   int    // where the next byte goes in buffer
+	histlen int    // number of valid bytes in buffer
+	end     int    // replication offset right after the last byte in the backlog
 }
 
 // Stores info for a single replica server.
 type Replica struct {
-	conn   net.Conn
-	offset int
+	conn      net.Conn
+	output    *OutputBuffer // the output buffer of the replica's client
+	capaEOF   bool          // it announced it can load diskless transfers (REPLCONF capa eof)
+	ackOffset int           // replication offset the replica last acknowledged (REPLCONF ACK)
+	ackTime   time.Time     // when it did
+	state     int           // replicaWaitBgsave, replicaSendBulk... (see fullsync.go)
+	pending   []byte        // replication stream held back until the replica is done with its snapshot
+}
+
+// Builds a listpack out of elements appended one by one (see listpack.go).
+type ListpackWriter struct {
+	data  []byte // header room, then the elements so far
+	count int    // number of elements
 }
@@ -15,19 +15,28 @@ func logAndExit(message string, err error) {
 	os.Exit(0)
 }
 
-// registers the replica that is now connected to (this) master server.
-func registerReplica(replicaConn net.Conn) {
-	CONFIG.replicas = append(
-		CONFIG.replicas,
-		Replica{
-			conn:   replicaConn,
-			offset: 0,
-		},
-	)
+// registers the replica that is now connected to (this) master server. A replica doing a full
+// sync starts out from the snapshot, on database 0. One doing a partial sync picks the stream
+// up where it left it, database included.
+func registerReplica(replicaConn net.Conn, fullSync bool) *Replica {
+	// From now on, the replication stream is kept around for replicas that need to catch up.
+	if CONFIG.replBacklog == nil {
+		CONFIG.replBacklog = newReplicationBacklog(CONFIG.replBacklogSize)
+	}
+
+	client := CONFIG.clients[replicaConn]
+	client.output.setLimits(replicaOutputBufferLimit, replTimeout)
+	replica := &Replica{conn: replicaConn, output: client.output, capaEOF: client.replCapaEOF, ackTime: time.Now(), state: replicaOnline}
+	CONFIG.replicas = append(CONFIG.replicas, replica)
+	if fullSync {
+		replica.state = replicaWaitBgsave
+		scheduleFullResync()
+	}
+	return replica
 }
 
 // Validates incoming stream entry ID, generates a new ID if the entry ID has auto-generate(*) as its value.
-func handleStreamEntryID(stream RedisStream, newEntryID string) (string, error) {
+func handleStreamEntryID(stream *RedisStream, newEntryID string) (string, error) {
 	// Generate a full entry ID if newEntryID is "*"
 	if newEntryID == "*" {
 		// ID generation logic goes here if needed
@@ -64,7 +73,7 @@ func handleStreamEntryID(stream RedisStream, newEntryID string) (string, error)
 	}
 
 	// Validate the full entry ID
-	isValid, err := validateStreamEntryID(newEntryID)
+	isValid, err := validateStreamEntryID(stream, newEntryID)
 	if !isValid || err != nil {
 		return "", err
 	}
@@ -74,7 +83,7 @@ func handleStreamEntryID(stream RedisStream, newEntryID string) (string, error)
 }
 
 // Validates the stream entry ID to be correct. error returned from this should be the reply on XADD if invalid.
-func validateStreamEntryID(entryID string) (bool, error) {
+func validateStreamEntryID(stream *RedisStream, entryID string) (bool, error) {
 	splitEntryID := strings.Split(entryID, "-")
 	if len(splitEntryID) != 2 {
 		return false, fmt.Errorf("invalid entry id given for stream")
@@ -87,9 +96,250 @@ func validateStreamEntryID(entryID string) (bool, error) {
 		return false, fmt.Errorf("ERR The ID specified in XADD must be greater than 0-0")
 	}
 
-	if entryID <= RDB.streamStore.lastStreamEntryID {
+	if len(stream.entryOrder) > 0 && compareStreamIDs(entryID, stream.entryOrder[len(stream.entryOrder)-1]) <= 0 {
 		return false, fmt.Errorf("ERR The ID specified in XADD is equal or smaller than the target stream top item")
 	}
 
 	return true, nil
 }
+
+// Compares two stream entry IDs (ms-seq) numerically. Returns -1, 0 or 1 like strings.Compare.
+// Comparing the raw strings breaks as soon as the timestamps have different lengths.
+func compareStreamIDs(a, b string) int {
+	aParts := strings.SplitN(a, "-", 2)
+	bParts := strings.SplitN(b, "-", 2)
+
+	aMs, _ := strconv.ParseUint(aParts[0], 10, 64)
+	bMs, _ := strconv.ParseUint(bParts[0], 10, 64)
+	if aMs != bMs {
+		if aMs < bMs {
+			return -1
+		}
+		return 1
+	}
+
+	var aSeq, bSeq uint64
+	if len(aParts) == 2 {
+		aSeq, _ = strconv.ParseUint(aParts[1], 10, 64)
+	}
+	if len(bParts) == 2 {
+		bSeq, _ = strconv.ParseUint(bParts[1], 10, 64)
+	}
+	if aSeq < bSeq {
+		return -1
+	} else if aSeq > bSeq {
+		return 1
+	}
+	return 0
+}
+
+// Returns the ID of the last entry in the stream stored at streamKey, or "0-0" if the
+// stream doesn't exist (yet). This is what '$' resolves to on XREAD.
+func lastStreamEntryID(db *RedisDatabase, streamKey string) string {
+	obj := db.lookupKey(streamKey)
+	if obj == nil || obj.objType != objStream {
+		return "0-0"
+	}
+	stream := obj.value.(*RedisStream)
+	if len(stream.entryOrder) == 0 {
+		return "0-0"
+	}
+	return stream.entryOrder[len(stream.entryOrder)-1]
+}
+
+// Registers a waiter on all the given stream keys. The returned channel gets signalled
+// whenever an entry is added to any of them. Has to be released with removeStreamWaiter.
+func addStreamWaiter(streamKeys []string) chan struct{} {
+	waiter := make(chan struct{}, 1)
+
+	streamWaiters.mu.Lock()
+	defer streamWaiters.mu.Unlock()
+	for _, streamKey := range streamKeys {
+		waiters, exists := streamWaiters.waiters[streamKey]
+		if !exists {
+			waiters = make(map[chan struct{}]struct{})
+			streamWaiters.waiters[streamKey] = waiters
+		}
+		waiters[waiter] = struct{}{}
+	}
+	return waiter
+}
+
+// Unregisters a waiter previously added with addStreamWaiter.
+func removeStreamWaiter(streamKeys []string, waiter chan struct{}) {
+	streamWaiters.mu.Lock()
+	defer streamWaiters.mu.Unlock()
+	for _, streamKey := range streamKeys {
+		waiters := streamWaiters.waiters[streamKey]
+		delete(waiters, waiter)
+		if len(waiters) == 0 {
+			delete(streamWaiters.waiters, streamKey)
+		}
+	}
+}
+
+// Wakes up every client blocked on the given stream key.
+func signalStreamWaiters(streamKey string) {
+	streamWaiters.mu.Lock()
+	defer streamWaiters.mu.Unlock()
+	for waiter := range streamWaiters.waiters[streamKey] {
+		select { // non blocking. a pending signal is just as good as a new one.
+		case waiter <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Returns true if the key currently holds a value that hasn't expired.
+func keyIsLive(db *RedisDatabase, key string) bool {
+	obj, exists := db.keys[key]
+	return exists && !obj.isExpired()
+}
+
+// Has to be called every time a key is modified (written, deleted, expired) in the keyspace.
+// Flags the transactions of every connection WATCHing the key as dirty, so their EXEC aborts,
+// and invalidates the key for the clients caching it (CLIENT TRACKING).
+func signalModifiedKey(db *RedisDatabase, key string) {
+	CONFIG.dirty++
+	for conn := range CONFIG.watchedKeys[WatchedKey{db.id, key}] {
+		clientTransaction(conn).dirty = true
+	}
+	invalidateTrackedKey(key)
+}
+
+// Starts WATCHing the key of the database on the given connection.
+func watchKey(conn net.Conn, db *RedisDatabase, key string) {
+	transaction := clientTransaction(conn)
+	if transaction.watchedKeys == nil {
+		transaction.watchedKeys = make(map[WatchedKey]bool)
+	}
+	watchedKey := WatchedKey{db.id, key}
+	if _, watching := transaction.watchedKeys[watchedKey]; watching {
+		return
+	}
+	transaction.watchedKeys[watchedKey] = keyIsLive(db, key)
+
+	watchers, exists := CONFIG.watchedKeys[watchedKey]
+	if !exists {
+		watchers = make(map[net.Conn]struct{})
+		CONFIG.watchedKeys[watchedKey] = watchers
+	}
+	watchers[conn] = struct{}{}
+}
+
+// Stops WATCHing every key on the given connection and clears its dirty flag.
+func unwatchAllKeys(conn net.Conn) {
+	transaction := clientTransaction(conn)
+	for watchedKey := range transaction.watchedKeys {
+		watchers := CONFIG.watchedKeys[watchedKey]
+		delete(watchers, conn)
+		if len(watchers) == 0 {
+			delete(CONFIG.watchedKeys, watchedKey)
+		}
+	}
+	transaction.watchedKeys = nil
+	transaction.dirty = false
+}
+
+// Returns true if one of the keys WATCHed by the connection held a value at WATCH time
+// that has expired since. Expiry is passive, so it never goes through signalModifiedKey.
+func watchedKeyExpired(conn net.Conn) bool {
+	for watchedKey, wasLive := range clientTransaction(conn).watchedKeys {
+		if wasLive && !keyIsLive(RDB.databases[watchedKey.db], watchedKey.key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches str against a glob-style pattern, with the same semantics redis uses everywhere
+// (KEYS, ACL key/channel patterns...): '*' matches any sequence of characters, '?' any single
+// character, '[abc]' one of the characters ('[a-z]' for ranges, '[^x]' to negate), and a
+// backslash matches the next character literally.
+func stringMatch(pattern, str string, nocase bool) bool {
+	// Iterative, remembering only the last star: when something after it fails to match, the
+	// star takes one more character and matching resumes from there. Earlier stars never need
+	// to be revisited, so a pattern like "*a*a*a...b" can't blow up the way recursion does.
+	p, s := 0, 0
+	star, starS := -1, 0
+	for p < len(pattern) || s < len(str) {
+		if p < len(pattern) {
+			if pattern[p] == '*' {
+				star, starS = p, s
+				p++
+				continue
+			}
+			if s < len(str) {
+				if next, match := _matchOne(pattern, p, str[s], nocase); match {
+					p, s = next, s+1
+					continue
+				}
+			}
+		}
+		if star >= 0 && starS < len(str) {
+			starS++
+			p, s = star+1, starS
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// Matches a single character against the pattern element at p ('?', a class, an escaped or a
+// plain character). Returns where the next element starts, and whether c matched.
+func _matchOne(pattern string, p int, c byte, nocase bool) (int, bool) {
+	switch pattern[p] {
+	case '?':
+		return p + 1, true
+
+	case '[':
+		p++
+		not := p < len(pattern) && pattern[p] == '^'
+		if not {
+			p++
+		}
+
+		match := false
+		for ; p < len(pattern) && pattern[p] != ']'; p++ { // unterminated class: the end closes it
+			if pattern[p] == '\\' && p+1 < len(pattern) {
+				p++
+				if _sameByte(pattern[p], c, nocase) {
+					match = true
+				}
+			} else if p+2 < len(pattern) && pattern[p+1] == '-' {
+				start, end, c := pattern[p], pattern[p+2], c
+				if start > end {
+					start, end = end, start
+				}
+				if nocase {
+					start, end, c = toLowerByte(start), toLowerByte(end), toLowerByte(c)
+				}
+				p += 2
+				if c >= start && c <= end {
+					match = true
+				}
+			} else if _sameByte(pattern[p], c, nocase) {
+				match = true
+			}
+		}
+		return p + 1, match != not
+
+	default:
+		if pattern[p] == '\\' && p+1 < len(pattern) {
+			p++
+		}
+		return p + 1, _sameByte(pattern[p], c, nocase)
+	}
+}
+
+func _sameByte(a, b byte, nocase bool) bool {
+	return a == b || (nocase && toLowerByte(a) == toLowerByte(b))
+}
+
+func toLowerByte(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + ('a' - 'A')
+	}
+	return c
+}
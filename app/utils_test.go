@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStringMatch(t *testing.T) {
+	tests := []struct {
+		pattern, str string
+		nocase       bool
+		want         bool
+	}{
+		{"*", "", false, true},
+		{"**", "", false, true},
+		{"*", "anything", false, true},
+		{"", "", false, true},
+		{"", "a", false, false},
+		{"a*", "a", false, true},
+		{"a*", "abc", false, true},
+		{"a*", "", false, false},
+		{"*a", "a", false, true},
+		{"*a*", "bab", false, true},
+		{"a*b*c", "abc", false, true},
+		{"a*b*c", "axxbyyc", false, true},
+		{"a*b*c", "axxbyy", false, false},
+		{"?", "a", false, true},
+		{"?", "", false, false},
+		{"?", "ab", false, false},
+		{"h?llo", "hello", false, true},
+		{"[abc]", "b", false, true},
+		{"[abc]", "d", false, false},
+		{"[^x]", "a", false, true},
+		{"[^x]", "x", false, false},
+		{"[^x]", "", false, false},
+		{"[a-c]", "b", false, true},
+		{"[a-c]", "d", false, false},
+		{"[c-a]", "b", false, true},
+		{"[A-C]", "b", true, true},
+		{"[A-C]", "b", false, false},
+		{"h[^e]llo", "hallo", false, true},
+		{"\\*", "*", false, true},
+		{"\\*", "a", false, false},
+		{"a\\?", "a?", false, true},
+		{"[\\]]", "]", false, true},
+		{"HELLO", "hello", true, true},
+		{"HELLO", "hello", false, false},
+		{"user:*:name", "user:42:name", false, true},
+		{"user:*:name", "user:42:age", false, false},
+		{"[\\A]", "a", true, true},
+		{"[\\A]", "a", false, false},
+		{"[abc", "b", false, true},
+		{"a\\", "a\\", false, true},
+		{strings.Repeat("*a", 14) + "b", strings.Repeat("a", 40), false, false},
+		{strings.Repeat("*a", 14) + "*", strings.Repeat("a", 40), false, true},
+		{strings.Repeat("a*", 50) + "b", strings.Repeat("a", 1000), false, false},
+	}
+	for _, test := range tests {
+		if got := stringMatch(test.pattern, test.str, test.nocase); got != test.want {
+			t.Errorf("stringMatch(%.40q, %q, %v) = %v, want %v", test.pattern, test.str, test.nocase, got, test.want)
+		}
+	}
+}